@@ -0,0 +1,317 @@
+package giffer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Archives are tar files holding a manifest followed by the gifs it lists.
+// Tar rather than zip, since zip's directory is at the end of the file: a tar
+// can be imported as it is read, from a pipe or a download.
+const (
+	archiveVersion  = 1
+	archiveManifest = "manifest.json"
+	archiveGifDir   = "gifs"
+)
+
+// ArchiveManifest lists the gifs in an archive.
+type ArchiveManifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Giffer is the version of giffer that made the archive.
+	Giffer  string         `json:"giffer"`
+	Entries []ArchiveEntry `json:"entries"`
+}
+
+// ArchiveEntry describes a gif in an archive.
+type ArchiveEntry struct {
+	Key string `json:"key"`
+	// File is the path of the gif within the archive.
+	File       string         `json:"file"`
+	FileName   string         `json:"filename"`
+	Size       int64          `json:"size"`
+	Checksum   string         `json:"checksum"`
+	Tags       []string       `json:"tags,omitempty"`
+	Provenance *Provenance    `json:"provenance,omitempty"`
+	Metadata   SourceMetadata `json:"metadata"`
+	Record     *RenderRecord  `json:"record,omitempty"`
+}
+
+// ExportFilter selects the gifs to export. Zero fields select every gif.
+type ExportFilter struct {
+	// Keys of the gifs to export.
+	Keys []string
+	// Tag that the gifs must have, ignoring case.
+	Tag string
+	// Since and Until bound when the gifs were created.
+	Since, Until time.Time
+}
+
+// Match reports whether the filter selects the entry.
+func (f ExportFilter) Match(e StoreEntry) bool {
+	if len(f.Keys) > 0 {
+		found := false
+		for _, key := range f.Keys {
+			found = found || key == e.Key
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Tag != "" && !e.HasTag(f.Tag) {
+		return false
+	}
+	if !f.Since.IsZero() && e.Created.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Created.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Export writes the gifs of the store that the filter selects to w, as a tar
+// archive that Import can read. Returns the manifest of the archive.
+func Export(s GifStore, w io.Writer, f ExportFilter) (*ArchiveManifest, error) {
+	entries, err := s.List(ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing gifs")
+	}
+	var (
+		manifest = &ArchiveManifest{
+			Version: archiveVersion,
+			Created: time.Now(),
+			Giffer:  Version,
+		}
+	)
+	for _, e := range entries {
+		if !f.Match(e) {
+			continue
+		}
+		img, ok, err := s.Lookup(e.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "loading %s", e.Key)
+		}
+		if !ok {
+			// Evicted since the listing.
+			continue
+		}
+		// The manifest comes before the gifs, so each gif is read once to
+		// describe it and again to archive it, rather than held in memory.
+		sum, size, err := hashContent(img.Content)
+		img.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s", e.Key)
+		}
+		manifest.Entries = append(manifest.Entries, ArchiveEntry{
+			Key:        e.Key,
+			File:       path.Join(archiveGifDir, e.Key+".gif"),
+			FileName:   img.FileName,
+			Size:       size,
+			Checksum:   sum,
+			Tags:       img.Tags,
+			Provenance: img.Provenance,
+			Metadata:   img.Metadata,
+			Record:     img.Record,
+		})
+	}
+	// The manifest comes first so that importing can stream the archive.
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding manifest")
+	}
+	tw := tar.NewWriter(w)
+	write := func(name string, r io.Reader, size int64, mod time.Time) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    size,
+			ModTime: mod,
+		}); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}
+	if err := write(archiveManifest, bytes.NewReader(data), int64(len(data)), manifest.Created); err != nil {
+		return nil, errors.Wrap(err, "writing manifest")
+	}
+	for _, e := range manifest.Entries {
+		mod := manifest.Created
+		if e.Record != nil {
+			mod = e.Record.Created
+		}
+		if err := exportGif(s, e, func(r io.Reader) error {
+			return write(e.File, r, e.Size, mod)
+		}); err != nil {
+			return nil, errors.Wrapf(err, "writing %s", e.Key)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, errors.Wrap(err, "finishing archive")
+	}
+	return manifest, nil
+}
+
+// exportGif looks up the gif that the entry describes, and writes its content
+// with write. It is an error for the gif to have changed since it was
+// described.
+func exportGif(s GifStore, e ArchiveEntry, write func(io.Reader) error) error {
+	img, ok, err := s.Lookup(e.Key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("removed while exporting")
+	}
+	defer img.Close()
+	if img.Size != e.Size {
+		return fmt.Errorf("changed while exporting")
+	}
+	return write(img.Content)
+}
+
+// Conflict decides what Import does with a gif whose key is already stored.
+type Conflict int
+
+const (
+	// ConflictSkip keeps the stored gif.
+	ConflictSkip Conflict = iota
+	// ConflictOverwrite replaces the stored gif.
+	ConflictOverwrite
+	// ConflictKeepBoth stores the imported gif under a new key, the original
+	// with a numbered suffix such as "key-2".
+	ConflictKeepBoth
+)
+
+// ParseConflict parses "skip", "overwrite" or "keep".
+func ParseConflict(s string) (Conflict, error) {
+	switch strings.ToLower(s) {
+	case "skip":
+		return ConflictSkip, nil
+	case "overwrite":
+		return ConflictOverwrite, nil
+	case "keep", "keep-both":
+		return ConflictKeepBoth, nil
+	}
+	return 0, fmt.Errorf("unknown conflict handling %q, want skip, overwrite or keep", s)
+}
+
+// Imported describes what Import did with a gif.
+type Imported struct {
+	Key string
+	// StoredAs is the key the gif was stored under, empty if it was
+	// skipped.
+	StoredAs string
+	// Replaced reports whether a stored gif was overwritten.
+	Replaced bool
+}
+
+// Import reads a tar archive written by Export into the store, resolving
+// gifs already stored under the same key as conflict says. Gifs are checked
+// against the checksums in the manifest, and archives listing keys that
+// can't name a gif are rejected. Returns what became of each gif, including
+// those imported before an error.
+func Import(s GifStore, r io.Reader, conflict Conflict) ([]Imported, error) {
+	var (
+		tr       = tar.NewReader(r)
+		manifest *ArchiveManifest
+		byFile   = make(map[string]ArchiveEntry)
+		imported []Imported
+	)
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing keys")
+	}
+	stored := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		stored[key] = true
+	}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, errors.Wrap(err, "reading archive")
+		}
+		if manifest == nil {
+			if h.Name != archiveManifest {
+				return nil, fmt.Errorf("archive starts with %s, not a manifest", h.Name)
+			}
+			manifest = &ArchiveManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, errors.Wrap(err, "decoding manifest")
+			}
+			if manifest.Version > archiveVersion {
+				return nil, fmt.Errorf("archive version %d is newer than this giffer supports", manifest.Version)
+			}
+			for _, e := range manifest.Entries {
+				// Keys name files in some stores, so an archive could
+				// otherwise write anywhere.
+				if err := checkKey(e.Key); err != nil {
+					return nil, errors.Wrap(err, "reading manifest")
+				}
+				byFile[e.File] = e
+			}
+			continue
+		}
+		e, ok := byFile[h.Name]
+		if !ok {
+			// Not listed, so not a gif of ours.
+			continue
+		}
+		result := Imported{Key: e.Key, StoredAs: e.Key}
+		if stored[e.Key] {
+			switch conflict {
+			case ConflictSkip:
+				imported = append(imported, Imported{Key: e.Key})
+				continue
+			case ConflictOverwrite:
+				result.Replaced = true
+			case ConflictKeepBoth:
+				for n := 2; stored[result.StoredAs]; n++ {
+					result.StoredAs = e.Key + "-" + strconv.Itoa(n)
+				}
+			}
+		}
+		// The archive can only be read through once, so each gif is
+		// spooled to disk for the store to read.
+		content, sum, size, err := spool("", tr)
+		if err != nil {
+			return imported, errors.Wrapf(err, "reading %s", e.Key)
+		}
+		if e.Checksum != "" && sum != e.Checksum {
+			content.Close()
+			return imported, fmt.Errorf("%s is damaged: checksum mismatch", e.Key)
+		}
+		err = s.Insert(result.StoredAs, &RenderedGif{
+			Content:    content,
+			Size:       size,
+			FileName:   e.FileName,
+			Provenance: e.Provenance,
+			Metadata:   e.Metadata,
+			Record:     e.Record,
+			Tags:       e.Tags,
+		})
+		content.Close()
+		if err != nil {
+			return imported, errors.Wrapf(err, "storing %s", e.Key)
+		}
+		stored[result.StoredAs] = true
+		imported = append(imported, result)
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("empty archive")
+	}
+	return imported, nil
+}
@@ -0,0 +1,263 @@
+package giffer_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackmordaunt/giffer"
+	"github.com/jackmordaunt/giffer/giffertest"
+)
+
+// day is when the gifs of the archive tests were made.
+var day = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// storeGif stores a synthetic gif of the given frames under key, made the given
+// number of days after day.
+func storeGif(t *testing.T, s giffer.GifStore, key string, frames, days int, tags ...string) {
+	t.Helper()
+	data := giffertest.SyntheticGIF(frames, 10)
+	err := s.Insert(key, &giffer.RenderedGif{
+		Content:  giffer.BytesContent(data),
+		Size:     int64(len(data)),
+		FileName: key + ".gif",
+		Record:   &giffer.RenderRecord{Created: day.AddDate(0, 0, days), Size: int64(len(data))},
+		Tags:     tags,
+	})
+	if err != nil {
+		t.Fatalf("storing %s: %v", key, err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := &giffer.GifDB{Dir: t.TempDir()}
+	storeGif(t, src, "a", 1, 0, "cats")
+	storeGif(t, src, "b", 2, 1, "Dogs")
+	storeGif(t, src, "c", 3, 2, "Cats", "dogs")
+	tests := []struct {
+		name   string
+		filter giffer.ExportFilter
+		want   []string
+	}{
+		{"all", giffer.ExportFilter{}, []string{"a", "b", "c"}},
+		{"keys", giffer.ExportFilter{Keys: []string{"a", "c", "missing"}}, []string{"a", "c"}},
+		{"tag", giffer.ExportFilter{Tag: "CATS"}, []string{"a", "c"}},
+		{"since", giffer.ExportFilter{Since: day.AddDate(0, 0, 1)}, []string{"b", "c"}},
+		{"until", giffer.ExportFilter{Until: day.AddDate(0, 0, 1)}, []string{"a"}},
+		{"range", giffer.ExportFilter{Since: day.AddDate(0, 0, 1), Until: day.AddDate(0, 0, 2)}, []string{"b"}},
+		{"combined", giffer.ExportFilter{Keys: []string{"a", "b"}, Tag: "dogs"}, []string{"b"}},
+		{"none", giffer.ExportFilter{Tag: "birds"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var archive bytes.Buffer
+			manifest, err := giffer.Export(src, &archive, tt.filter)
+			if err != nil {
+				t.Fatalf("exporting: %v", err)
+			}
+			if len(manifest.Entries) != len(tt.want) {
+				t.Errorf("exported %d gifs, want %d", len(manifest.Entries), len(tt.want))
+			}
+			dst := &giffer.GifDB{Dir: t.TempDir()}
+			imported, err := giffer.Import(dst, &archive, giffer.ConflictSkip)
+			if err != nil {
+				t.Fatalf("importing: %v", err)
+			}
+			var got []string
+			for _, im := range imported {
+				got = append(got, im.StoredAs)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("imported %v, want %v", got, tt.want)
+			}
+			for _, key := range tt.want {
+				if !bytes.Equal(content(t, dst, key), content(t, src, key)) {
+					t.Errorf("%s was imported with different content", key)
+				}
+			}
+			want, err := src.List(giffer.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := dst.List(giffer.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				for _, w := range want {
+					if w.Key != e.Key {
+						continue
+					}
+					if !reflect.DeepEqual(e.Tags, w.Tags) || !e.Created.Equal(w.Created) || e.Checksum != w.Checksum {
+						t.Errorf("%s was imported as %+v, want %+v", e.Key, e, w)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	src := &giffer.GifDB{Dir: t.TempDir()}
+	storeGif(t, src, "a", 1, 0)
+	storeGif(t, src, "b", 2, 0)
+	var archive bytes.Buffer
+	if _, err := giffer.Export(src, &archive, giffer.ExportFilter{}); err != nil {
+		t.Fatalf("exporting: %v", err)
+	}
+	tests := []struct {
+		name     string
+		conflict giffer.Conflict
+		want     []giffer.Imported
+		// kept is the key that the gif stored as a before the import ends
+		// up under, empty if it is replaced.
+		kept string
+	}{
+		{
+			name:     "skip",
+			conflict: giffer.ConflictSkip,
+			want:     []giffer.Imported{{Key: "a"}, {Key: "b", StoredAs: "b"}},
+			kept:     "a",
+		},
+		{
+			name:     "overwrite",
+			conflict: giffer.ConflictOverwrite,
+			want:     []giffer.Imported{{Key: "a", StoredAs: "a", Replaced: true}, {Key: "b", StoredAs: "b"}},
+		},
+		{
+			name:     "keep both",
+			conflict: giffer.ConflictKeepBoth,
+			want:     []giffer.Imported{{Key: "a", StoredAs: "a-3"}, {Key: "b", StoredAs: "b"}},
+			kept:     "a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := &giffer.GifDB{Dir: t.TempDir()}
+			storeGif(t, dst, "a", 5, 0)
+			storeGif(t, dst, "a-2", 6, 0)
+			before := content(t, dst, "a")
+			imported, err := giffer.Import(dst, bytes.NewReader(archive.Bytes()), tt.conflict)
+			if err != nil {
+				t.Fatalf("importing: %v", err)
+			}
+			if !reflect.DeepEqual(imported, tt.want) {
+				t.Errorf("imported %+v, want %+v", imported, tt.want)
+			}
+			for _, im := range imported {
+				if im.StoredAs != "" && !bytes.Equal(content(t, dst, im.StoredAs), content(t, src, im.Key)) {
+					t.Errorf("%s wasn't imported as %s", im.Key, im.StoredAs)
+				}
+			}
+			if tt.kept != "" && !bytes.Equal(content(t, dst, tt.kept), before) {
+				t.Errorf("the stored gif a isn't kept as %s", tt.kept)
+			}
+			if !bytes.Equal(content(t, dst, "a-2"), giffertest.SyntheticGIF(6, 10)) {
+				t.Errorf("an unrelated gif was replaced")
+			}
+		})
+	}
+}
+
+// writeArchive writes a tar archive with the manifest and files, in the form that
+// Export writes them.
+func writeArchive(t *testing.T, manifest giffer.ArchiveManifest, files map[string][]byte) *bytes.Buffer {
+	t.Helper()
+	var (
+		buf bytes.Buffer
+		tw  = tar.NewWriter(&buf)
+	)
+	write := func(name string, data []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("manifest.json", data)
+	for _, e := range manifest.Entries {
+		write(e.File, files[e.File])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestImportChecksumMismatch(t *testing.T) {
+	var (
+		gif = giffertest.SyntheticGIF(2, 10)
+		db  = &giffer.GifDB{Dir: t.TempDir()}
+	)
+	arc := writeArchive(t, giffer.ArchiveManifest{
+		Version: 1,
+		Entries: []giffer.ArchiveEntry{
+			{Key: "a", File: "gifs/a.gif", Size: int64(len(gif)), Checksum: "sha256:" + string(bytes.Repeat([]byte("0"), 64))},
+		},
+	}, map[string][]byte{"gifs/a.gif": gif})
+	if _, err := giffer.Import(db, arc, giffer.ConflictSkip); err == nil {
+		t.Errorf("imported a gif that doesn't match its checksum")
+	}
+	if got := keys(t, db); len(got) > 0 {
+		t.Errorf("stored %v, want nothing", got)
+	}
+}
+
+func TestImportMaliciousKeys(t *testing.T) {
+	gif := giffertest.SyntheticGIF(2, 10)
+	for _, key := range []string{
+		"../../x",
+		"../x",
+		"..",
+		".tmp-x",
+		"a/b",
+		`a\b`,
+		"/tmp/x",
+		"",
+	} {
+		t.Run(key, func(t *testing.T) {
+			var (
+				root = t.TempDir()
+				db   = &giffer.GifDB{Dir: filepath.Join(root, "a", "store")}
+			)
+			arc := writeArchive(t, giffer.ArchiveManifest{
+				Version: 1,
+				Entries: []giffer.ArchiveEntry{{Key: key, File: "gifs/x.gif", Size: int64(len(gif))}},
+			}, map[string][]byte{"gifs/x.gif": gif})
+			if _, err := giffer.Import(db, arc, giffer.ConflictOverwrite); err == nil {
+				t.Errorf("imported a gif under %q", key)
+			}
+			// Nothing is written outside the store.
+			filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() && !strings.HasPrefix(path, db.Dir+string(filepath.Separator)) {
+					t.Errorf("wrote %s outside the store", path)
+				}
+				return nil
+			})
+			// Nor can the key be used with the store directly.
+			data := giffertest.SyntheticGIF(1, 10)
+			if err := db.Insert(key, &giffer.RenderedGif{Content: giffer.BytesContent(data), Size: int64(len(data))}); err == nil {
+				t.Errorf("inserted a gif under %q", key)
+			}
+			if _, _, err := db.Lookup(key); err == nil {
+				t.Errorf("looked up %q", key)
+			}
+			if err := db.Delete(key); err == nil {
+				t.Errorf("deleted %q", key)
+			}
+		})
+	}
+}
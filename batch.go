@@ -0,0 +1,121 @@
+package giffer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Batch runs a job for each entry of a collection.
+type Batch struct {
+	// Concurrency is the number of jobs run at once. Non-positive runs one
+	// at a time.
+	Concurrency int
+	// Report, if not nil, is called as each job finishes. Calls are
+	// serialised, so Report needn't be safe for concurrent use.
+	Report func(BatchResult)
+}
+
+// BatchResult is the outcome of one job of a batch.
+type BatchResult struct {
+	// Index of the entry within the batch.
+	Index   int
+	Entry   Entry
+	Value   interface{}
+	Err     error
+	Elapsed time.Duration
+}
+
+// BatchSummary is the outcome of a batch.
+type BatchSummary struct {
+	// Results of each job, in the order of the entries.
+	Results []BatchResult
+	Elapsed time.Duration
+}
+
+// Failed returns the results of the jobs that failed.
+func (s *BatchSummary) Failed() []BatchResult {
+	var failed []BatchResult
+	for _, r := range s.Results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// String describes how many jobs succeeded and why the others failed.
+func (s *BatchSummary) String() string {
+	var (
+		b      strings.Builder
+		failed = s.Failed()
+	)
+	fmt.Fprintf(&b, "%d of %d succeeded in %s",
+		len(s.Results)-len(failed), len(s.Results), s.Elapsed.Round(time.Millisecond))
+	for _, r := range failed {
+		name := r.Entry.Title
+		if name == "" {
+			name = r.Entry.URL
+		}
+		fmt.Fprintf(&b, "\n  %d %s: %v", r.Index+1, name, r.Err)
+	}
+	return b.String()
+}
+
+// Run calls job for each entry, returning once every job has finished.
+// A job failing doesn't stop the others. Cancelling ctx does, in which case
+// the jobs that didn't start fail with the context's error.
+func (b Batch) Run(
+	ctx context.Context,
+	entries []Entry,
+	job func(ctx context.Context, e Entry) (interface{}, error),
+) *BatchSummary {
+	var (
+		began   = time.Now()
+		summary = &BatchSummary{Results: make([]BatchResult, len(entries))}
+		workers = b.Concurrency
+		indices = make(chan int)
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+	)
+	if workers <= 0 {
+		workers = 1
+	}
+	if workers > len(entries) {
+		workers = len(entries)
+	}
+	finish := func(r BatchResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		summary.Results[r.Index] = r
+		if b.Report != nil {
+			b.Report(r)
+		}
+	}
+	for ii := 0; ii < workers; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				r := BatchResult{Index: index, Entry: entries[index]}
+				start := time.Now()
+				if err := ctx.Err(); err != nil {
+					r.Err = err
+				} else {
+					r.Value, r.Err = job(ctx, r.Entry)
+				}
+				r.Elapsed = time.Since(start)
+				finish(r)
+			}
+		}()
+	}
+	for ii := range entries {
+		indices <- ii
+	}
+	close(indices)
+	wg.Wait()
+	summary.Elapsed = time.Since(began)
+	return summary
+}
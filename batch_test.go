@@ -0,0 +1,170 @@
+package giffer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackmordaunt/giffer"
+	"github.com/jackmordaunt/giffer/giffertest"
+)
+
+func TestBatchRun(t *testing.T) {
+	var entries []giffer.Entry
+	for ii := 0; ii < 10; ii++ {
+		entries = append(entries, giffer.Entry{URL: fmt.Sprintf("video-%d", ii), Title: fmt.Sprintf("Video %d", ii)})
+	}
+	var (
+		mu       sync.Mutex
+		running  int
+		peak     int
+		reported []int
+	)
+	b := giffer.Batch{
+		Concurrency: 3,
+		Report: func(r giffer.BatchResult) {
+			reported = append(reported, r.Index)
+		},
+	}
+	summary := b.Run(context.Background(), entries, func(ctx context.Context, e giffer.Entry) (interface{}, error) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if strings.HasSuffix(e.URL, "3") || strings.HasSuffix(e.URL, "7") {
+			return nil, errors.New("unavailable")
+		}
+		return strings.ToUpper(e.URL), nil
+	})
+	if peak > 3 {
+		t.Errorf("ran %d jobs at once, want at most 3", peak)
+	}
+	if len(reported) != len(entries) {
+		t.Errorf("reported %d results, want %d", len(reported), len(entries))
+	}
+	for ii, r := range summary.Results {
+		if r.Index != ii || r.Entry != entries[ii] {
+			t.Errorf("result %d is of entry %d %+v", ii, r.Index, r.Entry)
+		}
+		failed := ii == 3 || ii == 7
+		if (r.Err != nil) != failed {
+			t.Errorf("result %d has error %v, want failure %v", ii, r.Err, failed)
+		}
+		if !failed && r.Value != strings.ToUpper(entries[ii].URL) {
+			t.Errorf("result %d has value %v", ii, r.Value)
+		}
+	}
+	if failed := summary.Failed(); len(failed) != 2 || failed[0].Index != 3 || failed[1].Index != 7 {
+		t.Errorf("failed = %+v, want entries 3 and 7", failed)
+	}
+	s := summary.String()
+	for _, want := range []string{"8 of 10 succeeded", "4 Video 3: unavailable", "8 Video 7: unavailable"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("summary %q doesn't contain %q", s, want)
+		}
+	}
+}
+
+func TestBatchCancel(t *testing.T) {
+	entries := make([]giffer.Entry, 5)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var ran int
+	summary := giffer.Batch{}.Run(ctx, entries, func(ctx context.Context, e giffer.Entry) (interface{}, error) {
+		ran++
+		if ran == 2 {
+			cancel()
+		}
+		return nil, nil
+	})
+	if ran != 2 {
+		t.Errorf("ran %d jobs, want 2", ran)
+	}
+	for ii, r := range summary.Results[2:] {
+		if !errors.Is(r.Err, context.Canceled) {
+			t.Errorf("result %d has error %v, want it cancelled", ii+2, r.Err)
+		}
+	}
+}
+
+func TestBatchEmpty(t *testing.T) {
+	summary := giffer.Batch{Concurrency: 4}.Run(context.Background(), nil, func(ctx context.Context, e giffer.Entry) (interface{}, error) {
+		t.Errorf("ran a job without entries")
+		return nil, nil
+	})
+	if len(summary.Results) != 0 || summary.String() != "0 of 0 succeeded in "+summary.Elapsed.Round(time.Millisecond).String() {
+		t.Errorf("summary = %q", summary)
+	}
+}
+
+// TestBatchPlaylist renders a gif from each episode of a fake playlist, the
+// way the cli's -playlist does.
+func TestBatchPlaylist(t *testing.T) {
+	clips, err := giffertest.Clips(t.TempDir(), 5, 2*time.Second)
+	if err != nil {
+		t.Fatalf("making clips: %v", err)
+	}
+	// The third episode is missing.
+	clips[2].URL = filepath.Join(t.TempDir(), "missing.y4m")
+	p := &giffertest.Playlist{Lists: map[string][]giffer.Entry{"show": clips}}
+	dl := giffer.Downloader{Dir: t.TempDir(), Sources: p.Registry(), Backoff: time.Millisecond}
+	entries, err := dl.Expand(context.Background(), "playlist://show", giffer.Filter{Max: 4})
+	if err != nil {
+		t.Fatalf("expanding: %v", err)
+	}
+	eng := &giffer.Engine{Dir: t.TempDir()}
+	summary := giffer.Batch{Concurrency: 2}.Run(context.Background(), entries, func(ctx context.Context, e giffer.Entry) (interface{}, error) {
+		eng := eng.Fork()
+		defer eng.Clean()
+		clip, err := dl.DownloadContext(ctx, giffer.Request{URL: e.URL})
+		if err != nil {
+			return nil, err
+		}
+		path, err := eng.Transcode(clip.Path, 0.5, 1.5, 0, 0, 5)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		img, err := gif.DecodeAll(f)
+		if err != nil {
+			return nil, err
+		}
+		return len(img.Image), nil
+	})
+	if got := len(summary.Results); got != 4 {
+		t.Fatalf("ran %d jobs, want 4", got)
+	}
+	for ii, r := range summary.Results {
+		if ii == 2 {
+			if r.Err == nil {
+				t.Errorf("the missing episode succeeded")
+			}
+			continue
+		}
+		if r.Err != nil {
+			t.Errorf("episode %d failed: %v", ii+1, r.Err)
+		} else if r.Value != 5 {
+			t.Errorf("episode %d has %v frames, want 5", ii+1, r.Value)
+		}
+	}
+	if !strings.HasPrefix(summary.String(), "3 of 4 succeeded") {
+		t.Errorf("summary = %q", summary)
+	}
+}
@@ -0,0 +1,347 @@
+package giffer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DownloadCache keeps downloaded videos on disk so that they can be reused by
+// later clips of the same video.
+//
+// Each entry is a directory named by its key, holding the video and a json
+// file describing it. The modification time of the video records when the
+// entry was last used.
+type DownloadCache struct {
+	Dir string
+	// MaxBytes bounds the total size of the cached videos. When exceeded the
+	// least recently used entries are evicted. Zero is unbounded.
+	MaxBytes int64
+
+	mu sync.Mutex
+}
+
+// CacheEntry describes a cached video.
+type CacheEntry struct {
+	Key string `json:"key"`
+	// Source is the identity of the cached video, see Media.ID.
+	Source string `json:"source"`
+	Format string `json:"format,omitempty"`
+	// Offset of the video within the source, see Clip.Offset.
+	Offset float64 `json:"offset"`
+	// End of the video within the source, see Clip.End.
+	End float64 `json:"end,omitempty"`
+	// File is the name of the video within the entry's directory.
+	File string `json:"file"`
+	// Metadata describing the source video.
+	Metadata SourceMetadata `json:"metadata"`
+	Path     string         `json:"-"`
+	Size     int64          `json:"-"`
+	LastUsed time.Time      `json:"-"`
+}
+
+// Clip returns the cached video as a clip.
+func (e CacheEntry) Clip() Clip {
+	return Clip{Path: e.Path, Offset: e.Offset, End: e.End, Metadata: e.Metadata}
+}
+
+// Covers reports whether the cached video holds the range [start, end] of
+// the source.
+func (e CacheEntry) Covers(start, end float64) bool {
+	if e.End <= 0 {
+		return e.Offset <= start
+	}
+	return e.Offset <= start && end > start && end <= e.End
+}
+
+const (
+	cacheEntryFile = "entry.json"
+	partialDir     = ".partial"
+)
+
+// CacheKey derives the cache key for a download of m. The key depends on the
+// identity of the video and its format, not the URL it was requested by, so
+// that different URLs for the same video share an entry. Partial downloads
+// also depend on the range, which the Downloader aligns so that nearby clips
+// share it.
+func CacheKey(m *Media, start, end float64) (string, error) {
+	id := m.ID + "|" + m.Format
+	if end > start && m.Stream != "" {
+		id += fmt.Sprintf("|%f|%f", start, end)
+	}
+	return hash(id)
+}
+
+// Lookup finds the entry for key, marking it as used.
+func (c *DownloadCache) Lookup(key string) (CacheEntry, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.load(key)
+	if os.IsNotExist(err) {
+		return CacheEntry{}, false, nil
+	}
+	if err != nil {
+		return CacheEntry{}, false, err
+	}
+	now := time.Now()
+	if err := os.Chtimes(e.Path, now, now); err != nil {
+		return CacheEntry{}, false, errors.Wrap(err, "marking entry as used")
+	}
+	e.LastUsed = now
+	return e, true, nil
+}
+
+// Find looks for an entry of m that covers the range [start, end], either
+// the whole video or a range of it, marking it as used. The most recently
+// used is preferred.
+func (c *DownloadCache) Find(m *Media, start, end float64) (CacheEntry, bool, error) {
+	whole, err := CacheKey(m, 0, 0)
+	if err != nil {
+		return CacheEntry{}, false, err
+	}
+	if e, ok, err := c.Lookup(whole); err != nil || ok {
+		return e, ok, err
+	}
+	if end <= start || m.Stream == "" {
+		return CacheEntry{}, false, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, err := c.list()
+	if err != nil {
+		return CacheEntry{}, false, err
+	}
+	for _, e := range entries {
+		// Ranges cached before their end was recorded can't be told apart
+		// from whole videos, other than by their key.
+		if e.Source != m.ID || e.Format != m.Format || e.End <= 0 || !e.Covers(start, end) {
+			continue
+		}
+		now := time.Now()
+		if err := os.Chtimes(e.Path, now, now); err != nil {
+			return CacheEntry{}, false, errors.Wrap(err, "marking entry as used")
+		}
+		e.LastUsed = now
+		return e, true, nil
+	}
+	return CacheEntry{}, false, nil
+}
+
+// Commit moves the downloaded clip into the cache under key, then evicts
+// entries if the cache has grown too big. The new entry is never evicted.
+func (c *DownloadCache) Commit(key string, m *Media, clip Clip) (CacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir := filepath.Join(c.Dir, key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return CacheEntry{}, errors.Wrap(err, "preparing directories")
+	}
+	e := CacheEntry{
+		Key:      key,
+		Source:   m.ID,
+		Format:   m.Format,
+		Offset:   clip.Offset,
+		End:      clip.End,
+		File:     key + filepath.Ext(clip.Path),
+		Metadata: m.Metadata,
+	}
+	e.Path = filepath.Join(dir, e.File)
+	if err := moveFile(clip.Path, e.Path); err != nil {
+		return CacheEntry{}, errors.Wrap(err, "moving download into cache")
+	}
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return CacheEntry{}, errors.Wrap(err, "encoding entry")
+	}
+	if err := writeFileAtomic(filepath.Join(dir, cacheEntryFile), meta); err != nil {
+		return CacheEntry{}, errors.Wrap(err, "writing entry")
+	}
+	info, err := os.Stat(e.Path)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	e.Size, e.LastUsed = info.Size(), info.ModTime()
+	if _, err := c.evict(key); err != nil {
+		return CacheEntry{}, errors.Wrap(err, "evicting")
+	}
+	return e, nil
+}
+
+// partial returns the path that an in progress download for key is written
+// to. It lives outside of the entries, so it is neither listed nor evicted,
+// and persists so that interrupted downloads can be resumed.
+func (c *DownloadCache) partial(key, ext string) (string, error) {
+	dir := filepath.Join(c.Dir, partialDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, key+ext), nil
+}
+
+// Evict removes least recently used entries until the cache fits within
+// MaxBytes. Returns the evicted entries.
+func (c *DownloadCache) Evict() ([]CacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evict("")
+}
+
+// Remove the entry for key.
+func (c *DownloadCache) Remove(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return os.RemoveAll(filepath.Join(c.Dir, key))
+}
+
+// List the cached entries, most recently used first.
+func (c *DownloadCache) List() ([]CacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.list()
+}
+
+func (c *DownloadCache) list() ([]CacheEntry, error) {
+	dirs, err := ioutil.ReadDir(c.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []CacheEntry
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		e, err := c.load(d.Name())
+		if err != nil {
+			// Incomplete or foreign directories aren't entries.
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(ii, jj int) bool {
+		return entries[ii].LastUsed.After(entries[jj].LastUsed)
+	})
+	return entries, nil
+}
+
+// evict removes least recently used entries, other than keep, until the cache
+// fits.
+func (c *DownloadCache) evict(keep string) ([]CacheEntry, error) {
+	if c.MaxBytes <= 0 {
+		return nil, nil
+	}
+	entries, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	var evicted []CacheEntry
+	for ii := len(entries) - 1; ii >= 0 && total > c.MaxBytes; ii-- {
+		e := entries[ii]
+		if e.Key == keep {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(c.Dir, e.Key)); err != nil {
+			return evicted, err
+		}
+		total -= e.Size
+		evicted = append(evicted, e)
+	}
+	return evicted, nil
+}
+
+// load reads the entry for key.
+func (c *DownloadCache) load(key string) (CacheEntry, error) {
+	dir := filepath.Join(c.Dir, key)
+	data, err := ioutil.ReadFile(filepath.Join(dir, cacheEntryFile))
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	var e CacheEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return CacheEntry{}, errors.Wrap(err, "decoding entry")
+	}
+	e.Path = filepath.Join(dir, e.File)
+	info, err := os.Stat(e.Path)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	e.Size, e.LastUsed = info.Size(), info.ModTime()
+	return e, nil
+}
+
+// moveFile atomically moves src to dst. Renames can't cross filesystems, such
+// as when os.TempDir is a tmpfs, so in that case src is copied to a
+// temporary file beside dst which is then renamed into place.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path,
+// so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	return copyFileAtomic(path, bytes.NewReader(data))
+}
+
+// copyFileAtomic is writeFileAtomic for data read from r.
+func copyFileAtomic(path string, r io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
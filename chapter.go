@@ -0,0 +1,173 @@
+package giffer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chapter is a named section of a video. Times are in seconds.
+type Chapter struct {
+	Title string  `json:"title"`
+	Start float64 `json:"start"`
+	// End is 0 if unknown, which happens for the last chapter of a video of
+	// unknown duration.
+	End float64 `json:"end,omitempty"`
+}
+
+// ChapterRange selects a range of a video by chapter, rather than by time.
+type ChapterRange struct {
+	// Chapter is the title of a chapter, ignoring case, or its number
+	// counting from 1.
+	Chapter string
+	// Start is the offset in seconds of the range from the start of the
+	// chapter.
+	Start float64
+	// End is the offset in seconds of the end of the range from the start of
+	// the chapter. Non-positive values are offsets from the end of the
+	// chapter instead, so 0 ends the range with the chapter.
+	End float64
+}
+
+// Resolve finds the range within the chapters, in seconds.
+func (r ChapterRange) Resolve(chapters []Chapter) (start, end float64, err error) {
+	c, err := FindChapter(chapters, r.Chapter)
+	if err != nil {
+		return 0, 0, err
+	}
+	start = c.Start + r.Start
+	switch {
+	case r.End > 0:
+		end = c.Start + r.End
+	case c.End > 0:
+		end = c.End + r.End
+	default:
+		// The chapter runs to the end of the video.
+		end = 0
+	}
+	if end > 0 && end <= start {
+		return 0, 0, fmt.Errorf("range [%gs, %gs] of chapter %q is empty", start, end, c.Title)
+	}
+	return start, end, nil
+}
+
+// FindChapter finds a chapter by title, ignoring case, or by number counting
+// from 1. Titles take precedence, so that a chapter titled "2" can be found.
+func FindChapter(chapters []Chapter, name string) (Chapter, error) {
+	name = strings.TrimSpace(name)
+	for _, c := range chapters {
+		if strings.EqualFold(c.Title, name) {
+			return c, nil
+		}
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 1 || n > len(chapters) {
+			return Chapter{}, fmt.Errorf("no chapter %d, the video has %d", n, len(chapters))
+		}
+		return chapters[n-1], nil
+	}
+	return Chapter{}, fmt.Errorf("no chapter %q", name)
+}
+
+// chapterTimestamp matches timestamps such as "1:35" or "1:02:03" within a
+// line of a description.
+var chapterTimestamp = regexp.MustCompile(`\b(?:(\d+):)?(\d{1,2}):(\d{2})\b`)
+
+// ParseChapters finds a list of chapters in text such as a video's
+// description, one per line, eg "0:00 Intro" or "Part two - 1:35".
+// Like YouTube, the list must start at 0:00 with timestamps in order,
+// otherwise there are no chapters. Each chapter ends where the next begins,
+// and the last at the duration of the video, if known.
+func ParseChapters(text string, duration time.Duration) []Chapter {
+	var chapters []Chapter
+	for _, line := range strings.Split(text, "\n") {
+		loc := chapterTimestamp.FindStringSubmatchIndex(line)
+		if loc == nil {
+			continue
+		}
+		var (
+			m     = chapterTimestamp.FindStringSubmatch(line)
+			start float64
+		)
+		for _, part := range m[1:] {
+			v, _ := strconv.Atoi(part)
+			start = start*60 + float64(v)
+		}
+		title := strings.TrimSpace(line[:loc[0]] + " " + line[loc[1]:])
+		title = strings.Trim(title, " \t-–—:|()[]")
+		if len(chapters) == 0 && start != 0 {
+			// Timestamps before a list starts at 0:00 aren't chapters.
+			continue
+		}
+		if len(chapters) > 0 && start <= chapters[len(chapters)-1].Start {
+			return nil
+		}
+		chapters = append(chapters, Chapter{Title: title, Start: start})
+	}
+	if len(chapters) < 2 {
+		return nil
+	}
+	for ii := range chapters[:len(chapters)-1] {
+		chapters[ii].End = chapters[ii+1].Start
+	}
+	if duration > 0 {
+		chapters[len(chapters)-1].End = duration.Seconds()
+	}
+	return chapters
+}
+
+// probeChapters reads the chapters of a video's container with FFprobe.
+func probeChapters(ctx context.Context, ffprobe, video string) ([]Chapter, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffprobe,
+		"-v", "error",
+		"-print_format", "json",
+		"-show_chapters",
+		video,
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("probing chapters: %w: %s", err, stderr.String())
+	}
+	var probe struct {
+		Chapters []struct {
+			Start string            `json:"start_time"`
+			End   string            `json:"end_time"`
+			Tags  map[string]string `json:"tags"`
+		} `json:"chapters"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &probe); err != nil {
+		return nil, fmt.Errorf("decoding chapters: %w", err)
+	}
+	if len(probe.Chapters) == 0 {
+		return nil, nil
+	}
+	chapters := make([]Chapter, len(probe.Chapters))
+	for ii, c := range probe.Chapters {
+		chapters[ii].Start, _ = strconv.ParseFloat(c.Start, 64)
+		chapters[ii].End, _ = strconv.ParseFloat(c.End, 64)
+		chapters[ii].Title = c.Tags["title"]
+		if chapters[ii].Title == "" {
+			chapters[ii].Title = fmt.Sprintf("Chapter %d", ii+1)
+		}
+	}
+	return chapters, nil
+}
+
+// ffprobeFor finds FFprobe beside the FFmpeg binary, falling back to the one
+// on the path.
+func ffprobeFor(ffmpeg string) string {
+	dir, base := filepath.Split(ffmpeg)
+	if dir == "" {
+		return "ffprobe"
+	}
+	return filepath.Join(dir, strings.Replace(base, "ffmpeg", "ffprobe", 1))
+}
@@ -0,0 +1,218 @@
+package giffer_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackmordaunt/giffer"
+	"github.com/jackmordaunt/giffer/giffertest"
+)
+
+func TestParseChapters(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		duration time.Duration
+		want     []giffer.Chapter
+	}{
+		{
+			name:     "leading zero",
+			text:     "Songs:\n0:00 Intro\n1:35 - The Song\n1:02:03 Outro",
+			duration: 2 * time.Hour,
+			want: []giffer.Chapter{
+				{Title: "Intro", Start: 0, End: 95},
+				{Title: "The Song", Start: 95, End: 3723},
+				{Title: "Outro", Start: 3723, End: 7200},
+			},
+		},
+		{
+			name: "title first",
+			text: "Intro - 0:00\nPart two (1:35)\n[2:00] Part three",
+			want: []giffer.Chapter{
+				{Title: "Intro", Start: 0, End: 95},
+				{Title: "Part two", Start: 95, End: 120},
+				// The duration is unknown, so the last chapter's end is too.
+				{Title: "Part three", Start: 120},
+			},
+		},
+		{
+			name: "timestamps before the list",
+			text: "Skip to 3:00 for the good bit\n00:00 Start\n3:00 Good bit",
+			want: []giffer.Chapter{
+				{Title: "Start", Start: 0, End: 180},
+				{Title: "Good bit", Start: 180},
+			},
+		},
+		{
+			name: "no leading zero",
+			text: "0:30 Intro\n1:35 The Song\n2:00 Outro",
+		},
+		{
+			name: "out of order",
+			text: "0:00 Intro\n1:35 The Song\n1:00 Outro",
+		},
+		{
+			name: "one chapter",
+			text: "0:00 Intro",
+		},
+		{
+			name: "none",
+			text: "Thanks for watching!",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := giffer.ParseChapters(tt.text, tt.duration); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseChapters() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// chapters of a video whose duration is unknown.
+var chapters = []giffer.Chapter{
+	{Title: "Intro", Start: 0, End: 10},
+	{Title: "2", Start: 10, End: 40},
+	{Title: "Verse", Start: 40, End: 100},
+	{Title: "Outro", Start: 100},
+}
+
+func TestFindChapter(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  bool
+	}{
+		{name: "Intro", want: "Intro"},
+		{name: " verse ", want: "Verse"},
+		{name: "OUTRO", want: "Outro"},
+		{name: "1", want: "Intro"},
+		{name: "3", want: "Verse"},
+		{name: "4", want: "Outro"},
+		// Titles take precedence over numbers.
+		{name: "2", want: "2"},
+		{name: "0", err: true},
+		{name: "5", err: true},
+		{name: "-1", err: true},
+		{name: "Chorus", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := giffer.FindChapter(chapters, tt.name)
+			if tt.err {
+				if err == nil {
+					t.Errorf("found %+v, want an error", c)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("finding: %v", err)
+			}
+			if c.Title != tt.want {
+				t.Errorf("found %q, want %q", c.Title, tt.want)
+			}
+		})
+	}
+	if _, err := giffer.FindChapter(nil, "1"); err == nil {
+		t.Errorf("found a chapter of a video without any")
+	}
+}
+
+func TestChapterRangeResolve(t *testing.T) {
+	tests := []struct {
+		name       string
+		r          giffer.ChapterRange
+		start, end float64
+		err        bool
+	}{
+		{"whole", giffer.ChapterRange{Chapter: "Verse"}, 40, 100, false},
+		{"offsets", giffer.ChapterRange{Chapter: "Verse", Start: 5, End: 15}, 45, 55, false},
+		{"from the end", giffer.ChapterRange{Chapter: "Verse", End: -10}, 40, 90, false},
+		{"start and from the end", giffer.ChapterRange{Chapter: "3", Start: 20, End: -30}, 60, 70, false},
+		{"past the end", giffer.ChapterRange{Chapter: "Verse", End: 100}, 40, 140, false},
+		{"last", giffer.ChapterRange{Chapter: "Outro", Start: 5}, 105, 0, false},
+		{"last with end", giffer.ChapterRange{Chapter: "Outro", End: 20}, 100, 120, false},
+		// Without the chapter's end there is nothing to count back from,
+		// so the range runs to the end of the video.
+		{"last from the end", giffer.ChapterRange{Chapter: "Outro", End: -5}, 100, 0, false},
+		{"empty", giffer.ChapterRange{Chapter: "Verse", Start: 30, End: -30}, 0, 0, true},
+		{"backwards", giffer.ChapterRange{Chapter: "Verse", Start: 20, End: 10}, 0, 0, true},
+		{"missing", giffer.ChapterRange{Chapter: "Chorus"}, 0, 0, true},
+		{"out of range", giffer.ChapterRange{Chapter: "9"}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := tt.r.Resolve(chapters)
+			if tt.err {
+				if err == nil {
+					t.Errorf("resolved [%g, %g], want an error", start, end)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolving: %v", err)
+			}
+			if start != tt.start || end != tt.end {
+				t.Errorf("resolved [%g, %g], want [%g, %g]", start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestMetadataChapters(t *testing.T) {
+	h := harness(t)
+	sources := giffer.NewRegistry()
+	sources.RegisterScheme("range", rangeSource{})
+	dl := giffer.Downloader{FFmpeg: h.Path("ffmpeg"), Sources: sources}
+	if err := h.Script("ffprobe", giffertest.Script{Stdout: `{
+		"chapters": [
+			{"id": 0, "start_time": "0.000000", "end_time": "12.500000", "tags": {"title": "Intro"}},
+			{"id": 1, "start_time": "12.500000", "end_time": "100.000000"}
+		]
+	}`}); err != nil {
+		t.Fatal(err)
+	}
+	md, err := dl.Metadata(context.Background(), "range://video")
+	if err != nil {
+		t.Fatalf("reading metadata: %v", err)
+	}
+	want := []giffer.Chapter{
+		{Title: "Intro", Start: 0, End: 12.5},
+		{Title: "Chapter 2", Start: 12.5, End: 100},
+	}
+	if !reflect.DeepEqual(md.Chapters, want) {
+		t.Errorf("chapters = %+v, want %+v", md.Chapters, want)
+	}
+	calls, err := h.Calls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0].Tool != "ffprobe" {
+		t.Fatalf("calls = %+v, want one call to ffprobe", calls)
+	}
+	if args := calls[0].Args; len(args) == 0 || args[len(args)-1] != "range://video" {
+		t.Errorf("probed %q, want the stream", args)
+	}
+
+	// Containers without chapters, and failures to probe them, leave the
+	// video without chapters.
+	for _, script := range []giffertest.Script{
+		{Stdout: `{"chapters": []}`},
+		{Stdout: `{}`},
+		{Stderr: "range://video: Invalid data found", ExitCode: 1},
+		{Stdout: "not json"},
+	} {
+		if err := h.Script("ffprobe", script); err != nil {
+			t.Fatal(err)
+		}
+		md, err := dl.Metadata(context.Background(), "range://video")
+		if err != nil {
+			t.Fatalf("reading metadata: %v", err)
+		}
+		if md.Chapters != nil {
+			t.Errorf("chapters = %+v with ffprobe %+v, want none", md.Chapters, script)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackmordaunt/giffer"
+)
+
+// batch makes a gif from each video of the playlist at url, writing them
+// into the directory dest named by their titles. Videos with the same title
+// are told apart by a numbered suffix.
+func batch(dl giffer.Downloader, eng *giffer.Engine) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	filter := giffer.Filter{Max: maxVideos}
+	var err error
+	if include != "" {
+		if filter.Include, err = regexp.Compile(include); err != nil {
+			return fmt.Errorf("parsing -include: %w", err)
+		}
+	}
+	if exclude != "" {
+		if filter.Exclude, err = regexp.Compile(exclude); err != nil {
+			return fmt.Errorf("parsing -exclude: %w", err)
+		}
+	}
+	entries, err := dl.Expand(ctx, url, filter)
+	if err != nil {
+		return fmt.Errorf("expanding playlist: %w", err)
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("preparing destination: %w", err)
+	}
+	outs := &outputs{dir: dest}
+	b := giffer.Batch{
+		Concurrency: jobs,
+		Report: func(r giffer.BatchResult) {
+			if r.Err != nil {
+				fmt.Fprintf(os.Stderr, "%d/%d failed %s: %v\n", r.Index+1, len(entries), r.Entry.URL, r.Err)
+				return
+			}
+			fmt.Fprintf(os.Stderr, "%d/%d wrote %s\n", r.Index+1, len(entries), r.Value)
+		},
+	}
+	summary := b.Run(ctx, entries, func(ctx context.Context, e giffer.Entry) (interface{}, error) {
+		return render(ctx, dl, eng.Fork(), e.URL, outs)
+	})
+	fmt.Fprintln(os.Stderr, summary)
+	if failed := summary.Failed(); len(failed) > 0 {
+		return fmt.Errorf("%d of %d videos failed", len(failed), len(entries))
+	}
+	return nil
+}
+
+// render makes a gif from the video at url, writing it into outs named after
+// the video's title. Returns the path of the gif.
+func render(ctx context.Context, dl giffer.Downloader, eng *giffer.Engine, url string, outs *outputs) (string, error) {
+	defer eng.Clean()
+	from, to := start, end
+	if chapter != "" {
+		md, err := dl.Metadata(ctx, url)
+		if err != nil {
+			return "", fmt.Errorf("reading chapters: %w", err)
+		}
+		if from, to, err = chapterRange(md.Chapters); err != nil {
+			return "", fmt.Errorf("selecting chapter: %w", err)
+		}
+	}
+	job := giffer.JobSpec{
+		Source:   url,
+		Start:    from,
+		End:      to,
+		FPS:      fps,
+		Width:    width,
+		Height:   height,
+		Fuzz:     fuzz,
+		Download: format,
+	}
+	if img, ok := storedGif(job); ok {
+		defer img.Close()
+		out := outs.claim(img.FileName)
+		return out, saveGif(out, img.Content)
+	}
+	fetching := time.Now()
+	clip, err := dl.DownloadContext(ctx, giffer.Request{
+		URL:    url,
+		Start:  from,
+		End:    to,
+		Width:  width,
+		Height: height,
+		Format: format,
+	})
+	if err != nil {
+		return "", fmt.Errorf("downloading: %w", err)
+	}
+	fetched := sourceStage(clip, time.Since(fetching))
+	began := time.Now()
+	source := clip.Metadata.URL
+	if source == "" {
+		source = url
+	}
+	gif, err := eng.Transcode(clip.Path, from-clip.Offset, to-clip.Offset, width, height, fps)
+	if err != nil {
+		return "", fmt.Errorf("converting to gif: %w", err)
+	}
+	if err := eng.Crush(gif, fuzz); err != nil {
+		return "", fmt.Errorf("optimising gif: %w", err)
+	}
+	if err := eng.Stamp(gif, giffer.Provenance{
+		Source: source,
+		Title:  clip.Metadata.Title,
+		Author: clip.Metadata.Author,
+		Start:  from,
+		End:    to,
+		FPS:    fps,
+	}); err != nil {
+		return "", fmt.Errorf("stamping provenance: %w", err)
+	}
+	if err := keepGif(job, gif, clip.Metadata, time.Since(began)); err != nil {
+		return "", fmt.Errorf("storing gif: %w", err)
+	}
+	out := outs.claim(clip.Metadata.FileName(".gif"))
+	reportStages(out, fetched, eng)
+	in, err := os.Open(gif)
+	if err != nil {
+		return "", fmt.Errorf("opening gif file: %w", err)
+	}
+	defer in.Close()
+	f, err := os.Create(out)
+	if err != nil {
+		return "", fmt.Errorf("creating %s: %w", out, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, in); err != nil {
+		return "", fmt.Errorf("writing gif to file: %w", err)
+	}
+	return out, f.Close()
+}
+
+// outputs hands out the paths of the gifs written by a batch, so that videos
+// with the same title don't overwrite each other. Files left in dir by
+// earlier batches are overwritten.
+type outputs struct {
+	dir   string
+	mu    sync.Mutex
+	taken map[string]bool
+}
+
+// claim returns a path in the directory for a file named name, or if that has
+// already been claimed, for name with the lowest free suffix, eg "title (2).gif".
+func (o *outputs) claim(name string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.taken == nil {
+		o.taken = make(map[string]bool)
+	}
+	var (
+		ext  = filepath.Ext(name)
+		base = strings.TrimSuffix(name, ext)
+	)
+	for ii := 2; o.taken[strings.ToLower(name)]; ii++ {
+		name = fmt.Sprintf("%s (%d)%s", base, ii, ext)
+	}
+	// Names differing only in case are the same file on some systems.
+	o.taken[strings.ToLower(name)] = true
+	return filepath.Join(o.dir, name)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jackmordaunt/giffer"
+)
+
+func TestBatchDuplicateTitles(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		outs    = &outputs{dir: dir}
+		entries = []giffer.Entry{
+			{URL: "https://youtu.be/a", Title: "Intro"},
+			{URL: "https://youtu.be/b", Title: "Intro"},
+			{URL: "https://youtu.be/c", Title: "intro"},
+			{URL: "https://youtu.be/d", Title: "Intro (2)"},
+			{URL: "https://youtu.be/e", Title: "Outro"},
+		}
+	)
+	summary := giffer.Batch{Concurrency: len(entries)}.Run(
+		context.Background(),
+		entries,
+		func(ctx context.Context, e giffer.Entry) (interface{}, error) {
+			out := outs.claim(giffer.SourceMetadata{Title: e.Title}.FileName(".gif"))
+			return out, saveGif(out, strings.NewReader(e.URL))
+		},
+	)
+	if failed := summary.Failed(); len(failed) > 0 {
+		t.Fatalf("failed: %v", failed[0].Err)
+	}
+	written := make(map[string]string)
+	for _, r := range summary.Results {
+		out := r.Value.(string)
+		if prev, ok := written[strings.ToLower(out)]; ok {
+			t.Errorf("%s and %s both written to %s", prev, r.Entry.URL, out)
+		}
+		written[strings.ToLower(out)] = r.Entry.URL
+		b, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != r.Entry.URL {
+			t.Errorf("%s holds %q, want %q", out, b, r.Entry.URL)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Which of the same titled videos gets which name depends on the order
+	// they finish in.
+	if len(files) != len(entries) {
+		t.Errorf("wrote %d files, want %d", len(files), len(entries))
+	}
+}
+
+func TestOutputsClaim(t *testing.T) {
+	outs := &outputs{dir: "out"}
+	for _, tt := range []struct{ name, want string }{
+		{"a.gif", "a.gif"},
+		{"a.gif", "a (2).gif"},
+		{"A.gif", "A (3).gif"},
+		{"a (2).gif", "a (2) (2).gif"},
+		{"b", "b"},
+		{"b", "b (2)"},
+	} {
+		if got := outs.claim(tt.name); got != filepath.Join("out", tt.want) {
+			t.Errorf("claim(%q) = %q, want %q", tt.name, got, filepath.Join("out", tt.want))
+		}
+	}
+}
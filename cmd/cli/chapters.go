@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/jackmordaunt/giffer"
+)
+
+// chaptersOf looks up the chapters of the video at url, or of videofile.
+func chaptersOf(ctx context.Context, dl giffer.Downloader, eng *giffer.Engine) ([]giffer.Chapter, error) {
+	if url != "" {
+		md, err := dl.Metadata(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		return md.Chapters, nil
+	}
+	return eng.Chapters(videofile)
+}
+
+// listChapters prints the chapters of the video as a table.
+func listChapters(dl giffer.Downloader, eng *giffer.Engine) error {
+	chapters, err := chaptersOf(context.Background(), dl, eng)
+	if err != nil {
+		return fmt.Errorf("reading chapters: %w", err)
+	}
+	if len(chapters) == 0 {
+		fmt.Fprintln(os.Stderr, "no chapters")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tstart\tend\ttitle")
+	for ii, c := range chapters {
+		fmt.Fprintf(tw, "%d\t%g\t%g\t%s\n", ii+1, c.Start, c.End, c.Title)
+	}
+	return tw.Flush()
+}
+
+// chapterRange resolves -chapter within the chapters, with -s and -e as
+// offsets within the chapter.
+func chapterRange(chapters []giffer.Chapter) (float64, float64, error) {
+	if len(chapters) == 0 {
+		return 0, 0, fmt.Errorf("the video has no chapters")
+	}
+	return giffer.ChapterRange{
+		Chapter: chapter,
+		Start:   start,
+		End:     end,
+	}.Resolve(chapters)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/jackmordaunt/giffer"
+)
+
+// inspect prints the structure of each gif file named in args.
+func inspect(args []string) error {
+	var (
+		fs     = flag.NewFlagSet("inspect", flag.ExitOnError)
+		asJSON = fs.Bool("json", false, "print as json")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s inspect [-json] file.gif...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	for _, path := range fs.Args() {
+		info, err := inspectFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(info); err != nil {
+				return fmt.Errorf("encoding json: %w", err)
+			}
+			continue
+		}
+		printInfo(os.Stdout, path, info)
+	}
+	return nil
+}
+
+func inspectFile(path string) (*giffer.GifInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return giffer.Inspect(f)
+}
+
+// printInfo writes the info as a human readable table.
+func printInfo(w io.Writer, path string, info *giffer.GifInfo) {
+	fmt.Fprintf(w, "%s: %s\n", path, info)
+	fmt.Fprintf(w, "global palette: %d\n", info.GlobalPalette)
+	fmt.Fprintf(w, "transparency: %t\n", info.Transparency)
+	if p := info.Provenance; p != nil {
+		fmt.Fprintf(w, "source: %s [%gs, %gs] at %gfps\n", p.Source, p.Start, p.End, p.FPS)
+		if p.Title != "" {
+			fmt.Fprintf(w, "title: %s by %s\n", p.Title, p.Author)
+		}
+		fmt.Fprintf(w, "made by: giffer %s, ffmpeg %s\n", p.Giffer, p.FFmpeg)
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "frame\tdelay\tdisposal\tbounds\tpalette\ttransparent\tbytes\t")
+	for ii, f := range info.Frames {
+		palette := "global"
+		if f.LocalPalette > 0 {
+			palette = fmt.Sprintf("local %d", f.LocalPalette)
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%v\t%s\t%t\t%d\t\n",
+			ii, f.Delay, f.Disposal, f.Bounds, palette, f.Transparent, f.Size)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
 
@@ -12,18 +17,47 @@ import (
 )
 
 var (
-	videofile string
-	start     float64
-	end       float64
-	dest      string
-	fps       float64
-	width     int
-	height    int
-	url       string
-	debug     bool
+	videofile  string
+	start      float64
+	end        float64
+	dest       string
+	fps        float64
+	width      int
+	height     int
+	url        string
+	debug      bool
+	provenance string
+	via        string
+	format     string
+	cacheMax   int64
+	playlist   bool
+	include    string
+	exclude    string
+	maxVideos  int
+	jobs       int
+	chapter    string
+	chapters   bool
+	useStore   bool
+	tags       string
+	stages     bool
 )
 
+// fuzz is the crush level of the gifs made.
+const fuzz = 4
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		if err := inspect(os.Args[2:]); err != nil {
+			log.Fatalf("inspecting: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "store" {
+		if err := store(os.Args[2:]); err != nil {
+			log.Fatalf("store: %v", err)
+		}
+		return
+	}
 	flag.StringVar(&videofile, "v", "", "path to video file to gifify")
 	flag.StringVar(&url, "url", "", "url to video file to gifenate")
 	flag.Float64Var(&start, "s", 0.0, "time in seconds to start the gif")
@@ -33,8 +67,49 @@ func main() {
 	flag.IntVar(&height, "height", 0, "height in pixels of the output frames")
 	flag.Float64Var(&fps, "fps", 24, "frames per second")
 	flag.BoolVar(&debug, "debug", false, "debug mode")
+	flag.StringVar(&format, "format", "", "download this format (an itag or quality such as 720p) instead of choosing one")
+	flag.StringVar(&via, "via", "", "fetch urls with an external command such as yt-dlp")
+	flag.Int64Var(&cacheMax, "cache-max", 0, "evict least recently used downloads once the cache exceeds this many megabytes (0 is unbounded)")
+	flag.StringVar(&provenance, "provenance", "", "embed provenance metadata: comment, xmp or both (comma separated)")
+	flag.BoolVar(&playlist, "playlist", false, "make a gif from each video of the playlist or channel at -url, into the directory -dest")
+	flag.StringVar(&include, "include", "", "with -playlist, only videos with titles matching this regular expression")
+	flag.StringVar(&exclude, "exclude", "", "with -playlist, skip videos with titles matching this regular expression")
+	flag.IntVar(&maxVideos, "max", 0, "with -playlist, the maximum number of videos (0 is unlimited)")
+	flag.IntVar(&jobs, "jobs", 2, "with -playlist, the number of videos processed at once")
+	flag.StringVar(&chapter, "chapter", "", "make the gif from this chapter, by title or number, with -s and -e as offsets within it (-e 0 or less counts back from the chapter's end)")
+	flag.BoolVar(&chapters, "chapters", false, "list the chapters of the video and exit")
+	flag.BoolVar(&useStore, "store", false, "reuse gifs from, and add gifs to, the store shared with the gui, GIFFER_STORE if set")
+	flag.StringVar(&tags, "tag", "", "with -store, tag the gifs added to the store (comma separated)")
+	flag.BoolVar(&stages, "stages", false, "cache the stages of rendering, so that rendering again only reruns the stages that changed, and report which were cached")
 	flag.Parse()
-	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+	stamp, err := parseProvenance(provenance)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if chapters {
+		if err := listChapters(newDownloader(), newEngine(stamp)); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+	if url != "" && chapter == "" {
+		startFromURL(url)
+	}
+	if playlist {
+		if err := batch(newDownloader(), newEngine(stamp)); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+	// offset is the time in the source video at which videofile begins.
+	var (
+		offset float64
+		meta   giffer.SourceMetadata
+		job    giffer.JobSpec
+		// fetched is the source stage, when the video came from a url.
+		fetched *giffer.StageResult
+	)
+	if fromStdin() {
 		tmp, err := os.Create("tmp")
 		if err != nil {
 			log.Fatalf("creating temporary file: %v", err)
@@ -47,48 +122,245 @@ func main() {
 		tmp.Close()
 		videofile = "tmp"
 	} else if url != "" {
-		dl := giffer.Downloader{
-			Dir:    "./tmp/dl",
-			FFmpeg: "ffmpeg",
-			Debug:  debug,
-			Out:    os.Stdout,
+		dl := newDownloader()
+		dl.Progress = func(p giffer.DownloadProgress) {
+			fmt.Fprintf(os.Stderr, "\rdownloading: %-60s", p)
 		}
-		downloaded, err := dl.Download(url, start, end)
+		// Interrupting leaves the partial download in place, to be resumed
+		// by the next run.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		if chapter != "" {
+			md, err := dl.Metadata(ctx, url)
+			if err != nil {
+				log.Fatalf("reading chapters: %v", err)
+			}
+			if start, end, err = chapterRange(md.Chapters); err != nil {
+				log.Fatalf("selecting chapter: %v", err)
+			}
+		}
+		job = giffer.JobSpec{
+			Source:   url,
+			Start:    start,
+			End:      end,
+			FPS:      fps,
+			Width:    width,
+			Height:   height,
+			Fuzz:     fuzz,
+			Download: format,
+		}
+		if img, ok := storedGif(job); ok {
+			stop()
+			err := writeGif(img.Content)
+			img.Close()
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			return
+		}
+		fetching := time.Now()
+		clip, err := dl.DownloadContext(ctx, giffer.Request{
+			URL:    url,
+			Start:  start,
+			End:    end,
+			Width:  width,
+			Height: height,
+			Format: format,
+		})
+		stop()
+		fmt.Fprintln(os.Stderr)
 		if err != nil {
 			log.Fatalf("downloading: %v", err)
 		}
-		videofile = downloaded
+		videofile = clip.Path
+		offset = clip.Offset
+		meta = clip.Metadata
+		fetched = sourceStage(clip, time.Since(fetching))
 	}
-	t := giffer.Engine{
-		FFmpeg:  "ffmpeg",
-		Convert: "convert",
-		Debug:   debug,
-		Out:     os.Stdout,
+	t := newEngine(stamp)
+	if chapter != "" && url == "" {
+		chapters, err := t.Chapters(videofile)
+		if err != nil {
+			log.Fatalf("reading chapters: %v", err)
+		}
+		if start, end, err = chapterRange(chapters); err != nil {
+			log.Fatalf("selecting chapter: %v", err)
+		}
 	}
-	gif, err := t.Transcode(videofile, 0, 0, width, height, fps)
+	began := time.Now()
+	gif, err := t.Transcode(videofile, start-offset, end-offset, width, height, fps)
 	if err != nil {
 		log.Fatalf("converting to gif: %v", err)
 	}
-	if err := t.Crush(gif, 4); err != nil {
+	if err := t.Crush(gif, fuzz); err != nil {
 		log.Fatalf("optimising gif: %v", err)
 	}
+	source := meta.URL
+	if source == "" {
+		source = url
+	}
+	if source == "" {
+		source = videofile
+	}
+	if err := t.Stamp(gif, giffer.Provenance{
+		Source: source,
+		Title:  meta.Title,
+		Author: meta.Author,
+		Start:  start,
+		End:    end,
+		FPS:    fps,
+	}); err != nil {
+		log.Fatalf("stamping provenance: %v", err)
+	}
 	defer t.Clean()
-	var out io.WriteCloser
-	if terminal.IsTerminal(int(os.Stdout.Fd())) {
-		out = os.Stdout
-	} else {
-		out, err = os.Open(dest)
-		if err != nil {
-			log.Fatalf("opening destination file: %v", err)
+	reportStages(dest, fetched, t)
+	if job.Source != "" {
+		if err := keepGif(job, gif, meta, time.Since(began)); err != nil {
+			log.Printf("storing gif: %v", err)
 		}
 	}
-	defer out.Close()
 	gifFile, err := os.Open(gif)
 	if err != nil {
 		log.Fatalf("opening gif file: %v", err)
 	}
 	defer gifFile.Close()
-	if _, err := io.Copy(out, gifFile); err != nil {
-		log.Fatalf("writing gif to file: %v", err)
+	if err := writeGif(gifFile); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// isTerminal reports whether f is a terminal.
+var isTerminal = func(f *os.File) bool {
+	return terminal.IsTerminal(int(f.Fd()))
+}
+
+// fromStdin reports whether the video is read from stdin, which is when it's
+// piped in and no other video was given.
+func fromStdin() bool {
+	return url == "" && videofile == "" && !isTerminal(os.Stdin)
+}
+
+// writeGif writes the gif to stdout when it's piped, or else to dest.
+func writeGif(gif io.Reader) error {
+	if !isTerminal(os.Stdout) {
+		if _, err := io.Copy(os.Stdout, gif); err != nil {
+			return fmt.Errorf("writing gif: %w", err)
+		}
+		return nil
 	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("creating destination file: %w", err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, gif); err != nil {
+		return fmt.Errorf("writing gif to file: %w", err)
+	}
+	return out.Close()
+}
+
+// clipLength is the length in seconds of the clip made from a url timestamp
+// when no end is given.
+const clipLength = 3
+
+// startFromURL defaults start and end to the time the url links to, such as
+// "?t=95", unless they were given as flags.
+func startFromURL(url string) {
+	from, to, ok := giffer.URLTimes(url)
+	if !ok {
+		return
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["s"] {
+		start = from
+	}
+	if !set["e"] {
+		if to > start {
+			end = to
+		} else {
+			end = start + clipLength
+		}
+	}
+}
+
+func newDownloader() giffer.Downloader {
+	dl := giffer.Downloader{
+		Dir:    "./tmp/dl",
+		FFmpeg: "ffmpeg",
+		Debug:  debug,
+		Out:    os.Stdout,
+		Cache: &giffer.DownloadCache{
+			Dir:      "./tmp/dl",
+			MaxBytes: cacheMax << 20,
+		},
+	}
+	if via != "" {
+		dl.Sources = viaCommand(via)
+	}
+	return dl
+}
+
+func newEngine(stamp giffer.ProvenanceFormat) *giffer.Engine {
+	eng := &giffer.Engine{
+		FFmpeg:     "ffmpeg",
+		Convert:    "convert",
+		Debug:      debug,
+		Out:        os.Stdout,
+		Provenance: stamp,
+	}
+	if stages {
+		eng.Cache = &giffer.StageCache{
+			Dir:      "./tmp/stages",
+			MaxBytes: 1 << 30,
+		}
+	}
+	return eng
+}
+
+// sourceStage describes the download of clip as a stage.
+func sourceStage(clip giffer.Clip, elapsed time.Duration) *giffer.StageResult {
+	return &giffer.StageResult{Stage: giffer.StageSource, Hit: clip.Cached, Elapsed: elapsed}
+}
+
+// reportStages prints, with -stages, which stages of rendering the gif were
+// cached. source is the download, if there was one.
+func reportStages(gif string, source *giffer.StageResult, eng *giffer.Engine) {
+	if !stages {
+		return
+	}
+	report := eng.Stages
+	if source != nil {
+		report = append(giffer.StageReport{*source}, report...)
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s\n", gif, report)
+}
+
+// parseProvenance parses a comma separated list of provenance formats.
+func parseProvenance(s string) (giffer.ProvenanceFormat, error) {
+	var format giffer.ProvenanceFormat
+	for _, f := range strings.Split(s, ",") {
+		switch strings.TrimSpace(f) {
+		case "":
+		case "comment":
+			format |= giffer.ProvenanceComment
+		case "xmp":
+			format |= giffer.ProvenanceXMP
+		default:
+			return 0, fmt.Errorf("unknown provenance format %q", f)
+		}
+	}
+	return format, nil
+}
+
+// viaCommand routes every url through the external command, while still
+// handling local paths directly.
+func viaCommand(command string) *giffer.Registry {
+	var (
+		r   = giffer.NewRegistry()
+		src = giffer.CommandSource{Command: command}
+	)
+	r.RegisterScheme("http", src)
+	r.RegisterScheme("https", src)
+	r.RegisterScheme("file", giffer.FileSource{})
+	return r
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeTerminal makes isTerminal report the given files as terminals for the
+// duration of the test.
+func fakeTerminal(t *testing.T, terminals ...*os.File) {
+	t.Helper()
+	orig := isTerminal
+	t.Cleanup(func() { isTerminal = orig })
+	isTerminal = func(f *os.File) bool {
+		for _, term := range terminals {
+			if f == term {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestFromStdin(t *testing.T) {
+	defer func(u, v string) { url, videofile = u, v }(url, videofile)
+	tests := []struct {
+		name     string
+		url      string
+		video    string
+		terminal bool
+		want     bool
+	}{
+		{"piped", "", "", false, true},
+		{"terminal", "", "", true, false},
+		{"url", "https://youtu.be/abc", "", false, false},
+		{"video", "", "movie.mp4", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.terminal {
+				fakeTerminal(t, os.Stdin)
+			} else {
+				fakeTerminal(t)
+			}
+			url, videofile = tt.url, tt.video
+			if got := fromStdin(); got != tt.want {
+				t.Errorf("fromStdin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteGif(t *testing.T) {
+	defer func(d string, out *os.File) { dest, os.Stdout = d, out }(dest, os.Stdout)
+	dir := t.TempDir()
+
+	t.Run("dest", func(t *testing.T) {
+		fakeTerminal(t, os.Stdout)
+		dest = filepath.Join(dir, "movie.gif")
+		for _, gif := range []string{"GIF89a first", "GIF89a second"} {
+			if err := writeGif(strings.NewReader(gif)); err != nil {
+				t.Fatalf("writing: %v", err)
+			}
+			b, err := ioutil.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != gif {
+				t.Errorf("dest holds %q, want %q", b, gif)
+			}
+		}
+	})
+
+	t.Run("piped", func(t *testing.T) {
+		fakeTerminal(t)
+		out, err := os.Create(filepath.Join(dir, "stdout"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		os.Stdout = out
+		dest = filepath.Join(dir, "unused.gif")
+		if err := writeGif(strings.NewReader("GIF89a")); err != nil {
+			t.Fatalf("writing: %v", err)
+		}
+		b, err := ioutil.ReadFile(out.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "GIF89a" {
+			t.Errorf("stdout got %q", b)
+		}
+		if _, err := os.Stat(dest); !os.IsNotExist(err) {
+			t.Errorf("dest was written to when stdout is piped")
+		}
+	})
+}
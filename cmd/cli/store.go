@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackmordaunt/giffer"
+)
+
+// defaultStore is the store shared with the gui: GIFFER_STORE if set, or the
+// directory the gui keeps gifs in.
+func defaultStore() string {
+	if spec := os.Getenv("GIFFER_STORE"); spec != "" {
+		return spec
+	}
+	return filepath.Join(os.TempDir(), "giffer")
+}
+
+// storeUsage describes the -store flag of the store commands.
+const storeUsage = "store: a directory, s3://bucket/prefix?endpoint=URL or memory:"
+
+// storedGif finds the gif that job makes in the store, if -store is set.
+// Lookup failures are reported and treated as misses, so the gif is made
+// again.
+func storedGif(job giffer.JobSpec) (*giffer.RenderedGif, bool) {
+	if !useStore {
+		return nil, false
+	}
+	s, err := giffer.OpenStore(defaultStore())
+	if err != nil {
+		log.Printf("opening store: %v", err)
+		return nil, false
+	}
+	img, ok, err := s.Lookup(job.Key())
+	if err != nil {
+		log.Printf("looking up stored gif: %v", err)
+		return nil, false
+	}
+	return img, ok
+}
+
+// keepGif adds the gif at path, made by job, to the store if -store is set.
+func keepGif(job giffer.JobSpec, path string, meta giffer.SourceMetadata, elapsed time.Duration) error {
+	if !useStore {
+		return nil
+	}
+	s, err := giffer.OpenStore(defaultStore())
+	if err != nil {
+		return err
+	}
+	img, err := giffer.OpenGif(path)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	// The store reads the provenance from the gif.
+	img.FileName = meta.FileName(".gif")
+	img.Metadata = meta
+	img.Record = giffer.NewRenderRecord(job, img.Content, elapsed)
+	img.Tags = splitList(tags)
+	return s.Insert(job.Key(), img)
+}
+
+// saveGif copies the gif to a new file at path.
+func saveGif(path string, gif io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, gif); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// store manages the gif store, args being a command and its flags.
+func store(args []string) error {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "usage: %s store list|evict|fsck|export|import [flags]\n", os.Args[0])
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	switch args[0] {
+	case "list":
+		return storeList(args[1:])
+	case "evict":
+		return storeEvict(args[1:])
+	case "fsck":
+		return storeCheck(args[1:])
+	case "export":
+		return storeExport(args[1:])
+	case "import":
+		return storeImport(args[1:])
+	default:
+		usage()
+	}
+	return nil
+}
+
+// storeList prints the gifs in the store, newest first.
+func storeList(args []string) error {
+	var (
+		fs     = flag.NewFlagSet("store list", flag.ExitOnError)
+		spec   = fs.String("store", defaultStore(), storeUsage)
+		asJSON = fs.Bool("json", false, "print as json")
+		limit  = fs.Int("n", 0, "list at most this many gifs (0 is all)")
+		offset = fs.Int("skip", 0, "skip this many of the newest gifs")
+	)
+	fs.Parse(args)
+	s, err := giffer.OpenStore(*spec)
+	if err != nil {
+		return err
+	}
+	entries, err := s.List(giffer.ListOptions{
+		Offset:      *offset,
+		Limit:       *limit,
+		NewestFirst: true,
+	})
+	if err != nil {
+		return fmt.Errorf("listing %s: %w", *spec, err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	printEntries(os.Stdout, entries)
+	return nil
+}
+
+// storeEvict evicts gifs from the store until it fits within the limits.
+func storeEvict(args []string) error {
+	var (
+		fs      = flag.NewFlagSet("store evict", flag.ExitOnError)
+		spec    = fs.String("store", defaultStore(), storeUsage)
+		maxMB   = fs.Int64("max-size", 0, "evict least recently used gifs until the store is at most this many megabytes (0 is unbounded)")
+		maxGifs = fs.Int("max-gifs", 0, "evict least recently used gifs until at most this many remain (0 is unbounded)")
+		ttl     = fs.Duration("ttl", 0, "evict gifs created longer ago than this, eg 720h (0 keeps them)")
+		verbose = fs.Bool("v", false, "list the evicted gifs")
+	)
+	fs.Parse(args)
+	db, err := openGifDB(*spec)
+	if err != nil {
+		return err
+	}
+	db.MaxBytes = *maxMB << 20
+	db.MaxEntries = *maxGifs
+	db.TTL = *ttl
+	report, err := db.Evict()
+	if err != nil {
+		return fmt.Errorf("evicting from %s: %w", *spec, err)
+	}
+	if *verbose {
+		for _, e := range report.Evicted {
+			fmt.Printf("%s\t%s\t%s\n", e.Key, e.Reason, e.FileName)
+		}
+	}
+	fmt.Println(report)
+	return nil
+}
+
+// storeCheck looks for damaged gifs in the store, quarantining them with
+// -repair.
+func storeCheck(args []string) error {
+	var (
+		fs     = flag.NewFlagSet("store fsck", flag.ExitOnError)
+		spec   = fs.String("store", defaultStore(), storeUsage)
+		repair = fs.Bool("repair", false, "move damaged gifs into the quarantine directory")
+	)
+	fs.Parse(args)
+	db, err := openGifDB(*spec)
+	if err != nil {
+		return err
+	}
+	report, err := db.Check(*repair)
+	if err != nil {
+		return fmt.Errorf("checking %s: %w", *spec, err)
+	}
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	fmt.Println(report)
+	if len(report.Problems) > 0 && !*repair {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// storeExport writes gifs from the store to an archive.
+func storeExport(args []string) error {
+	var (
+		fs    = flag.NewFlagSet("store export", flag.ExitOnError)
+		spec  = fs.String("store", defaultStore(), storeUsage)
+		out   = fs.String("o", "gifs.tar", "archive to write, - for stdout")
+		keys  = fs.String("keys", "", "only these keys (comma separated)")
+		tag   = fs.String("tag", "", "only gifs with this tag")
+		since = fs.String("since", "", "only gifs created on or after this date (2006-01-02)")
+		until = fs.String("until", "", "only gifs created before this date (2006-01-02)")
+	)
+	fs.Parse(args)
+	filter := giffer.ExportFilter{
+		Keys: splitList(*keys),
+		Tag:  *tag,
+	}
+	var err error
+	if *since != "" {
+		if filter.Since, err = time.ParseInLocation("2006-01-02", *since, time.Local); err != nil {
+			return fmt.Errorf("parsing -since: %w", err)
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = time.ParseInLocation("2006-01-02", *until, time.Local); err != nil {
+			return fmt.Errorf("parsing -until: %w", err)
+		}
+	}
+	s, err := giffer.OpenStore(*spec)
+	if err != nil {
+		return err
+	}
+	w := io.WriteCloser(os.Stdout)
+	if *out != "-" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+	}
+	defer w.Close()
+	manifest, err := giffer.Export(s, w, filter)
+	if err != nil {
+		return fmt.Errorf("exporting %s: %w", *spec, err)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d gifs\n", len(manifest.Entries))
+	return nil
+}
+
+// storeImport reads gifs from archives into the store.
+func storeImport(args []string) error {
+	var (
+		fs       = flag.NewFlagSet("store import", flag.ExitOnError)
+		spec     = fs.String("store", defaultStore(), storeUsage)
+		conflict = fs.String("conflict", "skip", "what to do with gifs already in the store: skip, overwrite or keep (both)")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s store import [flags] archive.tar...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c, err := giffer.ParseConflict(*conflict)
+	if err != nil {
+		return err
+	}
+	s, err := giffer.OpenStore(*spec)
+	if err != nil {
+		return err
+	}
+	for _, archive := range fs.Args() {
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		imported, err := giffer.Import(s, f, c)
+		f.Close()
+		var stored, skipped int
+		for _, im := range imported {
+			switch {
+			case im.StoredAs == "":
+				skipped++
+			case im.StoredAs != im.Key:
+				fmt.Printf("%s\tstored as %s\n", im.Key, im.StoredAs)
+				stored++
+			default:
+				stored++
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%s: imported %d gifs, skipped %d\n", archive, stored, skipped)
+		if err != nil {
+			return fmt.Errorf("importing %s: %w", archive, err)
+		}
+	}
+	return nil
+}
+
+// openGifDB opens the store, which must be a directory for commands that
+// manage its files.
+func openGifDB(spec string) (*giffer.GifDB, error) {
+	s, err := giffer.OpenStore(spec)
+	if err != nil {
+		return nil, err
+	}
+	db, ok := s.(*giffer.GifDB)
+	if !ok {
+		return nil, fmt.Errorf("store %s is not a directory", spec)
+	}
+	return db, nil
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// printEntries writes the store entries as a human readable table.
+func printEntries(w io.Writer, entries []giffer.StoreEntry) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "key\tcreated\tsize\tframes\tdimensions\trender\tsource\t")
+	for _, e := range entries {
+		r := e.Record
+		source := r.Job.Source
+		if r.Job.End > 0 {
+			source += fmt.Sprintf(" [%gs, %gs]", r.Job.Start, r.Job.End)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%dx%d\t%s\t%s\t\n",
+			e.Key,
+			e.Created.Local().Format("2006-01-02 15:04"),
+			e.Size,
+			r.Frames,
+			r.Width, r.Height,
+			r.RenderTime.Round(time.Millisecond),
+			source,
+		)
+	}
+	tw.Flush()
+}
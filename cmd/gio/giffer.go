@@ -1,12 +1,13 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
-	"github.com/OneOfOne/xxhash"
 	"github.com/jackmordaunt/giffer"
 	"github.com/pkg/errors"
 )
@@ -15,104 +16,140 @@ import (
 type Giffer struct {
 	giffer.Downloader
 	giffer.Engine
-	Store GifStore
-}
-
-// GifStore contains Gif files.
-type GifStore interface {
-	Lookup(key string) (*RenderedGif, bool, error)
-	Insert(key string, img *RenderedGif) error
-	// Keys() []string
-	// Last() string
+	Store giffer.GifStore
+	// flight coalesces concurrent renders of the same gif.
+	flight giffer.Flight
 }
 
 // GififyURL downloads the video at url and creates a .gif based on the specified parameters.
+// Concurrent calls with the same parameters share the work, through the store.
+// Cancelling ctx stops the download, which is resumed by the next call.
+// The caller closes the gif.
 func (g *Giffer) GififyURL(
+	ctx context.Context,
 	url string,
 	start, end, fps float64,
 	width, height, fuzz int,
-) (*RenderedGif, error) {
-	if g.Store == nil {
-		return g.make(url, start, end, fps, width, height, fuzz)
+) (*giffer.RenderedGif, error) {
+	// The start and end are part of the key, so timestamps in the url would
+	// only split the store.
+	url = giffer.NormalizeURL(url)
+	job := giffer.JobSpec{
+		Source: url,
+		Start:  start,
+		End:    end,
+		FPS:    fps,
+		Width:  width,
+		Height: height,
+		Fuzz:   fuzz,
 	}
-	key, err := hash(fmt.Sprintf("%s_%f_%f_%f_%d_%d", url, start, end, fps, width, height))
-	if err != nil {
-		return nil, err
+	if g.Store == nil {
+		// Without a store there is nowhere for renders to share their gif
+		// through.
+		return g.make(ctx, job)
 	}
+	key := job.Key()
 	img, ok, err := g.Store.Lookup(key)
 	if err != nil {
 		return nil, errors.Wrap(err, "store lookup")
 	}
-	if ok && img != nil {
+	if ok {
 		return img, nil
 	}
-	img, err = g.make(url, start, end, fps, width, height, fuzz)
+	// Each caller opens the gif for itself once it is stored, since a handle
+	// can't be shared.
+	_, _, err = g.flight.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		// Another flight may have inserted the gif since the lookup above.
+		if img, ok, err := g.Store.Lookup(key); err != nil || ok {
+			if ok {
+				img.Close()
+			}
+			return nil, errors.Wrap(err, "store lookup")
+		}
+		img, err := g.make(ctx, job)
+		if err != nil {
+			return nil, err
+		}
+		defer img.Close()
+		if err := g.Store.Insert(key, img); err != nil {
+			return nil, errors.Wrap(err, "inserting gif into store")
+		}
+		return nil, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	if err := g.Store.Insert(key, img); err != nil {
-		return nil, errors.Wrap(err, "inserting gif into store")
+	img, ok, err = g.Store.Lookup(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "store lookup")
+	}
+	if !ok {
+		return nil, errors.New("gif was evicted as soon as it was stored")
 	}
 	return img, nil
 }
 
-func (g *Giffer) make(
-	url string,
-	start, end, fps float64,
-	width, height, fuzz int,
-) (*RenderedGif, error) {
-	video, err := g.Download(url, start, end)
+func (g *Giffer) make(ctx context.Context, job giffer.JobSpec) (*giffer.RenderedGif, error) {
+	clip, err := g.DownloadContext(ctx, giffer.Request{
+		URL:    job.Source,
+		Start:  job.Start,
+		End:    job.End,
+		Width:  job.Width,
+		Height: job.Height,
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "downloading video")
 	}
-	gif, err := g.Transcode(video, start, end, width, height, fps)
+	video := clip.Path
+	// Concurrent renders each work with their own engine, so that cleaning up
+	// after one doesn't remove the files of another.
+	eng := g.Engine.Fork()
+	defer eng.Clean()
+	began := time.Now()
+	gif, err := eng.Transcode(video, job.Start-clip.Offset, job.End-clip.Offset, job.Width, job.Height, job.FPS)
 	if err != nil {
 		return nil, errors.Wrap(err, "transcoding video to gif")
 	}
-	if err := g.Crush(gif, fuzz); err != nil {
+	if err := eng.Crush(gif, job.Fuzz); err != nil {
 		return nil, errors.Wrap(err, "optimising gif image")
 	}
-	defer g.Clean()
-	gifdata, err := ioutil.ReadFile(gif)
+	source := clip.Metadata.URL
+	if source == "" {
+		source = job.Source
+	}
+	if err := eng.Stamp(gif, giffer.Provenance{
+		Source: source,
+		Title:  clip.Metadata.Title,
+		Author: clip.Metadata.Author,
+		Start:  job.Start,
+		End:    job.End,
+		FPS:    job.FPS,
+	}); err != nil {
+		return nil, errors.Wrap(err, "stamping provenance")
+	}
+	elapsed := time.Since(began)
+	// The gif is moved out of the engine's files, so that it outlives them
+	// until it is closed.
+	kept, err := ioutil.TempFile(filepath.Dir(gif), "gif-*.gif")
 	if err != nil {
-		return nil, errors.Wrap(err, "buffering gif")
+		return nil, errors.Wrap(err, "keeping gif")
 	}
-	img := &RenderedGif{
-		Data:     gifdata,
-		FileName: sanitiseFilepath(strings.Split(filepath.Base(video), ".")[0] + ".gif"),
+	kept.Close()
+	if err := os.Rename(gif, kept.Name()); err != nil {
+		os.Remove(kept.Name())
+		return nil, errors.Wrap(err, "keeping gif")
 	}
-	return img, nil
-}
-
-// RenderedGif wraps the gif data with some metadata.
-type RenderedGif struct {
-	Data []byte
-	// FileName is <title>.<ext>
-	FileName string
-}
-
-func hash(input string) (string, error) {
-	hasher := xxhash.New64()
-	_, err := hasher.WriteString(input)
+	img, err := giffer.OpenTempGif(kept.Name())
 	if err != nil {
-		return "", errors.Wrap(err, "hashing input")
+		return nil, errors.Wrap(err, "opening gif")
 	}
-	h := fmt.Sprintf("%d", hasher.Sum64())
-	return h, nil
-}
-
-func sanitiseFilepath(p string) string {
-	r := strings.NewReplacer(
-		"(", "",
-		")", "",
-		"!", "",
-		"+", "",
-		"?", "",
-		"*", "",
-		"&", "",
-		"^", "",
-		"=", "",
-		" ", "",
-	)
-	return r.Replace(p)
+	// The store reads the provenance from the gif.
+	img.FileName = clip.Metadata.FileName(".gif")
+	img.Metadata = clip.Metadata
+	img.Record = giffer.NewRenderRecord(job, img.Content, elapsed)
+	if _, err := img.Content.Seek(0, io.SeekStart); err != nil {
+		img.Close()
+		return nil, errors.Wrap(err, "reading gif")
+	}
+	return img, nil
 }
@@ -1,14 +1,16 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"image"
 	"image/color"
 	"image/gif"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"gioui.org/app"
@@ -23,6 +25,7 @@ import (
 	"gioui.org/widget/material"
 	m "gioui.org/widget/material"
 	c "gioui.org/x/component"
+	"github.com/jackmordaunt/giffer"
 	"github.com/ncruces/zenity"
 )
 
@@ -35,9 +38,14 @@ func main() {
 			),
 			Th: material.NewTheme(gofont.Collection()),
 			Giffer: Giffer{
-				Store: &gifdb{
-					Dir: filepath.Join(os.TempDir(), "giffer"),
+				Engine: giffer.Engine{
+					Provenance: giffer.ProvenanceComment | giffer.ProvenanceXMP,
+					Cache: &giffer.StageCache{
+						Dir:      filepath.Join(os.TempDir(), "giffer-stages"),
+						MaxBytes: 1 << 30,
+					},
 				},
+				Store: openStore(),
 			},
 		}
 		if err := ui.Loop(); err != nil {
@@ -48,6 +56,24 @@ func main() {
 	app.Main()
 }
 
+// openStore opens the store named by GIFFER_STORE, by default a directory
+// in the temp directory. Directories are kept to a gigabyte and a month.
+func openStore() giffer.GifStore {
+	spec := os.Getenv("GIFFER_STORE")
+	if spec == "" {
+		spec = filepath.Join(os.TempDir(), "giffer")
+	}
+	s, err := giffer.OpenStore(spec)
+	if err != nil {
+		log.Fatalf("opening store: %v", err)
+	}
+	if db, ok := s.(*giffer.GifDB); ok {
+		db.MaxBytes = 1 << 30
+		db.TTL = 30 * 24 * time.Hour
+	}
+	return s
+}
+
 type (
 	C = layout.Context
 	D = layout.Dimensions
@@ -60,16 +86,29 @@ type UI struct {
 	Form       Form
 	GifPlayer  GifPlayer
 	Processing bool
-	cache      *PreparedGif
-	done       chan *PreparedGif
+	// Summary describes the structure of the last rendered gif.
+	Summary string
+	// Progress of the current download, if any.
+	Progress string
+	// Preview of the video at the URL being entered, if any.
+	Preview *Preview
+	cache   *PreparedGif
+	// done receives the rendered gif, or nil if rendering failed.
+	done     chan *PreparedGif
+	progress chan giffer.DownloadProgress
+	cancel   context.CancelFunc
+	// preview receives previews as they load.
+	preview       chan *Preview
+	cancelPreview context.CancelFunc
+	// linked is the start and end last taken from a url, so that the form
+	// is only prefilled when they change.
+	linked [2]float64
 }
 
-// PreparedGif helper wraps a Gif with FPS metadata.
-// This is needed because Gif itself cannot be relied upon to contain proper FPS data in it's delay
-// slice.
+// PreparedGif wraps a decoded Gif that is ready to be played.
 type PreparedGif struct {
 	*gif.GIF
-	FPS float64
+	Info *giffer.GifInfo
 }
 
 // Loop runs the event loop until terminated.
@@ -100,6 +139,16 @@ func (ui *UI) Init() {
 	ui.Form.Start.SetText("0")
 	ui.Form.End.SetText("3")
 	ui.done = make(chan *PreparedGif)
+	ui.progress = make(chan giffer.DownloadProgress, 1)
+	ui.preview = make(chan *Preview)
+	ui.Giffer.Downloader.Progress = func(p giffer.DownloadProgress) {
+		// Drop updates while the UI is busy, a fresher one will follow.
+		select {
+		case ui.progress <- p:
+			ui.Window.Invalidate()
+		default:
+		}
+	}
 }
 
 func (ui *UI) Update(gtx C) {
@@ -118,12 +167,31 @@ func (ui *UI) Update(gtx C) {
 		}
 		ui.cache = nil
 	}
+	for _, e := range ui.Form.URL.Events() {
+		if _, ok := e.(widget.ChangeEvent); ok {
+			url := strings.TrimSpace(ui.Form.URL.Text())
+			ui.prefillTimes(url)
+			ui.loadPreview(giffer.NormalizeURL(url))
+		}
+	}
+	select {
+	case p := <-ui.preview:
+		ui.Preview = p
+	default:
+	}
+	if ui.Form.CancelBtn.Clicked() && ui.cancel != nil {
+		ui.cancel()
+	}
 	if ui.Form.SubmitBtn.Clicked() {
 		ui.GifPlayer.Clear()
 		ui.Processing = true
+		ui.Progress = ""
+		ctx, cancel := context.WithCancel(context.Background())
+		ui.cancel = cancel
 		var (
-			url  = ui.Form.URL.Text()
-			fuzz = 0
+			url     = ui.Form.URL.Text()
+			chapter = strings.TrimSpace(ui.Form.Chapter.Text())
+			fuzz    = 0
 		)
 		// TODO(jfm): show as validation errors.
 		start, err := strconv.ParseFloat(ui.Form.Start.Text(), 64)
@@ -147,7 +215,23 @@ func (ui *UI) Update(gtx C) {
 			log.Printf("error: height must be an integer number")
 		}
 		go func() {
+			if chapter != "" {
+				// Start and end are offsets within the chapter.
+				md, err := ui.Giffer.Metadata(ctx, url)
+				if err != nil {
+					log.Printf("error: reading chapters: %v", err)
+					ui.done <- nil
+					return
+				}
+				r := giffer.ChapterRange{Chapter: chapter, Start: start, End: end}
+				if start, end, err = r.Resolve(md.Chapters); err != nil {
+					log.Printf("error: selecting chapter: %v", err)
+					ui.done <- nil
+					return
+				}
+			}
 			g, err := ui.Giffer.GififyURL(
+				ctx,
 				url,
 				start,
 				end,
@@ -158,29 +242,105 @@ func (ui *UI) Update(gtx C) {
 			)
 			if err != nil {
 				log.Printf("error: fetching gif: %v", err)
+				ui.done <- nil
 				return
 			}
-			img, err := gif.DecodeAll(bytes.NewReader(g.Data))
+			defer g.Close()
+			img, err := gif.DecodeAll(g.Content)
 			if err != nil {
 				log.Printf("error: decoding gif: %v", err)
+				ui.done <- nil
 				return
 			}
-			ui.GifPlayer.FPS = fps
+			var info *giffer.GifInfo
+			if _, err = g.Content.Seek(0, io.SeekStart); err == nil {
+				info, err = giffer.Inspect(g.Content)
+			}
+			if err != nil {
+				log.Printf("error: inspecting gif: %v", err)
+			}
 			ui.done <- &PreparedGif{
-				GIF: img,
-				FPS: fps,
+				GIF:  img,
+				Info: info,
 			}
 		}()
 	}
 	select {
+	case p := <-ui.progress:
+		ui.Progress = "downloading: " + p.String()
+	default:
+	}
+	select {
 	case img := <-ui.done:
-		ui.cache = img
 		ui.Processing = false
+		ui.Progress = ""
+		ui.cancel()
+		ui.cancel = nil
+		if img == nil {
+			break
+		}
+		ui.cache = img
 		ui.GifPlayer.Load(img)
+		ui.Summary = ""
+		if img.Info != nil {
+			ui.Summary = img.Info.String()
+		}
 	default:
 	}
 }
 
+// prefillTimes fills the start and end fields from the time that the url links
+// to, if any. Without an end in the url the length of the clip is kept.
+func (ui *UI) prefillTimes(url string) {
+	from, to, ok := giffer.URLTimes(url)
+	if !ok || [2]float64{from, to} == ui.linked {
+		return
+	}
+	ui.linked = [2]float64{from, to}
+	length := 3.0
+	start, err1 := strconv.ParseFloat(ui.Form.Start.Text(), 64)
+	end, err2 := strconv.ParseFloat(ui.Form.End.Text(), 64)
+	if err1 == nil && err2 == nil && end > start {
+		length = end - start
+	}
+	if to <= from {
+		to = from + length
+	}
+	ui.Form.Start.SetText(strconv.FormatFloat(from, 'f', -1, 64))
+	ui.Form.End.SetText(strconv.FormatFloat(to, 'f', -1, 64))
+}
+
+// loadPreview replaces the preview with one for url, loaded in the
+// background. Previews still loading for earlier urls are abandoned.
+func (ui *UI) loadPreview(url string) {
+	if ui.Preview != nil && ui.Preview.URL == url {
+		return
+	}
+	if ui.cancelPreview != nil {
+		ui.cancelPreview()
+	}
+	ui.Preview = nil
+	if url == "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ui.cancelPreview = cancel
+	go func() {
+		p, err := loadPreview(ctx, ui.Giffer.Downloader, url)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("error: previewing %s: %v", url, err)
+			}
+			return
+		}
+		select {
+		case ui.preview <- p:
+			ui.Window.Invalidate()
+		case <-ctx.Done():
+		}
+	}()
+}
+
 func (ui *UI) Layout(gtx C) D {
 	return layout.Stack{}.Layout(
 		gtx,
@@ -209,6 +369,12 @@ func (ui *UI) Layout(gtx C) D {
 								l.Rigid(func(gtx C) D {
 									return ui.Form.LayoutFields(gtx, ui.Th)
 								}),
+								l.Rigid(func(gtx C) D {
+									if ui.Preview == nil {
+										return D{}
+									}
+									return ui.Preview.Layout(gtx, ui.Th)
+								}),
 								l.Flexed(1, func(gtx C) D {
 									return D{Size: gtx.Constraints.Max}
 								}),
@@ -240,7 +406,22 @@ func (ui *UI) Layout(gtx C) D {
 						return D{Size: image.Point{X: 10}}
 					}),
 					l.Flexed(1, func(gtx C) D {
-						return ui.GifPlayer.Layout(gtx)
+						return l.Flex{
+							Axis: l.Vertical,
+						}.Layout(
+							gtx,
+							l.Flexed(1, func(gtx C) D {
+								return ui.GifPlayer.Layout(gtx)
+							}),
+							l.Rigid(func(gtx C) D {
+								if ui.Summary == "" {
+									return D{}
+								}
+								return l.Inset{Top: unit.Dp(5)}.Layout(gtx, func(gtx C) D {
+									return m.Caption(ui.Th, ui.Summary).Layout(gtx)
+								})
+							}),
+						)
 					}),
 				)
 			})
@@ -258,11 +439,30 @@ func (ui *UI) Layout(gtx C) D {
 			if !ui.Processing {
 				return D{}
 			}
-			cs := &gtx.Constraints
-			cs.Max.X = 50
-			cs.Max.Y = 50
 			return l.Center.Layout(gtx, func(gtx C) D {
-				return m.Loader(ui.Th).Layout(gtx)
+				return l.Flex{
+					Axis:      l.Vertical,
+					Alignment: l.Middle,
+				}.Layout(
+					gtx,
+					l.Rigid(func(gtx C) D {
+						cs := &gtx.Constraints
+						cs.Max.X = gtx.Dp(50)
+						cs.Max.Y = gtx.Dp(50)
+						return m.Loader(ui.Th).Layout(gtx)
+					}),
+					l.Rigid(func(gtx C) D {
+						if ui.Progress == "" {
+							return D{}
+						}
+						return l.UniformInset(unit.Dp(10)).Layout(gtx, func(gtx C) D {
+							return m.Body1(ui.Th, ui.Progress).Layout(gtx)
+						})
+					}),
+					l.Rigid(func(gtx C) D {
+						return m.Button(ui.Th, &ui.Form.CancelBtn, "Cancel").Layout(gtx)
+					}),
+				)
 			})
 		}),
 	)
@@ -276,8 +476,10 @@ type Form struct {
 	Width     c.TextField
 	Height    c.TextField
 	FPS       c.TextField
+	Chapter   c.TextField
 	SubmitBtn widget.Clickable
 	SaveBtn   widget.Clickable
+	CancelBtn widget.Clickable
 }
 
 func (f *Form) LayoutFields(gtx C, th *m.Theme) D {
@@ -288,6 +490,9 @@ func (f *Form) LayoutFields(gtx C, th *m.Theme) D {
 		l.Rigid(func(gtx C) D {
 			return f.URL.Layout(gtx, th, "url")
 		}),
+		l.Rigid(func(gtx C) D {
+			return f.Chapter.Layout(gtx, th, "chapter (title or number, optional)")
+		}),
 		l.Rigid(func(gtx C) D {
 			return f.Start.Layout(gtx, th, "start (seconds)")
 		}),
@@ -332,23 +537,30 @@ func (f *Form) LayoutActions(gtx C, th *m.Theme) D {
 // TODO(jfm): Properly crop gif.
 type GifPlayer struct {
 	Frames []paint.ImageOp
+	// Delays holds how long each frame is displayed for.
+	Delays []time.Duration
 	Cursor int
-	FPS    float64
-	since  time.Time
+	next   time.Time
 	img    widget.Image
 }
 
 // Load a Gif image to render.
 func (g *GifPlayer) Load(src *PreparedGif) {
-	g.FPS = float64(src.FPS)
 	g.Frames = make([]paint.ImageOp, len(src.Image))
+	g.Delays = make([]time.Duration, len(src.Image))
 	for ii := range src.Image {
 		s := ImageStack{Config: src.Config}
 		for jj := ii; jj >= 0; jj-- {
 			s.Stack = append(s.Stack, src.Image[jj])
 		}
 		g.Frames[ii] = paint.NewImageOp(s)
+		var delay int
+		if ii < len(src.Delay) {
+			delay = src.Delay[ii]
+		}
+		g.Delays[ii] = giffer.DelayDuration(delay)
 	}
+	g.next = time.Time{}
 }
 
 // Clear the player state.
@@ -356,17 +568,12 @@ func (g *GifPlayer) Load(src *PreparedGif) {
 func (g *GifPlayer) Clear() {
 	g.Frames = g.Frames[:]
 	g.Cursor = 0
-	g.FPS = 0
+	g.next = time.Time{}
 }
 
-// Ready if the next frame is ready to be displayed.
+// Ready if the current frame has been displayed for its delay.
 func (g *GifPlayer) Ready(gtx C) bool {
-	var (
-		now     = gtx.Now
-		since   = g.since
-		latency = time.Second / time.Duration(g.FPS)
-	)
-	return now.Sub(since).Milliseconds() >= latency.Milliseconds()
+	return !gtx.Now.Before(g.next)
 }
 
 // Next loads the next frame in the series.
@@ -376,9 +583,15 @@ func (g *GifPlayer) Next(gtx C) {
 		if g.Cursor > len(g.Frames)-1 {
 			g.Cursor = 0
 		}
-		g.since = gtx.Now
 	}()
 	g.img.Src = g.Frames[g.Cursor]
+	// Schedule from the previous deadline rather than from now so that late
+	// frames don't push the rest of the animation back. If we've fallen far
+	// behind (eg the window was hidden) start afresh.
+	if g.next.IsZero() || gtx.Now.Sub(g.next) > time.Second {
+		g.next = gtx.Now
+	}
+	g.next = g.next.Add(g.Delays[g.Cursor])
 }
 
 // Current returns the current frame.
@@ -396,10 +609,10 @@ func (g *GifPlayer) Layout(gtx C) D {
 			Color: color.NRGBA{A: 100},
 		}.Layout(gtx)
 	}
-	op.InvalidateOp{}.Add(gtx.Ops)
 	if g.Ready(gtx) {
 		g.Next(gtx)
 	}
+	op.InvalidateOp{At: g.next}.Add(gtx.Ops)
 	g.img.Fit = widget.Fill
 	return g.img.Layout(gtx)
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strings"
+	"time"
+
+	l "gioui.org/layout"
+	"gioui.org/op/paint"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	m "gioui.org/widget/material"
+	"github.com/jackmordaunt/giffer"
+)
+
+// Preview describes the video at a URL before any gif is made from it.
+type Preview struct {
+	URL      string
+	Metadata giffer.SourceMetadata
+	// Thumbnail of the video, if it could be fetched and decoded.
+	Thumbnail *paint.ImageOp
+	img       widget.Image
+}
+
+// loadPreview looks up the metadata of the video at url, and its thumbnail.
+// A missing thumbnail isn't an error, the preview just goes without.
+func loadPreview(ctx context.Context, dl giffer.Downloader, url string) (*Preview, error) {
+	md, err := dl.Metadata(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	p := &Preview{URL: url, Metadata: md}
+	if md.Thumbnail == "" {
+		return p, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, md.Thumbnail, nil)
+	if err != nil {
+		return p, nil
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return p, nil
+	}
+	defer resp.Body.Close()
+	if img, _, err := image.Decode(resp.Body); err == nil {
+		op := paint.NewImageOp(img)
+		p.Thumbnail = &op
+	}
+	return p, nil
+}
+
+// Caption summarises the metadata, eg "Title by Author, 3m12s, 2 Jan 2006".
+func (p *Preview) Caption() string {
+	md := p.Metadata
+	var parts []string
+	title := md.Title
+	if md.Author != "" {
+		title += " by " + md.Author
+	}
+	parts = append(parts, title)
+	if md.Duration > 0 {
+		parts = append(parts, md.Duration.Round(time.Second).String())
+	}
+	if !md.Uploaded.IsZero() {
+		parts = append(parts, md.Uploaded.Format("2 Jan 2006"))
+	}
+	if n := len(md.Chapters); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d chapters", n))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (p *Preview) Layout(gtx C, th *m.Theme) D {
+	return l.Flex{
+		Axis:      l.Horizontal,
+		Alignment: l.Middle,
+	}.Layout(
+		gtx,
+		l.Rigid(func(gtx C) D {
+			if p.Thumbnail == nil {
+				return D{}
+			}
+			return l.Inset{Right: unit.Dp(10)}.Layout(gtx, func(gtx C) D {
+				gtx.Constraints.Max.X = gtx.Dp(96)
+				gtx.Constraints.Max.Y = gtx.Dp(54)
+				p.img.Src = *p.Thumbnail
+				p.img.Fit = widget.Contain
+				return p.img.Layout(gtx)
+			})
+		}),
+		l.Flexed(1, func(gtx C) D {
+			return m.Caption(th, p.Caption()).Layout(gtx)
+		}),
+	)
+}
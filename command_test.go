@@ -0,0 +1,31 @@
+package giffer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommandOmitEmpty(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"whole", []string{"-ss", "2.000000;omitempty", "-i", "v.mp4"}, []string{"-ss", "2.000000", "-i", "v.mp4"}},
+		{"fractional", []string{"-ss", "0.500000;omitempty", "-i", "v.mp4"}, []string{"-ss", "0.500000", "-i", "v.mp4"}},
+		{"fractional above one", []string{"-t", "1.250000;omitempty", "-i", "v.mp4"}, []string{"-t", "1.250000", "-i", "v.mp4"}},
+		{"zero", []string{"-ss", "0.000000;omitempty", "-i", "v.mp4"}, []string{"-i", "v.mp4"}},
+		{"negative", []string{"-t", "-1.000000;omitempty", "-i", "v.mp4"}, []string{"-i", "v.mp4"}},
+		{"empty", []string{"-ss", ";omitempty", "-i", "v.mp4"}, []string{"-i", "v.mp4"}},
+		{"not a number", []string{"-vf", "palettegen;omitempty", "-y", "p.png"}, []string{"-vf", "palettegen", "-y", "p.png"}},
+		{"empty value", []string{"-vf", "", "-y", "p.png"}, []string{"-y", "p.png"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eng := &Engine{}
+			if got := eng.command("ffmpeg", tt.args...).Args[1:]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("command(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package giffer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// BytesContent serves gif content held in memory.
+func BytesContent(data []byte) io.ReadSeekCloser {
+	return nopCloser{bytes.NewReader(data)}
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// OpenGif opens the gif file at path as the content of a rendered gif.
+func OpenGif(path string) (*RenderedGif, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &RenderedGif{Content: f, Size: info.Size()}, nil
+}
+
+// OpenTempGif is OpenGif for a temporary file, which is removed when the gif
+// is closed.
+func OpenTempGif(path string) (*RenderedGif, error) {
+	img, err := OpenGif(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	img.Content = tempFile{img.Content.(*os.File)}
+	return img, nil
+}
+
+// tempFile is a file that is removed once it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f tempFile) Close() error {
+	err := f.File.Close()
+	if rmerr := os.Remove(f.Name()); err == nil {
+		err = rmerr
+	}
+	return err
+}
+
+// spool copies r into a temporary file in dir, or the default temp directory
+// if dir is empty, so that it can be read as content. The file is removed
+// when it is closed. Returns the checksum and size of what was copied.
+func spool(dir string, r io.Reader) (io.ReadSeekCloser, string, int64, error) {
+	f, err := ioutil.TempFile(dir, ".spool-*")
+	if err != nil {
+		return nil, "", 0, err
+	}
+	var (
+		content = tempFile{f}
+		h       = sha256.New()
+	)
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		content.Close()
+		return nil, "", 0, err
+	}
+	return content, "sha256:" + hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// hashContent reads the content from the start, returning its checksum, see
+// checksum, and size. The content is left at the start.
+func hashContent(r io.ReadSeeker) (string, int64, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -4,47 +4,190 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math"
 	"os"
-	"path/filepath"
+	"os/exec"
+	"strings"
+	"time"
 
 	"github.com/OneOfOne/xxhash"
-	"github.com/kkdai/youtube/v2"
-	"github.com/kkdai/youtube/v2/downloader"
 	"github.com/pkg/errors"
 )
 
+const (
+	// DefaultMargin is the default number of seconds fetched ahead of the
+	// start of a partial download.
+	DefaultMargin = 2.0
+	// DefaultAlign is the default number of seconds that partial downloads
+	// are aligned to.
+	DefaultAlign = 30.0
+)
+
 // Downloader is responsible for downloading videos.
 type Downloader struct {
 	Dir    string
 	FFmpeg string
 	Debug  bool
 	Out    io.Writer
+	// Margin is the number of seconds fetched ahead of start, so that the
+	// clip can begin on a keyframe without cutting into the requested range.
+	// Zero uses DefaultMargin.
+	Margin float64
+	// Align rounds the range of partial downloads out to multiples of this
+	// many seconds, so that clips near each other share a download.
+	// Zero uses DefaultAlign, negative fetches the range as requested.
+	Align float64
+	// Sources resolves URLs to the Source that fetches them.
+	// Nil uses DefaultSources.
+	Sources *Registry
+	// Cache stores downloads for reuse. Nil caches in Dir, without bounding
+	// its size.
+	Cache *DownloadCache
+	// Progress, if not nil, is called periodically while downloading.
+	Progress func(DownloadProgress)
+	// Retries is the number of times to retry after a transient error.
+	// Zero uses DefaultRetries, negative disables retries.
+	Retries int
+	// Backoff is the delay before the first retry. Zero uses DefaultBackoff.
+	Backoff time.Duration
 }
 
-// Download the video from URL into Dir and return the full path to the
-// downloaded file.
-func (dl Downloader) Download(
-	URL string,
-	start, end float64,
-) (string, error) {
+// Clip is a downloaded video file, which may hold only a portion of the source
+// video.
+type Clip struct {
+	Path string
+	// Offset is the time in the source video, in seconds, at which the file
+	// begins. Subtract it from source timestamps to get file timestamps.
+	Offset float64
+	// End is the time in the source video, in seconds, at which the file
+	// ends. Zero if it runs to the end of the source.
+	End float64
+	// Metadata describing the source video.
+	Metadata SourceMetadata
+	// Cached reports whether the video was already in the cache, rather
+	// than fetched for this clip.
+	Cached bool
+}
+
+// Download the requested video and return the downloaded clip.
+// See DownloadContext.
+func (dl Downloader) Download(req Request) (Clip, error) {
+	return dl.DownloadContext(context.Background(), req)
+}
+
+// DownloadContext downloads the requested video and returns the downloaded
+// clip. If req.End is after req.Start only that range, rounded out to
+// dl.Align and with a margin before the start, is fetched. Otherwise the
+// whole video is downloaded. Timestamps in the URL are ignored, see
+// URLTimes.
+//
+// Downloads are cached, so the same video is only fetched once, including
+// when it is requested by concurrent calls. In that case progress is reported
+// to the Downloader that began the fetch.
+//
+// Transient errors are retried. A whole download that is interrupted, by an
+// error or by cancelling ctx, is resumed from where it stopped by the next
+// attempt if the source supports it. Ranged downloads are restarted instead.
+func (dl Downloader) DownloadContext(ctx context.Context, req Request) (Clip, error) {
 	dl.logf("ffmpeg: %q\n", dl.FFmpeg)
-	h, err := hash(fmt.Sprintf("%s_%f_%f", URL, start, end))
+	// Links to different moments of a video are the same download.
+	req.URL = NormalizeURL(req.URL)
+	src, err := dl.sources().Lookup(req.URL)
+	if err != nil {
+		return Clip{}, err
+	}
+	if req.Codecs == nil {
+		if req.Codecs, err = FFmpegDecoders(dl.ffmpeg()); err != nil {
+			dl.logf("download: assuming any codec can be decoded: %v\n", err)
+		}
+	}
+	var m *Media
+	if err := dl.retry(ctx, "resolving", func() (err error) {
+		m, err = src.Resolve(ctx, req)
+		return err
+	}); err != nil {
+		return Clip{}, fmt.Errorf("resolving video: %w", err)
+	}
+	if m.Note != "" {
+		dl.logf("download: selected format %s\n", m.Note)
+	}
+	// Any cached download that covers the range will do, whether of the
+	// whole video or of an earlier clip.
+	cache := dl.cache()
+	if e, ok, err := cache.Find(m, req.Start, req.End); err != nil {
+		return Clip{}, errors.Wrap(err, "looking up cache")
+	} else if ok {
+		dl.logf("download: cached at %s\n", e.Path)
+		clip := e.Clip()
+		clip.Cached = true
+		return clip, nil
+	}
+	if req.End > req.Start && m.Stream != "" {
+		req.Start, req.End = dl.align(req.Start, req.End)
+	}
+	key, err := CacheKey(m, req.Start, req.End)
+	if err != nil {
+		return Clip{}, errors.Wrap(err, "creating cache key")
+	}
+	// Concurrent downloads of the same video into the same cache share one
+	// fetch, rather than racing to write the same partial file.
+	v, shared, err := downloads.Do(ctx, cache.Dir+"|"+key, func(ctx context.Context) (interface{}, error) {
+		// The video may have been cached by a flight that landed between
+		// the lookup above and this one taking off.
+		if e, ok, err := cache.Find(m, req.Start, req.End); err != nil {
+			return nil, errors.Wrap(err, "looking up cache")
+		} else if ok {
+			clip := e.Clip()
+			clip.Cached = true
+			return clip, nil
+		}
+		clip, err := dl.download(ctx, src, m, req, key)
+		if err != nil {
+			return nil, err
+		}
+		e, err := cache.Commit(key, m, clip)
+		if err != nil {
+			os.Remove(clip.Path)
+			return nil, errors.Wrap(err, "caching download")
+		}
+		return e.Clip(), nil
+	})
 	if err != nil {
-		return "", errors.Wrap(err, "creating hash")
+		return Clip{}, err
 	}
-	dir := filepath.Join(dl.Dir, h)
-	if err := os.MkdirAll(dir, 0755); err != nil && !os.IsExist(err) {
-		return "", errors.Wrap(err, "preparing directories")
+	if shared {
+		dl.logf("download: shared with a concurrent request\n")
 	}
-	tmp, err := dl.download(URL, start, end)
+	return v.(Clip), nil
+}
+
+// downloads coalesces concurrent downloads of the same video.
+var downloads Flight
+
+// Metadata looks up the metadata of the video at url without downloading it.
+// Chapters are read from the container, with FFprobe, if the source doesn't
+// provide any.
+func (dl Downloader) Metadata(ctx context.Context, url string) (SourceMetadata, error) {
+	src, err := dl.sources().Lookup(url)
 	if err != nil {
-		return "", err
+		return SourceMetadata{}, err
 	}
-	real := filepath.Join(dir, h+filepath.Ext(tmp))
-	if err := os.Rename(tmp, real); err != nil {
-		return "", errors.Wrap(err, "renaming temporary file")
+	var m *Media
+	if err := dl.retry(ctx, "resolving", func() (err error) {
+		m, err = src.Resolve(ctx, Request{URL: url})
+		return err
+	}); err != nil {
+		return SourceMetadata{}, fmt.Errorf("resolving video: %w", err)
 	}
-	return real, nil
+	if m.Metadata.Chapters == nil && m.Stream != "" {
+		// The source doesn't know of any chapters, but the container may.
+		chapters, err := probeChapters(ctx, ffprobeFor(dl.ffmpeg()), m.Stream)
+		if err != nil {
+			dl.logf("download: no chapters: %v\n", err)
+		}
+		m.Metadata.Chapters = chapters
+	}
+	return m.Metadata, nil
 }
 
 func (dl Downloader) logf(f string, v ...interface{}) {
@@ -54,20 +197,177 @@ func (dl Downloader) logf(f string, v ...interface{}) {
 	fmt.Fprintf(dl.Out, f, v...)
 }
 
-// download a video from the specified url.
+// download the resolved video into the cache's partial file for key.
+// The partial file is kept when the download is interrupted, so that it can
+// be resumed, and removed when it fails for good.
 func (dl Downloader) download(
-	videoURL string,
-	start, end float64,
-) (string, error) {
-	d := downloader.Downloader{
-		Client: youtube.Client{},
+	ctx context.Context,
+	src Source,
+	m *Media,
+	req Request,
+	key string,
+) (Clip, error) {
+	partial := req.End > req.Start && m.Stream != ""
+	ext := m.Ext
+	if partial {
+		ext = copyExt(m.Ext)
 	}
-	v, err := d.GetVideo(videoURL)
+	path, err := dl.cache().partial(key, ext)
 	if err != nil {
-		return "", fmt.Errorf("getting video: %w", err)
+		return Clip{}, errors.Wrap(err, "preparing partial file")
+	}
+	size := m.Size
+	if partial {
+		// A copy of a range is roughly its share of the whole video.
+		size = 0
+		if d := m.Metadata.Duration.Seconds(); d > 0 {
+			size = int64(float64(m.Size) * math.Min(1, (req.End-req.Start+dl.margin())/d))
+		}
+	}
+	stop := watchProgress(ctx, path, size, dl.Progress)
+	clip := Clip{Path: path}
+	err = dl.retry(ctx, "fetching", func() (err error) {
+		if partial {
+			clip, err = dl.fetchRange(ctx, m.Stream, req.Start, req.End, path)
+			return err
+		}
+		return src.Fetch(ctx, m, path)
+	})
+	stop()
+	if err != nil {
+		if ctx.Err() == nil && !transient(err) {
+			os.Remove(path)
+		}
+		return Clip{}, fmt.Errorf("fetching video: %w", err)
+	}
+	return clip, nil
+}
+
+func (dl Downloader) cache() *DownloadCache {
+	if dl.Cache == nil {
+		return &DownloadCache{Dir: dl.Dir}
+	}
+	return dl.Cache
+}
+
+func (dl Downloader) ffmpeg() string {
+	if dl.FFmpeg == "" {
+		return "ffmpeg"
+	}
+	return dl.FFmpeg
+}
+
+func (dl Downloader) sources() *Registry {
+	if dl.Sources == nil {
+		return DefaultSources
+	}
+	return dl.Sources
+}
+
+// fetchRange copies the range [start, end] of the input into output.
+//
+// FFmpeg seeks within the remote input using HTTP range requests, so only
+// the bytes around the range are transferred. Stream copying has to begin on
+// a keyframe, so the copy begins Margin seconds ahead of start.
+//
+// Unlike whole videos a copy can't be resumed, so when FFmpeg fails because
+// of the network the error is temporary and the retry starts the copy again.
+// Ranges are short, so little is fetched twice.
+func (dl Downloader) fetchRange(
+	ctx context.Context,
+	input string,
+	start, end float64,
+	output string,
+) (Clip, error) {
+	from := start - dl.margin()
+	if from < 0 {
+		from = 0
+	}
+	ffmpeg := dl.ffmpeg()
+	args := []string{
+		"-ss", fmt.Sprintf("%f", from),
+		"-i", input,
+		"-t", fmt.Sprintf("%f", end-from),
+		"-c", "copy",
+		"-y", output,
+	}
+	dl.logf("%s %s\n", ffmpeg, strings.Join(args, " "))
+	if out, err := exec.CommandContext(ctx, ffmpeg, args...).CombinedOutput(); err != nil {
+		return Clip{}, errors.Wrap(&ffmpegError{err: err, output: string(out)}, "fetching range")
+	}
+	return Clip{Path: output, Offset: from, End: end}, nil
+}
+
+func (dl Downloader) margin() float64 {
+	if dl.Margin <= 0 {
+		return DefaultMargin
+	}
+	return dl.Margin
+}
+
+// ffmpegError is a failed FFmpeg command, along with what it printed.
+type ffmpegError struct {
+	err    error
+	output string
+}
+
+func (err *ffmpegError) Error() string {
+	return fmt.Sprintf("%v: %s", err.err, err.output)
+}
+
+func (err *ffmpegError) Unwrap() error {
+	return err.err
+}
+
+// networkFailures are what FFmpeg prints when reading a remote input fails
+// in a way that may not happen again.
+var networkFailures = []string{
+	"connection reset",
+	"connection refused",
+	"connection timed out",
+	"broken pipe",
+	"network is unreachable",
+	"i/o error",
+	"end of file",
+	"server returned 5",
+	"http error 5",
+	"http error 429",
+}
+
+// Temporary reports whether FFmpeg failed because of the network, in which
+// case the command is worth retrying.
+func (err *ffmpegError) Temporary() bool {
+	out := strings.ToLower(err.output)
+	for _, failure := range networkFailures {
+		if strings.Contains(out, failure) {
+			return true
+		}
+	}
+	return false
+}
+
+// align rounds the range out to multiples of dl.Align.
+func (dl Downloader) align(start, end float64) (float64, float64) {
+	align := dl.Align
+	if align == 0 {
+		align = DefaultAlign
+	}
+	if align < 0 {
+		return start, end
+	}
+	return math.Floor(start/align) * align, math.Ceil(end/align) * align
+}
+
+// copyExt picks the container that a range of a video in the container ext
+// is copied into. The stream is copied rather than encoded, so the container
+// has to hold the source's codecs: it is kept if FFmpeg can write it, and
+// otherwise Matroska, which holds almost any codec.
+func copyExt(ext string) string {
+	switch ext = strings.ToLower(ext); ext {
+	case ".mp4", ".m4v", ".mov", ".webm", ".mkv":
+		return ext
 	}
-	outf := filepath.Join(os.TempDir(), downloader.SanitizeFilename(v.Title))
-	return outf, d.Download(context.TODO(), v, &v.Formats[0], outf)
+	return ".mkv"
 }
 
 func hash(input string) (string, error) {
@@ -0,0 +1,507 @@
+package giffer_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackmordaunt/giffer"
+	"github.com/jackmordaunt/giffer/giffertest"
+)
+
+// fixture serves a file over HTTP, recording the ranges requested and the
+// bytes sent.
+type fixture struct {
+	Data []byte
+	// Drop, if positive, drops the connection after sending this many bytes
+	// of the body, for each of the first Drops requests for content.
+	Drop  int
+	Drops int
+
+	mu     sync.Mutex
+	ranges []string
+	sent   int
+}
+
+func (f *fixture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.ranges = append(f.ranges, r.Header.Get("Range"))
+	cw := &countingWriter{ResponseWriter: w, f: f}
+	if f.Drop > 0 && f.Drops > 0 && r.Method == http.MethodGet {
+		f.Drops--
+		cw.limit = f.Drop
+	}
+	f.mu.Unlock()
+	http.ServeContent(cw, r, "", time.Time{}, bytes.NewReader(f.Data))
+}
+
+// Ranges returns the Range headers of the requests, empty for requests
+// without one.
+func (f *fixture) Ranges() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.ranges...)
+}
+
+// Sent returns the number of body bytes sent.
+func (f *fixture) Sent() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sent
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	f *fixture
+	// limit, if positive, is how many bytes are sent before the connection
+	// is dropped.
+	limit int
+	n     int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	drop := w.limit > 0 && w.n+len(p) > w.limit
+	if drop {
+		p = p[:w.limit-w.n]
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += n
+	w.f.mu.Lock()
+	w.f.sent += n
+	w.f.mu.Unlock()
+	if drop {
+		w.ResponseWriter.(http.Flusher).Flush()
+		// Aborting the handler closes the connection short of the length
+		// that was promised.
+		panic(http.ErrAbortHandler)
+	}
+	return n, err
+}
+
+func TestDownloadRangeContainer(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/clip.mp4", ".mp4"},
+		{"/clip.webm", ".webm"},
+		{"/clip.MKV", ".mkv"},
+		{"/clip.flv", ".mkv"},
+		{"/clip", ".mkv"},
+	}
+	h := harness(t)
+	srv := httptest.NewServer(&fixture{Data: []byte("not really a video")})
+	defer srv.Close()
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if err := h.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			dl := giffer.Downloader{Dir: t.TempDir(), FFmpeg: h.Path("ffmpeg"), Align: -1}
+			clip, err := dl.Download(giffer.Request{
+				URL:    srv.URL + tt.path,
+				Start:  5,
+				End:    7.5,
+				Codecs: giffer.Codecs{},
+			})
+			if err != nil {
+				t.Fatalf("downloading: %v", err)
+			}
+			if ext := filepath.Ext(clip.Path); ext != tt.want {
+				t.Errorf("clip is %s, want %s", clip.Path, tt.want)
+			}
+			if clip.Offset != 5-giffer.DefaultMargin {
+				t.Errorf("offset = %v, want %v", clip.Offset, 5-giffer.DefaultMargin)
+			}
+			got := calls(t, h)
+			if len(got) != 1 {
+				t.Fatalf("got %d calls, want 1: %v", len(got), got)
+			}
+			for name, want := range map[string]string{
+				"-ss": "3.000000",
+				"-i":  srv.URL + tt.path,
+				"-t":  "4.500000",
+				"-c":  "copy",
+			} {
+				if v, _ := flag(got[0].Args, name); v != want {
+					t.Errorf("%s = %q, want %q in %q", name, v, want, got[0].Args)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadRangeRequests(t *testing.T) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("needs ffmpeg")
+	}
+	// Twenty seconds of video, with the index at the front so that seeking
+	// doesn't need the end of the file.
+	var (
+		dir  = t.TempDir()
+		fx   = &fixture{}
+		path = filepath.Join(dir, "fixture.mp4")
+	)
+	gen := exec.Command(ffmpeg,
+		"-f", "lavfi", "-i", "testsrc=duration=20:size=320x240:rate=25",
+		"-g", "25", "-movflags", "+faststart",
+		"-y", path,
+	)
+	if out, err := gen.CombinedOutput(); err != nil {
+		t.Fatalf("making fixture: %v: %s", err, out)
+	}
+	if fx.Data, err = ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(fx)
+	defer srv.Close()
+	dl := giffer.Downloader{Dir: filepath.Join(dir, "dl"), FFmpeg: ffmpeg, Margin: 1, Align: -1}
+	clip, err := dl.DownloadContext(context.Background(), giffer.Request{
+		URL:   srv.URL + "/fixture.mp4",
+		Start: 14,
+		End:   15,
+	})
+	if err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+	if clip.Offset != 13 {
+		t.Errorf("offset = %v, want 13", clip.Offset)
+	}
+	var ranged bool
+	for _, r := range fx.Ranges() {
+		ranged = ranged || (r != "" && r != "bytes=0-")
+	}
+	if !ranged {
+		t.Errorf("no ranges were requested: %q", fx.Ranges())
+	}
+	if sent := fx.Sent(); sent > len(fx.Data)/2 {
+		t.Errorf("sent %d of %d bytes for a tenth of the video", sent, len(fx.Data))
+	}
+}
+
+func TestDownloadCacheReuse(t *testing.T) {
+	h := harness(t)
+	srv := httptest.NewServer(&fixture{Data: []byte("not really a video")})
+	defer srv.Close()
+	dl := giffer.Downloader{Dir: t.TempDir(), FFmpeg: h.Path("ffmpeg"), Align: 30, Margin: 2}
+	tests := []struct {
+		name       string
+		start, end float64
+		// fetched is the range expected to be fetched, or nil for a hit.
+		fetched []string
+		offset  float64
+	}{
+		{"first clip", 40, 45, []string{"28.000000", "32.000000"}, 28},
+		{"within the window", 50, 55, nil, 28},
+		{"same clip", 40, 45, nil, 28},
+		{"across windows", 58, 62, []string{"28.000000", "62.000000"}, 28},
+		{"within the wider range", 31, 89, nil, 28},
+		{"another window", 95, 100, []string{"88.000000", "32.000000"}, 88},
+		{"before the first", 10, 12, []string{"0.000000", "30.000000"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := h.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			clip, err := dl.Download(giffer.Request{
+				URL:    srv.URL + "/clip.mp4",
+				Start:  tt.start,
+				End:    tt.end,
+				Codecs: giffer.Codecs{},
+			})
+			if err != nil {
+				t.Fatalf("downloading: %v", err)
+			}
+			if clip.Cached != (tt.fetched == nil) {
+				t.Errorf("cached = %v, want %v", clip.Cached, tt.fetched == nil)
+			}
+			if clip.Offset != tt.offset {
+				t.Errorf("offset = %v, want %v", clip.Offset, tt.offset)
+			}
+			got := calls(t, h)
+			if tt.fetched == nil {
+				if len(got) != 0 {
+					t.Errorf("fetched again: %v", got)
+				}
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d calls, want 1: %v", len(got), got)
+			}
+			ss, _ := flag(got[0].Args, "-ss")
+			d, _ := flag(got[0].Args, "-t")
+			if ss != tt.fetched[0] || d != tt.fetched[1] {
+				t.Errorf("fetched -ss %s -t %s, want -ss %s -t %s", ss, d, tt.fetched[0], tt.fetched[1])
+			}
+		})
+	}
+}
+
+func TestDownloadCacheWhole(t *testing.T) {
+	h := harness(t)
+	video := []byte("the whole video")
+	srv := httptest.NewServer(&fixture{Data: video})
+	defer srv.Close()
+	dl := giffer.Downloader{Dir: t.TempDir(), FFmpeg: h.Path("ffmpeg")}
+	req := giffer.Request{URL: srv.URL + "/clip.webm", Codecs: giffer.Codecs{}}
+	whole, err := dl.Download(req)
+	if err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+	if data, err := ioutil.ReadFile(whole.Path); err != nil || !bytes.Equal(data, video) {
+		t.Fatalf("downloaded %q (%v), want %q", data, err, video)
+	}
+	// Clips of a video that is cached whole are cut from it, rather than
+	// fetched again.
+	req.Start, req.End = 100, 103
+	clip, err := dl.Download(req)
+	if err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+	if !clip.Cached || clip.Path != whole.Path || clip.Offset != 0 {
+		t.Errorf("clip = %+v, want the whole video %+v", clip, whole)
+	}
+	if got := calls(t, h); len(got) != 0 {
+		t.Errorf("fetched a range of a cached video: %v", got)
+	}
+}
+
+func TestCacheEntryCovers(t *testing.T) {
+	tests := []struct {
+		entry      giffer.CacheEntry
+		start, end float64
+		want       bool
+	}{
+		{giffer.CacheEntry{}, 0, 0, true},
+		{giffer.CacheEntry{}, 10, 20, true},
+		{giffer.CacheEntry{Offset: 28, End: 60}, 30, 60, true},
+		{giffer.CacheEntry{Offset: 28, End: 60}, 28, 29, true},
+		{giffer.CacheEntry{Offset: 28, End: 60}, 27, 29, false},
+		{giffer.CacheEntry{Offset: 28, End: 60}, 59, 61, false},
+		{giffer.CacheEntry{Offset: 28, End: 60}, 30, 0, false},
+	}
+	for _, tt := range tests {
+		if got := tt.entry.Covers(tt.start, tt.end); got != tt.want {
+			t.Errorf("[%v, %v] covers [%v, %v] = %v, want %v",
+				tt.entry.Offset, tt.entry.End, tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	video := bytes.Repeat([]byte("0123456789"), 10000)
+	fx := &fixture{Data: video, Drop: 30000, Drops: 3}
+	srv := httptest.NewServer(fx)
+	defer srv.Close()
+	var last giffer.DownloadProgress
+	dl := giffer.Downloader{
+		Dir:      t.TempDir(),
+		Backoff:  time.Millisecond,
+		Progress: func(p giffer.DownloadProgress) { last = p },
+	}
+	clip, err := dl.Download(giffer.Request{URL: srv.URL + "/video.mp4", Codecs: giffer.Codecs{}})
+	if err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+	data, err := ioutil.ReadFile(clip.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, video) {
+		t.Fatalf("downloaded %d bytes that differ from the %d served", len(data), len(video))
+	}
+	// Each attempt carries on from where the last was dropped.
+	want := []string{"", "", "bytes=30000-", "bytes=60000-", "bytes=90000-"}
+	if got := fx.Ranges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ranges = %q, want %q", got, want)
+	}
+	if fx.Sent() != len(video) {
+		t.Errorf("sent %d bytes for a %d byte video", fx.Sent(), len(video))
+	}
+	if last.Bytes != int64(len(video)) || last.Total != int64(len(video)) {
+		t.Errorf("last progress = %+v, want %d of %d bytes", last, len(video), len(video))
+	}
+}
+
+func TestDownloadGivesUp(t *testing.T) {
+	fx := &fixture{Data: bytes.Repeat([]byte("x"), 1000), Drop: 100, Drops: 10}
+	srv := httptest.NewServer(fx)
+	defer srv.Close()
+	dl := giffer.Downloader{Dir: t.TempDir(), Backoff: time.Millisecond, Retries: 2}
+	if _, err := dl.Download(giffer.Request{URL: srv.URL + "/video.mp4", Codecs: giffer.Codecs{}}); err == nil {
+		t.Fatalf("downloading succeeded")
+	}
+	// A resolve, then the first attempt and two retries.
+	if got := len(fx.Ranges()); got != 4 {
+		t.Errorf("made %d requests, want 4", got)
+	}
+	// The partial file is kept for the next call to resume.
+	if _, err := dl.Download(giffer.Request{URL: srv.URL + "/video.mp4", Codecs: giffer.Codecs{}}); err == nil {
+		t.Fatalf("downloading succeeded with the connection still dropping")
+	}
+	if got := fx.Ranges(); got[len(got)-3] != "bytes=300-" {
+		t.Errorf("ranges = %q, want the second call to resume at 300", got)
+	}
+}
+
+func TestDownloadRangeRetry(t *testing.T) {
+	h := harness(t)
+	srv := httptest.NewServer(&fixture{Data: []byte("not really a video")})
+	defer srv.Close()
+	tests := []struct {
+		name    string
+		scripts []giffertest.Script
+		calls   int
+		fails   bool
+	}{
+		{
+			name: "connection reset",
+			scripts: []giffertest.Script{
+				{ExitCode: 1, Stderr: "[tls] Error in the pull function.\nConnection reset by peer"},
+				{},
+			},
+			calls: 2,
+		},
+		{
+			name: "server error",
+			scripts: []giffertest.Script{
+				{ExitCode: 1, Stderr: "Server returned 5XX Server Error reply"},
+				{ExitCode: 1, Stderr: "HTTP error 503 Service Unavailable"},
+				{},
+			},
+			calls: 3,
+		},
+		{
+			name:    "bad input",
+			scripts: []giffertest.Script{{ExitCode: 1, Stderr: "Invalid data found when processing input"}},
+			calls:   1,
+			fails:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := h.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			if err := h.Script("ffmpeg", tt.scripts...); err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			dl := giffer.Downloader{Dir: dir, FFmpeg: h.Path("ffmpeg"), Backoff: time.Millisecond}
+			_, err := dl.Download(giffer.Request{
+				URL:    srv.URL + "/clip.mp4",
+				Start:  1,
+				End:    2,
+				Codecs: giffer.Codecs{},
+			})
+			if (err != nil) != tt.fails {
+				t.Errorf("got error %v, want failure %v", err, tt.fails)
+			}
+			if got := len(calls(t, h)); got != tt.calls {
+				t.Errorf("ffmpeg ran %d times, want %d", got, tt.calls)
+			}
+			// A range that fails for good leaves nothing behind.
+			if left := files(t, filepath.Join(dir, ".partial")); tt.fails && len(left) > 0 {
+				t.Errorf("left partial files %v", left)
+			}
+		})
+	}
+}
+
+// rangeSource resolves every request to a video of known size and duration
+// that FFmpeg reads directly.
+type rangeSource struct{}
+
+func (rangeSource) Resolve(ctx context.Context, req giffer.Request) (*giffer.Media, error) {
+	return &giffer.Media{
+		ID:       "range:" + req.URL,
+		URL:      req.URL,
+		Metadata: giffer.SourceMetadata{Duration: 100 * time.Second},
+		Ext:      ".mp4",
+		Stream:   req.URL,
+		Size:     100000,
+	}, nil
+}
+
+func (rangeSource) Fetch(ctx context.Context, m *giffer.Media, dst string) error {
+	return fmt.Errorf("fetching %s whole", m.URL)
+}
+
+func TestDownloadRangeProgress(t *testing.T) {
+	h := harness(t)
+	sources := giffer.NewRegistry()
+	sources.RegisterScheme("range", rangeSource{})
+	var last giffer.DownloadProgress
+	dl := giffer.Downloader{
+		Dir:      t.TempDir(),
+		FFmpeg:   h.Path("ffmpeg"),
+		Sources:  sources,
+		Margin:   2,
+		Align:    30,
+		Progress: func(p giffer.DownloadProgress) { last = p },
+	}
+	if _, err := dl.Download(giffer.Request{URL: "range://video", Start: 40, End: 45, Codecs: giffer.Codecs{}}); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+	// 32 of the 100 seconds, from 28 to 60.
+	if last.Total != 32000 {
+		t.Errorf("total = %d, want an estimate of 32000", last.Total)
+	}
+}
+
+func TestDownloadLocalFile(t *testing.T) {
+	var (
+		video = filepath.Join(t.TempDir(), "clip.mkv")
+		dl    = giffer.Downloader{Dir: t.TempDir()}
+		req   = giffer.Request{URL: video}
+	)
+	download := func(want string, cached bool) giffer.Clip {
+		t.Helper()
+		clip, err := dl.Download(req)
+		if err != nil {
+			t.Fatalf("downloading: %v", err)
+		}
+		if data, err := ioutil.ReadFile(clip.Path); err != nil || string(data) != want {
+			t.Errorf("downloaded %q (%v), want %q", data, err, want)
+		}
+		if clip.Cached != cached {
+			t.Errorf("cached = %v, want %v", clip.Cached, cached)
+		}
+		return clip
+	}
+	if err := ioutil.WriteFile(video, []byte("first cut"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	clip := download("first cut", false)
+	download("first cut", true)
+	// The cache holds a copy, not the user's file.
+	orig, err := os.Stat(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := os.Stat(clip.Path); err != nil || os.SameFile(orig, cached) {
+		t.Errorf("the cached video is the user's file")
+	}
+	// Replacing the file, even with one the same size, isn't served the old
+	// one from the cache.
+	if err := ioutil.WriteFile(video, []byte("final cut"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := orig.ModTime().Add(time.Second)
+	if err := os.Chtimes(video, later, later); err != nil {
+		t.Fatal(err)
+	}
+	download("final cut", false)
+}
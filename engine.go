@@ -1,6 +1,7 @@
 package giffer
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -18,12 +19,24 @@ import (
 type Engine struct {
 	Dir     string    // Directory to write temporary files.
 	FFmpeg  string    // Path to FFmpeg binary.
+	FFprobe string    // Path to FFprobe binary, defaults to the one beside FFmpeg.
 	Convert string    // Path to imagemagick Convert binary.
 	Debug   bool      // Print commands used.
 	Out     io.Writer // Writer to use if debug is true.
 	Junk    []string  // Temporary files to cleanup.
 
-	once sync.Once
+	// Provenance selects the metadata blocks that Stamp embeds.
+	// Zero disables stamping.
+	Provenance ProvenanceFormat
+	// Cache keeps the intermediate files of Transcode for reuse. Nil
+	// doesn't cache them.
+	Cache *StageCache
+	// Stages that Transcode has done, with whether they were cached.
+	Stages StageReport
+
+	once          sync.Once
+	mu            sync.Mutex
+	ffmpegVersion string
 }
 
 // Cut and merge the target file into the specified time slices.
@@ -41,7 +54,7 @@ func (eng *Engine) Cut(video string, cuts ...[2]int) (string, error) {
 		merged   = eng.path(fmt.Sprintf("merged%s", filepath.Ext(video)))
 	)
 	defer func() {
-		eng.Junk = append(eng.Junk, append(cutfiles, filelist, merged)...)
+		eng.junk(append(cutfiles, filelist, merged)...)
 	}()
 	for ii, c := range cuts {
 		start, end := c[0], c[1]
@@ -85,6 +98,9 @@ func (eng *Engine) Cut(video string, cuts ...[2]int) (string, error) {
 }
 
 // Transcode the target video file into a gif.
+// Y4M videos are transcoded natively, without FFmpeg.
+// Other videos go through eng.Cache, if set, recording the stages of this
+// call on eng.Stages.
 // Returns a filepath to the gif image.
 func (eng *Engine) Transcode(
 	video string,
@@ -95,12 +111,16 @@ func (eng *Engine) Transcode(
 	if err := eng.init(); err != nil {
 		return "", fmt.Errorf("initializing engine: %w", err)
 	}
+	eng.mu.Lock()
+	eng.Stages = nil
+	eng.mu.Unlock()
 	var (
 		duration   = end - start
 		filters    string
 		palettegen string
-		palette    = eng.path("palette.png")
-		output     = eng.path(fmt.Sprintf("%s.gif", strings.Split(filepath.Base(video), ".")[0]))
+		name       = strings.Split(filepath.Base(video), ".")[0]
+		palette    = eng.path(name + ".palette.png")
+		output     = eng.path(name + ".gif")
 	)
 	if height < -2 {
 		height = -2
@@ -108,6 +128,13 @@ func (eng *Engine) Transcode(
 	if width < -2 {
 		width = -2
 	}
+	if isY4M(video) {
+		defer eng.junk(output)
+		if err := eng.transcodeY4M(video, output, start, end, width, height, fps); err != nil {
+			return "", errors.Wrap(err, "transcoding y4m")
+		}
+		return output, nil
+	}
 	if fps > 0.0 {
 		filters += fmt.Sprintf("fps=%2f", fps)
 	}
@@ -122,9 +149,118 @@ func (eng *Engine) Transcode(
 	} else {
 		palettegen = "palettegen"
 	}
+	if eng.Cache != nil {
+		defer eng.junk(output)
+		if err := eng.transcodeCached(video, output, start, duration, filters, palettegen, fps); err != nil {
+			return "", err
+		}
+		return output, nil
+	}
+	defer eng.junk(palette, output)
+	if err := eng.palette(video, palette, start, duration, palettegen); err != nil {
+		return "", err
+	}
+	if err := eng.render(video, palette, output, start, duration, filters, fps); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+// transcodeCached is Transcode through eng.Cache. The stages are looked up
+// from the last, so that those before a cached stage aren't needed at all.
+// The stages used are only released for eviction once the gif is made.
+func (eng *Engine) transcodeCached(
+	video, output string,
+	start, duration float64,
+	filters, palettegen string,
+	fps float64,
+) (err error) {
+	sum, err := fingerprint(video)
+	if err != nil {
+		return errors.Wrap(err, "fingerprinting video")
+	}
+	var (
+		segmentKey = stageKey(StageSegment, sum, fmt.Sprintf("%f", start), fmt.Sprintf("%f", duration))
+		paletteKey = stageKey(StagePalette, segmentKey, palettegen)
+		gifKey     = stageKey(StageGIF, paletteKey, filters, fmt.Sprintf("%f", fps))
+		segment    string
+		used       []string
+	)
 	defer func() {
-		eng.Junk = append(eng.Junk, palette, output)
+		if rerr := eng.Cache.release(used...); rerr != nil && err == nil {
+			err = errors.Wrap(rerr, "evicting stages")
+		}
 	}()
+	stage := func(stage, key, ext string, run func(path string) error) (string, error) {
+		path, err := eng.Cache.stage(eng, stage, key, ext, run)
+		if err == nil {
+			used = append(used, path)
+		}
+		return path, err
+	}
+	// The segment is needed by both the palette and the gif, but made once.
+	trim := func() (string, error) {
+		if segment != "" {
+			return segment, nil
+		}
+		path, err := stage(StageSegment, segmentKey, ".mkv", func(path string) error {
+			return eng.trim(video, path, start, duration)
+		})
+		segment = path
+		return path, err
+	}
+	gif, err := stage(StageGIF, gifKey, ".gif", func(path string) error {
+		palette, err := stage(StagePalette, paletteKey, ".png", func(path string) error {
+			segment, err := trim()
+			if err != nil {
+				return err
+			}
+			return eng.palette(segment, path, 0, 0, palettegen)
+		})
+		if err != nil {
+			return err
+		}
+		segment, err := trim()
+		if err != nil {
+			return err
+		}
+		return eng.render(segment, palette, path, 0, 0, filters, fps)
+	})
+	if err != nil {
+		return err
+	}
+	// The gif is copied out of the cache, since Crush and Stamp modify it.
+	in, err := os.Open(gif)
+	if err != nil {
+		return errors.Wrap(err, "reading cached gif")
+	}
+	defer in.Close()
+	if err := copyFileAtomic(output, in); err != nil {
+		return errors.Wrap(err, "copying cached gif")
+	}
+	return nil
+}
+
+// trim losslessly encodes the part of the video from start for duration,
+// without audio, so that later stages needn't seek through the whole video.
+func (eng *Engine) trim(video, output string, start, duration float64) error {
+	cut := eng.command(
+		eng.FFmpeg,
+		"-ss", fmt.Sprintf("%2f;omitempty", start),
+		"-t", fmt.Sprintf("%2f;omitempty", duration),
+		"-i", video,
+		"-an", "-c:v", "ffv1",
+		"-y", output,
+	)
+	if out, err := cut.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "trimming video: %s", string(out))
+	}
+	return nil
+}
+
+// palette generates the palette of the part of the video from start for
+// duration. Zero start and duration is the whole video.
+func (eng *Engine) palette(video, output string, start, duration float64, palettegen string) error {
 	// TODO(jfm): make these structured, with omission as a field.
 	genPalette := eng.command(
 		eng.FFmpeg,
@@ -132,11 +268,22 @@ func (eng *Engine) Transcode(
 		"-t", fmt.Sprintf("%2f;omitempty", duration),
 		"-i", video,
 		"-vf", palettegen,
-		"-y", palette,
+		"-y", output,
 	)
 	if out, err := genPalette.CombinedOutput(); err != nil {
-		return "", errors.Wrapf(err, "generating palette: %s", string(out))
+		return errors.Wrapf(err, "generating palette: %s", string(out))
 	}
+	return nil
+}
+
+// render makes the gif of the part of the video from start for duration,
+// using the palette.
+func (eng *Engine) render(
+	video, palette, output string,
+	start, duration float64,
+	filters string,
+	fps float64,
+) error {
 	makeGif := eng.command(
 		eng.FFmpeg,
 		"-ss", fmt.Sprintf("%2f;omitempty", start),
@@ -146,9 +293,32 @@ func (eng *Engine) Transcode(
 		"-y", output,
 	)
 	if out, err := makeGif.CombinedOutput(); err != nil {
-		return "", errors.Wrapf(err, "making gif: %s", string(out))
+		return errors.Wrapf(err, "making gif: %s", string(out))
 	}
-	return output, nil
+	if fps > 0.0 {
+		if err := eng.retime(output, fps); err != nil {
+			return errors.Wrap(err, "retiming gif")
+		}
+	}
+	return nil
+}
+
+// retime rewrites the frame delays of the gif so that the rounding error of
+// each delay is spread across the animation, rather than accumulating.
+func (eng *Engine) retime(gif string, fps float64) error {
+	data, err := ioutil.ReadFile(gif)
+	if err != nil {
+		return errors.Wrap(err, "reading gif")
+	}
+	layout, err := scanGIF(data)
+	if err != nil {
+		return errors.Wrap(err, "scanning gif")
+	}
+	setDelays(data, layout, Delays(fps, len(layout.Frames)))
+	if err := ioutil.WriteFile(gif, data, 0644); err != nil {
+		return errors.Wrap(err, "writing gif")
+	}
+	return nil
 }
 
 // Crush reduces the file size of a gif image.
@@ -171,15 +341,114 @@ func (eng *Engine) Crush(gif string, fuzz int) error {
 	return nil
 }
 
+// Stamp embeds provenance metadata into the gif, in the formats selected by
+// eng.Provenance. Unset versions and dimensions are filled in.
+func (eng *Engine) Stamp(gif string, p Provenance) error {
+	if eng.Provenance == 0 {
+		return nil
+	}
+	if err := eng.init(); err != nil {
+		return fmt.Errorf("initializing engine: %w", err)
+	}
+	data, err := ioutil.ReadFile(gif)
+	if err != nil {
+		return errors.Wrap(err, "reading gif")
+	}
+	if p.Width == 0 && p.Height == 0 && len(data) >= gifHeaderSize+4 {
+		p.Width = int(data[6]) | int(data[7])<<8
+		p.Height = int(data[8]) | int(data[9])<<8
+	}
+	if p.Giffer == "" {
+		p.Giffer = Version
+	}
+	if p.FFmpeg == "" {
+		if p.FFmpeg, err = eng.FFmpegVersion(); err != nil {
+			eng.logf("stamp: %v\n", err)
+		}
+	}
+	data, err = EmbedProvenance(data, p, eng.Provenance)
+	if err != nil {
+		return errors.Wrap(err, "embedding provenance")
+	}
+	if err := ioutil.WriteFile(gif, data, 0644); err != nil {
+		return errors.Wrap(err, "writing gif")
+	}
+	return nil
+}
+
+// FFmpegVersion reports the version of the FFmpeg binary.
+func (eng *Engine) FFmpegVersion() (string, error) {
+	if eng.ffmpegVersion != "" {
+		return eng.ffmpegVersion, nil
+	}
+	if err := eng.init(); err != nil {
+		return "", fmt.Errorf("initializing engine: %w", err)
+	}
+	out, err := eng.command(eng.FFmpeg, "-version").Output()
+	if err != nil {
+		return "", errors.Wrap(err, "querying ffmpeg version")
+	}
+	// The first line reads "ffmpeg version <version> Copyright ...".
+	fields := strings.Fields(strings.SplitN(string(out), "\n", 2)[0])
+	if len(fields) < 3 || fields[1] != "version" {
+		return "", fmt.Errorf("unrecognised ffmpeg version: %q", fields)
+	}
+	eng.ffmpegVersion = fields[2]
+	return eng.ffmpegVersion, nil
+}
+
+// Chapters reads the chapters of the video's container.
+func (eng *Engine) Chapters(video string) ([]Chapter, error) {
+	if err := eng.init(); err != nil {
+		return nil, fmt.Errorf("initializing engine: %w", err)
+	}
+	eng.logf("%s -show_chapters %s\n", eng.FFprobe, video)
+	return probeChapters(context.Background(), eng.FFprobe, video)
+}
+
+// Fork returns an engine with the same configuration and no temporary files,
+// so that it can work alongside eng without either cleaning up the other's
+// files.
+func (eng *Engine) Fork() *Engine {
+	return &Engine{
+		Dir:        eng.Dir,
+		FFmpeg:     eng.FFmpeg,
+		FFprobe:    eng.FFprobe,
+		Convert:    eng.Convert,
+		Debug:      eng.Debug,
+		Out:        eng.Out,
+		Provenance: eng.Provenance,
+		Cache:      eng.Cache,
+	}
+}
+
 // Clean the temporary files.
 func (eng *Engine) Clean() {
-	for _, f := range eng.Junk {
+	eng.mu.Lock()
+	junk := eng.Junk
+	eng.Junk = nil
+	eng.mu.Unlock()
+	for _, f := range junk {
 		if err := os.Remove(f); err != nil {
 			eng.logf("clean: %v\n", err)
 		}
 	}
 }
 
+// stage records a stage that was done.
+func (eng *Engine) stage(r StageResult) {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	eng.Stages = append(eng.Stages, r)
+}
+
+// junk records temporary files to clean.
+func (eng *Engine) junk(files ...string) {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	eng.Junk = append(eng.Junk, files...)
+}
+
 // command creates a new exec.Cmd after removing empty arguments.
 // If an argument value contains "<value>;omitempty" and <value> is a zero
 // value, the argument value and it's corresponding argument specifier are
@@ -188,7 +457,7 @@ func (eng *Engine) command(cmd string, args ...string) *exec.Cmd {
 	var a []string
 	for ii := 0; ii < len(args); ii++ {
 		arg := args[ii]
-		if arg[0] == '-' { // This is an argument specifier eg "-h".
+		if arg[0] == '-' && ii+1 < len(args) { // This is an argument specifier eg "-h".
 			if v := args[ii+1]; v == "" {
 				ii++
 				continue
@@ -199,13 +468,9 @@ func (eng *Engine) command(cmd string, args ...string) *exec.Cmd {
 					ii++
 					continue
 				}
-				x, _ := strconv.Atoi(v)
-				if x == 0 {
-					ii++
-					continue
-				}
-				fl, _ := strconv.ParseFloat(v, 64)
-				if fl <= 0.0 {
+				// Parse as a float so that fractional values such as
+				// "1.500000" aren't mistaken for zero.
+				if fl, err := strconv.ParseFloat(v, 64); err == nil && fl <= 0.0 {
 					ii++
 					continue
 				}
@@ -240,6 +505,9 @@ func (eng *Engine) init() (err error) {
 		if eng.FFmpeg == "" {
 			eng.FFmpeg = "ffmpeg"
 		}
+		if eng.FFprobe == "" {
+			eng.FFprobe = ffprobeFor(eng.FFmpeg)
+		}
 		if eng.Dir == "" {
 			return
 		}
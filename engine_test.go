@@ -0,0 +1,365 @@
+package giffer_test
+
+import (
+	"fmt"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackmordaunt/giffer/giffertest"
+)
+
+var (
+	// fakes is built once and copied for each test, since building is slow.
+	fakes     *giffertest.Harness
+	fakesErr  error
+	buildOnce sync.Once
+)
+
+// harness installs the fake tools into a temporary directory.
+func harness(t *testing.T) *giffertest.Harness {
+	t.Helper()
+	buildOnce.Do(func() {
+		var dir string
+		if dir, fakesErr = ioutil.TempDir("", "giffertest"); fakesErr == nil {
+			fakes, fakesErr = giffertest.New(dir)
+		}
+	})
+	if fakesErr != nil {
+		t.Fatalf("building fakes: %v", fakesErr)
+	}
+	h := &giffertest.Harness{Dir: t.TempDir()}
+	for _, tool := range giffertest.Tools {
+		data, err := ioutil.ReadFile(fakes.Path(tool))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(h.Path(tool), data, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if fakes != nil {
+		os.RemoveAll(fakes.Dir)
+	}
+	os.Exit(code)
+}
+
+// calls returns the recorded invocations of the fakes.
+func calls(t *testing.T, h *giffertest.Harness) []giffertest.Call {
+	t.Helper()
+	calls, err := h.Calls()
+	if err != nil {
+		t.Fatalf("reading calls: %v", err)
+	}
+	return calls
+}
+
+// flag returns the value following name in args.
+func flag(args []string, name string) (string, bool) {
+	for ii := 0; ii+1 < len(args); ii++ {
+		if args[ii] == name {
+			return args[ii+1], true
+		}
+	}
+	return "", false
+}
+
+func TestTranscodeOffsets(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end float64
+		// ss and t are the expected values of -ss and -t, empty when they
+		// should be omitted.
+		ss, t string
+	}{
+		{"fractional", 0.5, 1.25, "0.500000", "0.750000"},
+		{"fractional duration", 2, 2.5, "2.000000", "0.500000"},
+		{"whole", 1, 3, "1.000000", "2.000000"},
+		{"from the start", 0, 2, "", "2.000000"},
+		{"whole video", 0, 0, "", ""},
+	}
+	h := harness(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := h.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			eng := h.Engine()
+			eng.Dir = t.TempDir()
+			defer eng.Clean()
+			if _, err := eng.Transcode("video.mp4", tt.start, tt.end, 0, 0, 0); err != nil {
+				t.Fatalf("transcoding: %v", err)
+			}
+			for _, c := range calls(t, h) {
+				if c.Tool != "ffmpeg" {
+					continue
+				}
+				ss, ok := flag(c.Args, "-ss")
+				if ok != (tt.ss != "") || ss != tt.ss {
+					t.Errorf("-ss = %q (present %v), want %q in %q", ss, ok, tt.ss, c.Args)
+				}
+				d, ok := flag(c.Args, "-t")
+				if ok != (tt.t != "") || d != tt.t {
+					t.Errorf("-t = %q (present %v), want %q in %q", d, ok, tt.t, c.Args)
+				}
+			}
+		})
+	}
+}
+
+func TestTranscodeCommands(t *testing.T) {
+	h := harness(t)
+	// Only frames with a delay have one to rewrite.
+	if err := h.Script("ffmpeg", giffertest.Script{Delay: 4}); err != nil {
+		t.Fatal(err)
+	}
+	eng := h.Engine()
+	defer eng.Clean()
+	gif, err := eng.Transcode("clip.mp4", 1, 3, 320, 0, 10)
+	if err != nil {
+		t.Fatalf("transcoding: %v", err)
+	}
+	var (
+		palette = filepath.Join(eng.Dir, "clip.palette.png")
+		want    = [][]string{
+			{
+				"-ss", "1.000000", "-t", "2.000000",
+				"-i", "clip.mp4",
+				"-vf", "fps=10.000000,scale=320:0:flags=lanczos,palettegen",
+				"-y", palette,
+			},
+			{
+				"-ss", "1.000000", "-t", "2.000000",
+				"-i", "clip.mp4", "-i", palette,
+				"-lavfi", "fps=10.000000,scale=320:0:flags=lanczos [x]; [x][1:v] paletteuse",
+				"-y", gif,
+			},
+		}
+		got = calls(t, h)
+	)
+	if len(got) != len(want) {
+		t.Fatalf("got %d calls, want %d: %v", len(got), len(want), got)
+	}
+	for ii, c := range got {
+		if c.Tool != "ffmpeg" || !reflect.DeepEqual(c.Args, want[ii]) {
+			t.Errorf("call %d = %s %q, want ffmpeg %q", ii, c.Tool, c.Args, want[ii])
+		}
+	}
+	if gif != filepath.Join(eng.Dir, "clip.gif") {
+		t.Errorf("gif = %s, want it in %s", gif, eng.Dir)
+	}
+	// The delays of the gif are rewritten to match the frame rate.
+	img := decode(t, gif)
+	for ii, d := range img.Delay {
+		if d != 10 {
+			t.Errorf("frame %d has delay %d, want 10", ii, d)
+		}
+	}
+}
+
+func TestTranscodeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		scripts []giffertest.Script
+		want    string
+	}{
+		{
+			name:    "palette",
+			scripts: []giffertest.Script{{ExitCode: 1, Stderr: "no such stream"}},
+			want:    "generating palette: no such stream",
+		},
+		{
+			name:    "gif",
+			scripts: []giffertest.Script{{}, {ExitCode: 1, Stderr: "invalid filter"}},
+			want:    "making gif: invalid filter",
+		},
+		{
+			name:    "truncated gif",
+			scripts: []giffertest.Script{{}, {Output: giffertest.OutputTruncated}},
+			want:    "retiming gif",
+		},
+	}
+	h := harness(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := h.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			if err := h.Script("ffmpeg", tt.scripts...); err != nil {
+				t.Fatal(err)
+			}
+			eng := h.Engine()
+			eng.Dir = t.TempDir()
+			_, err := eng.Transcode("clip.mp4", 0, 1, 0, 0, 10)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.want)
+			}
+			// The files made before the failure are still cleaned up.
+			eng.Clean()
+			if left := files(t, eng.Dir); len(left) > 0 {
+				t.Errorf("clean left %v", left)
+			}
+		})
+	}
+}
+
+func TestCrush(t *testing.T) {
+	gif := filepath.Join(t.TempDir(), "a.gif")
+	tests := []struct {
+		name string
+		fuzz int
+		want []string
+	}{
+		{"fuzz", 4, []string{gif, "-fuzz", "4%", "-layers", "Optimize", gif}},
+		{"no fuzz", 0, []string{gif, "-layers", "Optimize", gif}},
+	}
+	h := harness(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := h.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			if err := h.Engine().Crush(gif, tt.fuzz); err != nil {
+				t.Fatalf("crushing: %v", err)
+			}
+			got := calls(t, h)
+			if len(got) != 1 || got[0].Tool != "convert" || !reflect.DeepEqual(got[0].Args, tt.want) {
+				t.Errorf("calls = %v, want convert %q", got, tt.want)
+			}
+		})
+	}
+	t.Run("failure", func(t *testing.T) {
+		if err := h.Script("convert", giffertest.Script{ExitCode: 1, Stderr: "not a gif"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Engine().Crush(gif, 4); err == nil || !strings.Contains(err.Error(), "not a gif") {
+			t.Errorf("got error %v, want the output of convert", err)
+		}
+	})
+	t.Run("without convert", func(t *testing.T) {
+		if err := h.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		eng := h.Engine()
+		eng.Convert = ""
+		if err := eng.Crush(gif, 4); err != nil {
+			t.Fatalf("crushing: %v", err)
+		}
+		if got := calls(t, h); len(got) != 0 {
+			t.Errorf("crush without convert ran %v", got)
+		}
+	})
+}
+
+func TestCut(t *testing.T) {
+	h := harness(t)
+	eng := h.Engine()
+	video := filepath.Join(t.TempDir(), "video.mp4")
+	if err := ioutil.WriteFile(video, []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := eng.Cut(video, [2]int{1, 3}, [2]int{5, 6})
+	if err != nil {
+		t.Fatalf("cutting: %v", err)
+	}
+	got := calls(t, h)
+	if len(got) != 3 {
+		t.Fatalf("got %d calls, want 3: %v", len(got), got)
+	}
+	for ii, want := range [][2]string{{"1", "2"}, {"5", "1"}} {
+		ss, _ := flag(got[ii].Args, "-ss")
+		d, _ := flag(got[ii].Args, "-t")
+		if ss != want[0] || d != want[1] {
+			t.Errorf("cut %d: -ss %s -t %s, want -ss %s -t %s", ii, ss, d, want[0], want[1])
+		}
+	}
+	list, _ := flag(got[2].Args, "-i")
+	data, err := ioutil.ReadFile(list)
+	if err != nil {
+		t.Fatalf("reading file list: %v", err)
+	}
+	want := fmt.Sprintf("file '%s'\nfile '%s'",
+		filepath.Join(eng.Dir, "tmp_0.mp4"),
+		filepath.Join(eng.Dir, "tmp_1.mp4"),
+	)
+	if string(data) != want {
+		t.Errorf("file list = %q, want %q", data, want)
+	}
+	if merged != filepath.Join(eng.Dir, "merged.mp4") {
+		t.Errorf("merged = %s", merged)
+	}
+	eng.Clean()
+	if left := files(t, eng.Dir); len(left) > 0 {
+		t.Errorf("clean left %v", left)
+	}
+	if _, err := eng.Cut(video, [2]int{3, 1}); err == nil {
+		t.Errorf("cut with start after end succeeded")
+	}
+}
+
+func TestClean(t *testing.T) {
+	h := harness(t)
+	eng := h.Engine()
+	gif, err := eng.Transcode("clip.mp4", 0, 1, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("transcoding: %v", err)
+	}
+	if _, err := os.Stat(gif); err != nil {
+		t.Fatalf("gif wasn't made: %v", err)
+	}
+	// A fork's files are its own.
+	fork := eng.Fork()
+	if _, err := fork.Transcode("other.mp4", 0, 1, 0, 0, 0); err != nil {
+		t.Fatalf("transcoding: %v", err)
+	}
+	eng.Clean()
+	if len(eng.Junk) != 0 {
+		t.Errorf("junk = %v after clean", eng.Junk)
+	}
+	if left := files(t, eng.Dir); !reflect.DeepEqual(left, []string{"other.gif", "other.palette.png"}) {
+		t.Errorf("clean left %v, want only the fork's files", left)
+	}
+	fork.Clean()
+	if left := files(t, eng.Dir); len(left) > 0 {
+		t.Errorf("clean left %v", left)
+	}
+}
+
+// files lists the names of the files in dir.
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+// decode reads the gif at path.
+func decode(t *testing.T, path string) *gif.GIF {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", path, err)
+	}
+	return img
+}
@@ -0,0 +1,90 @@
+package giffer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Flight coalesces concurrent calls that do the same work, identified by a
+// key, so that the work is done once and every caller shares its result.
+//
+// The work runs detached from the callers' contexts. A caller that gives up
+// returns early without affecting the others, and the work is only cancelled
+// once every caller has given up. If the work panics, every caller gets the
+// panic as an error.
+//
+// The zero value is ready to use.
+type Flight struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+	// waiters is the number of callers still waiting, and dups the number
+	// that joined the call after it began, whether or not they still wait.
+	waiters int
+	dups    int
+	cancel  context.CancelFunc
+}
+
+// Do calls fn, unless a call for key is already in flight in which case it
+// waits for that call instead. shared reports whether the call was joined by
+// more than one caller, even if some of them gave up before it landed.
+func (f *Flight) Do(
+	ctx context.Context,
+	key string,
+	fn func(ctx context.Context) (interface{}, error),
+) (v interface{}, shared bool, err error) {
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = make(map[string]*flightCall)
+	}
+	c, ok := f.calls[key]
+	if !ok {
+		work, cancel := context.WithCancel(context.Background())
+		c = &flightCall{done: make(chan struct{}), cancel: cancel}
+		f.calls[key] = c
+		go func() {
+			defer cancel()
+			defer func() {
+				if r := recover(); r != nil {
+					c.val, c.err = nil, fmt.Errorf("%s: panic: %v", key, r)
+				}
+				f.mu.Lock()
+				if f.calls[key] == c {
+					delete(f.calls, key)
+				}
+				f.mu.Unlock()
+				close(c.done)
+			}()
+			c.val, c.err = fn(work)
+		}()
+	} else {
+		c.dups++
+	}
+	c.waiters++
+	f.mu.Unlock()
+	select {
+	case <-c.done:
+		f.mu.Lock()
+		shared = ok || c.dups > 0
+		f.mu.Unlock()
+		return c.val, shared, c.err
+	case <-ctx.Done():
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if c.waiters--; c.waiters == 0 {
+			// Nobody wants the result any more. Later callers start afresh
+			// rather than joining work that is being cancelled.
+			c.cancel()
+			if f.calls[key] == c {
+				delete(f.calls, key)
+			}
+		}
+		return nil, false, ctx.Err()
+	}
+}
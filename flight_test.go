@@ -0,0 +1,197 @@
+package giffer_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackmordaunt/giffer"
+)
+
+// result is what a call of Flight.Do returned.
+type result struct {
+	v      interface{}
+	shared bool
+	err    error
+}
+
+// join calls f.Do in the background, and waits long enough for the call to
+// have joined any in flight.
+func join(f *giffer.Flight, ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) <-chan result {
+	out := make(chan result, 1)
+	go func() {
+		v, shared, err := f.Do(ctx, key, fn)
+		out <- result{v, shared, err}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	return out
+}
+
+// receive waits for the result of a call.
+func receive(t *testing.T, r <-chan result) result {
+	t.Helper()
+	select {
+	case got := <-r:
+		return got
+	case <-time.After(5 * time.Second):
+		t.Fatal("call didn't return")
+		return result{}
+	}
+}
+
+func TestFlightShares(t *testing.T) {
+	var (
+		f       giffer.Flight
+		calls   int32
+		release = make(chan struct{})
+		fn      = func(ctx context.Context) (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return "done", nil
+		}
+		results []<-chan result
+	)
+	for ii := 0; ii < 5; ii++ {
+		results = append(results, join(&f, context.Background(), "key", fn))
+	}
+	// Other keys fly separately.
+	other := join(&f, context.Background(), "other", func(ctx context.Context) (interface{}, error) {
+		return "other", nil
+	})
+	close(release)
+	for ii, r := range results {
+		if got := receive(t, r); got.v != "done" || !got.shared || got.err != nil {
+			t.Errorf("caller %d got %+v, want the shared result", ii, got)
+		}
+	}
+	if got := receive(t, other); got.v != "other" || got.shared {
+		t.Errorf("other key got %+v", got)
+	}
+	if calls != 1 {
+		t.Errorf("did the work %d times, want once", calls)
+	}
+	// Once landed, the next call does the work again.
+	if _, shared, _ := f.Do(context.Background(), "key", fn); shared || calls != 2 {
+		t.Errorf("a later call shared %v and did the work %d times", shared, calls)
+	}
+}
+
+func TestFlightWaiterCancels(t *testing.T) {
+	var (
+		f        giffer.Flight
+		release  = make(chan struct{})
+		canceled = make(chan struct{})
+		fn       = func(ctx context.Context) (interface{}, error) {
+			select {
+			case <-release:
+				return "done", nil
+			case <-ctx.Done():
+				close(canceled)
+				return nil, ctx.Err()
+			}
+		}
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+	defer cancel()
+	first := join(&f, ctx, "key", fn)
+	second := join(&f, context.Background(), "key", fn)
+	cancel()
+	if got := receive(t, first); !errors.Is(got.err, context.Canceled) {
+		t.Errorf("cancelled caller got %+v, want it cancelled", got)
+	}
+	select {
+	case <-canceled:
+		t.Fatal("the work was cancelled while a caller still waited")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	// The call was joined by both, though only one is left for the result.
+	if got := receive(t, second); got.v != "done" || !got.shared || got.err != nil {
+		t.Errorf("remaining caller got %+v, want the shared result", got)
+	}
+}
+
+func TestFlightLastWaiterCancels(t *testing.T) {
+	var (
+		f        giffer.Flight
+		calls    int32
+		canceled = make(chan struct{})
+		fn       = func(ctx context.Context) (interface{}, error) {
+			if atomic.AddInt32(&calls, 1) > 1 {
+				return "again", nil
+			}
+			<-ctx.Done()
+			close(canceled)
+			return nil, ctx.Err()
+		}
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+	first := join(&f, ctx, "key", fn)
+	second := join(&f, ctx, "key", fn)
+	cancel()
+	for _, r := range []<-chan result{first, second} {
+		if got := receive(t, r); !errors.Is(got.err, context.Canceled) {
+			t.Errorf("got %+v, want it cancelled", got)
+		}
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the work wasn't cancelled once every caller gave up")
+	}
+	// A new caller doesn't join the cancelled work.
+	v, shared, err := f.Do(context.Background(), "key", fn)
+	if v != "again" || shared || err != nil {
+		t.Errorf("new caller got %v, %v, %v, want fresh work", v, shared, err)
+	}
+}
+
+func TestFlightFailures(t *testing.T) {
+	failure := errors.New("failed")
+	tests := []struct {
+		name string
+		fn   func(release <-chan struct{}) (interface{}, error)
+		want func(err error) bool
+	}{
+		{
+			"error",
+			func(release <-chan struct{}) (interface{}, error) {
+				<-release
+				return nil, failure
+			},
+			func(err error) bool { return errors.Is(err, failure) },
+		},
+		{
+			"panic",
+			func(release <-chan struct{}) (interface{}, error) {
+				<-release
+				panic("boom")
+			},
+			func(err error) bool { return err != nil && strings.Contains(err.Error(), "boom") },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				f       giffer.Flight
+				release = make(chan struct{})
+				results []<-chan result
+			)
+			fn := func(ctx context.Context) (interface{}, error) {
+				return tt.fn(release)
+			}
+			for ii := 0; ii < 3; ii++ {
+				results = append(results, join(&f, context.Background(), "key", fn))
+			}
+			close(release)
+			for ii, r := range results {
+				if got := receive(t, r); got.v != nil || !tt.want(got.err) {
+					t.Errorf("caller %d got %+v", ii, got)
+				}
+			}
+		})
+	}
+}
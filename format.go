@@ -0,0 +1,215 @@
+package giffer
+
+import (
+	"fmt"
+	"mime"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+// Codecs is a set of codec families, such as "h264" or "vp9".
+// A nil set contains every codec.
+type Codecs map[string]bool
+
+// Has reports whether the set contains the codec.
+func (c Codecs) Has(codec string) bool {
+	return c == nil || c[codec]
+}
+
+// decoderFamilies maps FFmpeg decoder names to the codec family they decode.
+var decoderFamilies = map[string]string{
+	"h264":       "h264",
+	"h264_cuvid": "h264",
+	"hevc":       "hevc",
+	"vp8":        "vp8",
+	"libvpx":     "vp8",
+	"vp9":        "vp9",
+	"libvpx-vp9": "vp9",
+	"av1":        "av1",
+	"libdav1d":   "av1",
+	"libaom-av1": "av1",
+	"mpeg4":      "mpeg4",
+	"h263":       "h263",
+}
+
+// FFmpegDecoders lists the video codec families the FFmpeg binary can decode.
+func FFmpegDecoders(ffmpeg string) (Codecs, error) {
+	out, err := exec.Command(ffmpeg, "-hide_banner", "-decoders").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing decoders: %w", err)
+	}
+	codecs := Codecs{}
+	// Lines look like " V....D h264    H.264 / AVC / MPEG-4 AVC".
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields[0]) != 6 || fields[0][0] != 'V' {
+			continue
+		}
+		if family, ok := decoderFamilies[fields[1]]; ok {
+			codecs[family] = true
+		}
+	}
+	return codecs, nil
+}
+
+// codecFamily maps an RFC 6381 codec string, as found in a mime type, to its
+// family. For example "avc1.4d401f" is "h264".
+func codecFamily(codec string) string {
+	codec = strings.ToLower(strings.TrimSpace(codec))
+	if dot := strings.IndexByte(codec, '.'); dot >= 0 {
+		codec = codec[:dot]
+	}
+	switch codec {
+	case "avc1", "avc3":
+		return "h264"
+	case "hev1", "hvc1":
+		return "hevc"
+	case "vp09":
+		return "vp9"
+	case "av01":
+		return "av1"
+	case "mp4v":
+		return "mpeg4"
+	case "s263":
+		return "h263"
+	}
+	return codec
+}
+
+// videoCodec returns the family of the video codec in the format's mime type,
+// or "" if the format has no video.
+func videoCodec(f *youtube.Format) string {
+	mediaType, params, err := mime.ParseMediaType(f.MimeType)
+	if err != nil || !strings.HasPrefix(mediaType, "video/") {
+		return ""
+	}
+	for _, c := range strings.Split(params["codecs"], ",") {
+		family := codecFamily(c)
+		switch family {
+		case "mp4a", "opus", "vorbis", "":
+			continue
+		}
+		return family
+	}
+	return ""
+}
+
+// DefaultMaxHeight bounds the height of the format picked when the output
+// size isn't given, since gifs are rarely made larger.
+var DefaultMaxHeight = 720
+
+// selectFormat picks the format to fetch for the request.
+//
+// An explicit req.Format, either an itag or a quality such as "720p", always
+// wins. Otherwise we want the cheapest format that still looks good: the
+// lowest bitrate video whose resolution is at least the requested size, with a
+// codec we can decode. Video only (adaptive) formats are preferred, since
+// audio is thrown away anyway. If nothing is big enough, the largest format
+// is used. Without a requested size, the largest format up to
+// DefaultMaxHeight is used.
+//
+// Returns the format along with an explanation of why it was picked.
+func selectFormat(formats youtube.FormatList, req Request) (*youtube.Format, string, error) {
+	if req.Format != "" {
+		if itag, err := strconv.Atoi(req.Format); err == nil {
+			if f := formats.FindByItag(itag); f != nil {
+				return f, "requested itag", nil
+			}
+			return nil, "", fmt.Errorf("no format with itag %d", itag)
+		}
+		for ii := range formats {
+			if f := &formats[ii]; f.QualityLabel == req.Format || f.Quality == req.Format {
+				return f, "requested quality", nil
+			}
+		}
+		return nil, "", fmt.Errorf("no format with quality %q", req.Format)
+	}
+	if req.Width < 0 {
+		req.Width = 0
+	}
+	if req.Height < 0 {
+		req.Height = 0
+	}
+	var adaptive, muxed []*youtube.Format
+	for ii := range formats {
+		f := &formats[ii]
+		codec := videoCodec(f)
+		if codec == "" || !req.Codecs.Has(codec) {
+			continue
+		}
+		if f.AudioChannels == 0 {
+			adaptive = append(adaptive, f)
+		} else {
+			muxed = append(muxed, f)
+		}
+	}
+	all := append(append([]*youtube.Format(nil), adaptive...), muxed...)
+	if len(all) == 0 {
+		return nil, "", fmt.Errorf("no decodable video formats")
+	}
+	// Largest first, then video only, then cheapest.
+	sort.SliceStable(all, func(ii, jj int) bool {
+		a, b := all[ii], all[jj]
+		if a.Width*a.Height != b.Width*b.Height {
+			return a.Width*a.Height > b.Width*b.Height
+		}
+		if (a.AudioChannels == 0) != (b.AudioChannels == 0) {
+			return a.AudioChannels == 0
+		}
+		return a.Bitrate < b.Bitrate
+	})
+	if req.Width == 0 && req.Height == 0 {
+		// Every format is big enough for an unsized output, but the smallest
+		// would make a needlessly poor gif.
+		for _, f := range all {
+			if f.Height <= DefaultMaxHeight {
+				return f, fmt.Sprintf("largest format up to %dp, no size was requested", DefaultMaxHeight), nil
+			}
+		}
+		smallest := all[len(all)-1]
+		for _, f := range all {
+			if f.Width*f.Height == smallest.Width*smallest.Height {
+				return f, fmt.Sprintf("smallest format, none are up to %dp", DefaultMaxHeight), nil
+			}
+		}
+	}
+	bigEnough := func(f *youtube.Format) bool {
+		return f.Width >= req.Width && f.Height >= req.Height
+	}
+	for _, group := range []struct {
+		formats []*youtube.Format
+		kind    string
+	}{
+		{adaptive, "video only"},
+		{muxed, "muxed"},
+	} {
+		var candidates []*youtube.Format
+		for _, f := range group.formats {
+			if bigEnough(f) {
+				candidates = append(candidates, f)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		sort.SliceStable(candidates, func(ii, jj int) bool {
+			return candidates[ii].Bitrate < candidates[jj].Bitrate
+		})
+		return candidates[0], fmt.Sprintf(
+			"lowest bitrate %s format of at least %dx%d", group.kind, req.Width, req.Height,
+		), nil
+	}
+	return all[0], fmt.Sprintf("largest format, none are at least %dx%d", req.Width, req.Height), nil
+}
+
+// describeFormat summarises a format for logging.
+func describeFormat(f *youtube.Format) string {
+	return fmt.Sprintf(
+		"itag %d: %dx%d %s %dkbps",
+		f.ItagNo, f.Width, f.Height, f.MimeType, f.Bitrate/1000,
+	)
+}
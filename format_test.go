@@ -0,0 +1,81 @@
+package giffer
+
+import (
+	"testing"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+func TestSelectFormat(t *testing.T) {
+	formats := youtube.FormatList{
+		{ItagNo: 18, MimeType: `video/mp4; codecs="avc1.42001E, mp4a.40.2"`, Width: 640, Height: 360, Bitrate: 500000, AudioChannels: 2},
+		{ItagNo: 22, MimeType: `video/mp4; codecs="avc1.64001F, mp4a.40.2"`, Width: 1280, Height: 720, Bitrate: 1500000, AudioChannels: 2},
+		{ItagNo: 160, MimeType: `video/mp4; codecs="avc1.4d400c"`, Width: 256, Height: 144, Bitrate: 100000},
+		{ItagNo: 134, MimeType: `video/mp4; codecs="avc1.4d401e"`, Width: 640, Height: 360, Bitrate: 400000},
+		{ItagNo: 243, MimeType: `video/webm; codecs="vp9"`, Width: 640, Height: 360, Bitrate: 300000},
+		{ItagNo: 136, MimeType: `video/mp4; codecs="avc1.4d401f"`, Width: 1280, Height: 720, Bitrate: 1200000},
+		{ItagNo: 247, MimeType: `video/webm; codecs="vp9"`, Width: 1280, Height: 720, Bitrate: 1000000},
+		{ItagNo: 137, MimeType: `video/mp4; codecs="avc1.640028"`, Width: 1920, Height: 1080, Bitrate: 4000000, QualityLabel: "1080p"},
+		{ItagNo: 140, MimeType: `audio/mp4; codecs="mp4a.40.2"`, Bitrate: 128000, AudioChannels: 2},
+	}
+	tests := []struct {
+		name string
+		req  Request
+		want int
+	}{
+		{"no size", Request{}, 247},
+		{"no size, negative", Request{Width: -2, Height: -1}, 247},
+		{"no size, h264 only", Request{Codecs: Codecs{"h264": true}}, 136},
+		{"width", Request{Width: 320}, 243},
+		{"height", Request{Height: 400}, 247},
+		{"both", Request{Width: 1280, Height: 720}, 247},
+		{"too big", Request{Width: 4000}, 137},
+		{"too big, h264 only", Request{Width: 4000, Codecs: Codecs{"h264": true}}, 137},
+		{"width, h264 only", Request{Width: 320, Codecs: Codecs{"h264": true}}, 134},
+		{"itag", Request{Format: "18"}, 18},
+		{"quality", Request{Format: "1080p"}, 137},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, why, err := selectFormat(formats, tt.req)
+			if err != nil {
+				t.Fatalf("selecting: %v", err)
+			}
+			if f.ItagNo != tt.want {
+				t.Errorf("selected %s (%s), want itag %d", describeFormat(f), why, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectFormatUnsizedSmallest(t *testing.T) {
+	// When every format is taller than the cap, the smallest is used.
+	formats := youtube.FormatList{
+		{ItagNo: 1, MimeType: `video/mp4; codecs="avc1"`, Width: 3840, Height: 2160, Bitrate: 9000000},
+		{ItagNo: 2, MimeType: `video/mp4; codecs="avc1, mp4a"`, Width: 1920, Height: 1080, Bitrate: 3000000, AudioChannels: 2},
+		{ItagNo: 3, MimeType: `video/mp4; codecs="avc1"`, Width: 1920, Height: 1080, Bitrate: 4000000},
+	}
+	f, _, err := selectFormat(formats, Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.ItagNo != 3 {
+		t.Errorf("selected %s, want itag 3", describeFormat(f))
+	}
+}
+
+func TestSelectFormatErrors(t *testing.T) {
+	formats := youtube.FormatList{
+		{ItagNo: 140, MimeType: `audio/mp4; codecs="mp4a.40.2"`, AudioChannels: 2},
+		{ItagNo: 243, MimeType: `video/webm; codecs="vp9"`, Width: 640, Height: 360},
+	}
+	for _, req := range []Request{
+		{Codecs: Codecs{"h264": true}},
+		{Format: "999"},
+		{Format: "4320p"},
+	} {
+		if f, _, err := selectFormat(formats, req); err == nil {
+			t.Errorf("selectFormat(%+v) = %s, want an error", req, describeFormat(f))
+		}
+	}
+}
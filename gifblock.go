@@ -0,0 +1,324 @@
+package giffer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// GIF block introducers and extension labels.
+const (
+	gifExtension      = 0x21
+	gifImage          = 0x2C
+	gifTrailer        = 0x3B
+	gifControlLabel   = 0xF9
+	gifCommentLabel   = 0xFE
+	gifAppLabel       = 0xFF
+	gifHeaderSize     = 6
+	gifScreenSize     = 7
+	gifDescriptorSize = 10
+)
+
+// gifLayout records where the blocks of an encoded GIF live so that the stream
+// can be inspected or patched in place, without a decode/encode round trip.
+type gifLayout struct {
+	// GlobalTable is the number of entries in the global color table.
+	GlobalTable int
+	Extensions  []gifBlock
+	Frames      []gifFrame
+	// Trailer is the offset of the trailer byte.
+	Trailer int
+}
+
+// gifBlock spans an extension block, from its introducer to just past the
+// block terminator.
+type gifBlock struct {
+	Label  byte
+	Offset int
+	End    int
+}
+
+// gifFrame spans an image descriptor and its data.
+type gifFrame struct {
+	// Offset is the start of the frame, including its graphic control
+	// extension if it has one.
+	Offset int
+	// Control is the offset of the graphic control extension, or -1.
+	Control    int
+	Descriptor int
+	// LocalTable is the number of entries in the local color table.
+	LocalTable int
+	End        int
+}
+
+// Size of the frame in bytes.
+func (f gifFrame) Size() int {
+	return f.End - f.Offset
+}
+
+// scanGIF walks the blocks of an encoded GIF.
+func scanGIF(data []byte) (*gifLayout, error) {
+	if len(data) < gifHeaderSize+gifScreenSize ||
+		!bytes.HasPrefix(data, []byte("GIF8")) {
+		return nil, fmt.Errorf("not a gif")
+	}
+	var (
+		layout  = &gifLayout{Trailer: -1}
+		off     = gifHeaderSize + gifScreenSize
+		control = -1
+	)
+	if packed := data[gifHeaderSize+4]; packed&0x80 != 0 {
+		layout.GlobalTable = 1 << (packed&0x07 + 1)
+		off += 3 * layout.GlobalTable
+	}
+	for off < len(data) {
+		switch data[off] {
+		case gifExtension:
+			if off+1 >= len(data) {
+				return nil, errTruncated
+			}
+			end, err := skipSubBlocks(data, off+2)
+			if err != nil {
+				return nil, err
+			}
+			label := data[off+1]
+			if label == gifControlLabel {
+				control = off
+			}
+			layout.Extensions = append(layout.Extensions, gifBlock{
+				Label:  label,
+				Offset: off,
+				End:    end,
+			})
+			off = end
+		case gifImage:
+			if off+gifDescriptorSize > len(data) {
+				return nil, errTruncated
+			}
+			frame := gifFrame{
+				Offset:     off,
+				Control:    control,
+				Descriptor: off,
+			}
+			if control >= 0 {
+				frame.Offset = control
+			}
+			next := off + gifDescriptorSize
+			if packed := data[off+9]; packed&0x80 != 0 {
+				frame.LocalTable = 1 << (packed&0x07 + 1)
+				next += 3 * frame.LocalTable
+			}
+			// Skip the LZW minimum code size.
+			end, err := skipSubBlocks(data, next+1)
+			if err != nil {
+				return nil, err
+			}
+			frame.End = end
+			layout.Frames = append(layout.Frames, frame)
+			control = -1
+			off = end
+		case gifTrailer:
+			layout.Trailer = off
+			return layout, nil
+		default:
+			return nil, fmt.Errorf("unknown gif block 0x%02x at offset %d", data[off], off)
+		}
+	}
+	return nil, errTruncated
+}
+
+var errTruncated = fmt.Errorf("gif is truncated")
+
+// skimGIF reads an encoded GIF, keeping every block but the image data, which
+// is the bulk of it. The skim can be scanned like the gif it was read from,
+// without holding the whole gif in memory. Returns the size of each frame, as
+// gifFrame.Size counts it, and of the whole gif, since the skim has neither.
+func skimGIF(r io.Reader) (skim []byte, sizes []int, total int64, err error) {
+	s := &gifSkimmer{r: bufio.NewReader(r)}
+	if err := s.keep(gifHeaderSize + gifScreenSize); err != nil {
+		if errors.Is(err, errTruncated) {
+			err = fmt.Errorf("not a gif")
+		}
+		return nil, nil, 0, err
+	}
+	if !bytes.HasPrefix(s.skim, []byte("GIF8")) {
+		return nil, nil, 0, fmt.Errorf("not a gif")
+	}
+	if packed := s.skim[gifHeaderSize+4]; packed&0x80 != 0 {
+		if err := s.keep(3 * (1 << (packed&0x07 + 1))); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	control := int64(-1)
+	for {
+		off := s.read
+		if err := s.keep(1); err != nil {
+			return nil, nil, 0, err
+		}
+		switch introducer := s.skim[len(s.skim)-1]; introducer {
+		case gifExtension:
+			if err := s.keep(1); err != nil {
+				return nil, nil, 0, err
+			}
+			if s.skim[len(s.skim)-1] == gifControlLabel {
+				control = off
+			}
+			if err := s.subBlocks(true); err != nil {
+				return nil, nil, 0, err
+			}
+		case gifImage:
+			if err := s.keep(gifDescriptorSize - 1); err != nil {
+				return nil, nil, 0, err
+			}
+			if packed := s.skim[len(s.skim)-1]; packed&0x80 != 0 {
+				if err := s.keep(3 * (1 << (packed&0x07 + 1))); err != nil {
+					return nil, nil, 0, err
+				}
+			}
+			// Keep the LZW minimum code size, and drop the data after it.
+			if err := s.keep(1); err != nil {
+				return nil, nil, 0, err
+			}
+			if err := s.subBlocks(false); err != nil {
+				return nil, nil, 0, err
+			}
+			if control >= 0 {
+				off = control
+			}
+			sizes = append(sizes, int(s.read-off))
+			control = -1
+		case gifTrailer:
+			// Anything after the trailer still counts towards the size.
+			rest, err := io.Copy(ioutil.Discard, s.r)
+			if err != nil {
+				return nil, nil, 0, fmt.Errorf("reading gif: %w", err)
+			}
+			return s.skim, sizes, s.read + rest, nil
+		default:
+			return nil, nil, 0, fmt.Errorf("unknown gif block 0x%02x at offset %d", introducer, off)
+		}
+	}
+}
+
+// gifSkimmer reads a gif for skimGIF.
+type gifSkimmer struct {
+	r    *bufio.Reader
+	skim []byte
+	// read counts the bytes read from r.
+	read int64
+}
+
+// keep reads n bytes into the skim.
+func (s *gifSkimmer) keep(n int) error {
+	start := len(s.skim)
+	s.skim = append(s.skim, make([]byte, n)...)
+	read, err := io.ReadFull(s.r, s.skim[start:])
+	s.read += int64(read)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errTruncated
+	}
+	if err != nil {
+		return fmt.Errorf("reading gif: %w", err)
+	}
+	return nil
+}
+
+// subBlocks reads a chain of sub-blocks, into the skim if keep is set.
+// Otherwise the skim gets an empty chain in its place.
+func (s *gifSkimmer) subBlocks(keep bool) error {
+	for {
+		n, err := s.r.ReadByte()
+		if err == io.EOF {
+			return errTruncated
+		}
+		if err != nil {
+			return fmt.Errorf("reading gif: %w", err)
+		}
+		s.read++
+		if keep || n == 0 {
+			s.skim = append(s.skim, n)
+		}
+		if n == 0 {
+			return nil
+		}
+		if keep {
+			if err := s.keep(int(n)); err != nil {
+				return err
+			}
+			continue
+		}
+		skipped, err := s.r.Discard(int(n))
+		s.read += int64(skipped)
+		if err == io.EOF {
+			return errTruncated
+		}
+		if err != nil {
+			return fmt.Errorf("reading gif: %w", err)
+		}
+	}
+}
+
+// skipSubBlocks returns the offset just past the chain of sub-blocks starting
+// at off.
+func skipSubBlocks(data []byte, off int) (int, error) {
+	for {
+		if off >= len(data) {
+			return 0, errTruncated
+		}
+		n := int(data[off])
+		off++
+		if n == 0 {
+			return off, nil
+		}
+		off += n
+	}
+}
+
+// subBlocks appends payload as a chain of sub-blocks, including the block
+// terminator.
+func subBlocks(dst, payload []byte) []byte {
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > 255 {
+			n = 255
+		}
+		dst = append(dst, byte(n))
+		dst = append(dst, payload[:n]...)
+		payload = payload[n:]
+	}
+	return append(dst, 0)
+}
+
+// readSubBlocks concatenates the payload of the sub-blocks starting at off.
+func readSubBlocks(data []byte, off int) []byte {
+	var payload []byte
+	for off < len(data) {
+		n := int(data[off])
+		off++
+		if n == 0 || off+n > len(data) {
+			break
+		}
+		payload = append(payload, data[off:off+n]...)
+		off += n
+	}
+	return payload
+}
+
+// setDelays rewrites the delay of every frame that has a graphic control
+// extension. Delays are applied to frames in order.
+func setDelays(data []byte, layout *gifLayout, delays []int) {
+	for ii, f := range layout.Frames {
+		if ii >= len(delays) {
+			return
+		}
+		if f.Control < 0 || data[f.Control+2] < 4 {
+			continue
+		}
+		d := delays[ii]
+		data[f.Control+4] = byte(d)
+		data[f.Control+5] = byte(d >> 8)
+	}
+}
@@ -0,0 +1,675 @@
+package giffer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GifDB is a GifStore in a directory.
+//
+// Each gif is described by a json file named by its key, which points at the
+// gif's content in the blobs directory. Content is named by its checksum, so
+// that gifs with the same bytes are stored once however many keys they are
+// stored under, and is removed once no key refers to it.
+//
+// The modification time of each json file records when the gif was last
+// looked up, so that the least recently used gifs can be evicted first.
+type GifDB struct {
+	Dir string
+	// MaxBytes bounds the total size of the gifs. Zero is unbounded.
+	MaxBytes int64
+	// MaxEntries bounds the number of gifs. Zero is unbounded.
+	MaxEntries int
+	// TTL is how long gifs are kept after they were created. Zero keeps
+	// them forever.
+	TTL time.Duration
+	// Log reports errors that don't fail the operation they happen in, such
+	// as failing to evict gifs after an insert. Nil uses the standard logger.
+	Log *log.Logger
+
+	init    sync.Once
+	initErr error
+	// mu keeps eviction and deletion from removing gifs while they are
+	// being read.
+	mu sync.RWMutex
+}
+
+// blobDir is the directory within the store that gif content is kept in.
+const blobDir = "blobs"
+
+// metadataSchema is the version of the metadata sidecar. Sidecars of earlier
+// versions are upgraded when the store is opened.
+//
+//	0: filename, provenance and source
+//	1: adds the render record
+//	2: adds the checksum of the gif
+//	3: gifs move from beside their sidecar into the blobs directory
+const metadataSchema = 3
+
+// metadata is the json encoded sidecar for each gif.
+type metadata struct {
+	Schema   int    `json:"schema"`
+	FileName string `json:"filename"`
+	// Checksum of the gif, see checksum, which names its blob.
+	Checksum string `json:"checksum"`
+	// Provenance is indexed from the gif so that entries can be traced back
+	// to their source without decoding the image.
+	Provenance *Provenance `json:"provenance,omitempty"`
+	// Source describes the video the gif was made from, and is what Search
+	// matches against.
+	Source SourceMetadata `json:"source"`
+	// Record describes how the gif was rendered.
+	Record *RenderRecord `json:"record,omitempty"`
+	Tags   []string      `json:"tags,omitempty"`
+}
+
+// newMetadata describes the gif, whose content has the checksum sum,
+// filling in what it was stored without. The content is left at the start.
+func newMetadata(img *RenderedGif, sum string) (metadata, error) {
+	md := metadata{
+		Schema:     metadataSchema,
+		FileName:   img.FileName,
+		Checksum:   sum,
+		Provenance: img.Provenance,
+		Source:     img.Metadata,
+		Record:     img.Record,
+		Tags:       img.Tags,
+	}
+	if md.Provenance == nil {
+		md.Provenance = readProvenance(img.Content)
+	}
+	if md.Record == nil {
+		md.Record = recordProvenance(img.Content, md.Provenance, time.Now())
+	}
+	_, err := img.Content.Seek(0, io.SeekStart)
+	return md, err
+}
+
+// rendered returns the gif that the metadata describes, with its content.
+func (md metadata) rendered(content io.ReadSeekCloser, size int64) *RenderedGif {
+	return &RenderedGif{
+		Content:    content,
+		Size:       size,
+		FileName:   md.FileName,
+		Provenance: md.Provenance,
+		Metadata:   md.Source,
+		Record:     md.Record,
+		Tags:       md.Tags,
+	}
+}
+
+// entry describes the gif that the metadata describes, as stored under key.
+func (md metadata) entry(key string) StoreEntry {
+	return StoreEntry{
+		Key:        key,
+		FileName:   md.FileName,
+		Created:    md.Record.Created,
+		Size:       md.Record.Size,
+		Checksum:   md.Checksum,
+		Provenance: md.Provenance,
+		Metadata:   md.Source,
+		Record:     md.Record,
+		Tags:       md.Tags,
+	}
+}
+
+// Lookup opens the rendered gif on disk, once its checksum is verified.
+// Windows won't remove a gif whose content is open, so gifs should be
+// closed promptly to let them be evicted.
+func (db *GifDB) Lookup(key string) (*RenderedGif, bool, error) {
+	if err := db.open(); err != nil {
+		return nil, false, err
+	}
+	if err := checkKey(key); err != nil {
+		return nil, false, err
+	}
+	db.mu.RLock()
+	img, ok, err := db.lookup(key, db.readMetadata)
+	db.mu.RUnlock()
+	if err == errStale {
+		// Written by an earlier version since the store was opened.
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return db.lookup(key, db.metadata)
+	}
+	return img, ok, err
+}
+
+// lookup opens the gif stored under key, reading its sidecar with read.
+func (db *GifDB) lookup(key string, read func(key string) (metadata, error)) (*RenderedGif, bool, error) {
+	md, err := read(key)
+	if err == errStale {
+		return nil, false, err
+	}
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	f, err := os.Open(db.blob(md.Checksum))
+	if os.IsNotExist(err) {
+		// Removed by another process since the metadata was read.
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, "opening gif file")
+	}
+	sum, size, err := hashContent(f)
+	if err != nil {
+		f.Close()
+		return nil, false, errors.Wrap(err, "reading gif file")
+	}
+	if sum != md.Checksum {
+		// A damaged gif is as good as none, so it will be made again and
+		// replaced. Check finds and quarantines them.
+		f.Close()
+		return nil, false, nil
+	}
+	now := time.Now()
+	// Not a problem if the use can't be recorded, the gif just looks less
+	// recently used than it is.
+	_ = os.Chtimes(db.sidecar(key), now, now)
+	return md.rendered(f, size), true, nil
+}
+
+// Insert stores the rendered gif on disk. Content already stored under
+// another key is shared rather than written again.
+func (db *GifDB) Insert(key string, img *RenderedGif) error {
+	if err := db.open(); err != nil {
+		return err
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	sum, _, err := hashContent(img.Content)
+	if err != nil {
+		return errors.Wrap(err, "reading gif")
+	}
+	described, err := newMetadata(img, sum)
+	if err != nil {
+		return errors.Wrap(err, "reading gif")
+	}
+	md, err := json.Marshal(described)
+	if err != nil {
+		return errors.Wrap(err, "encoding metadata")
+	}
+	// The content a replaced gif had is released once the new content is in
+	// place.
+	prev, err := db.metadata(key)
+	if err != nil {
+		prev = metadata{}
+	}
+	// Each file is written aside and renamed into place, so a crash never
+	// leaves one half written. The metadata goes last since it is what makes
+	// the gif visible, and its checksum catches a gif replaced without it.
+	blob := db.blob(sum)
+	if existing, _, err := fileChecksum(blob); err != nil || existing != sum {
+		if err := copyFileAtomic(blob, img.Content); err != nil {
+			return errors.Wrap(err, "persisting gif to disk")
+		}
+	}
+	if err := writeFileAtomic(db.sidecar(key), md); err != nil {
+		return errors.Wrap(err, "writing metadata file")
+	}
+	if prev.Checksum != "" && prev.Checksum != sum {
+		refs, err := db.references()
+		if err != nil {
+			return errors.Wrap(err, "counting references")
+		}
+		if refs[prev.Checksum] == 0 {
+			if err := os.Remove(db.blob(prev.Checksum)); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, "removing replaced gif")
+			}
+		}
+	}
+	// The gif is stored either way, and whatever couldn't be evicted is
+	// tried again by the next insert.
+	if _, err := db.evict(key); err != nil {
+		db.logf("evicting gifs from %s: %v", db.Dir, err)
+	}
+	return nil
+}
+
+// Delete removes the gif's metadata, and its content unless another key
+// refers to it.
+func (db *GifDB) Delete(key string) error {
+	if err := db.open(); err != nil {
+		return err
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	refs, err := db.references()
+	if err != nil {
+		return errors.Wrap(err, "counting references")
+	}
+	_, err = db.remove(key, refs)
+	return err
+}
+
+// remove deletes the metadata of the gif, and its blob once refs counts no
+// other references to it. The metadata goes first, since that is what makes
+// the gif visible. Returns the number of bytes freed.
+func (db *GifDB) remove(key string, refs map[string]int) (int64, error) {
+	md, err := db.metadata(key)
+	if os.IsNotExist(errors.Cause(err)) {
+		return 0, nil
+	}
+	if rmerr := os.Remove(db.sidecar(key)); rmerr != nil && !os.IsNotExist(rmerr) {
+		return 0, rmerr
+	}
+	if err != nil {
+		// Undecodable metadata points at no blob.
+		return 0, nil
+	}
+	if refs[md.Checksum]--; refs[md.Checksum] > 0 {
+		return 0, nil
+	}
+	blob := db.blob(md.Checksum)
+	info, err := os.Stat(blob)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Remove(blob); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// references counts the keys referring to each blob, by checksum.
+func (db *GifDB) references() (map[string]int, error) {
+	keys, err := db.keys()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]int)
+	for _, key := range keys {
+		// Unreadable metadata refers to nothing, see Check.
+		if md, err := db.metadata(key); err == nil {
+			refs[md.Checksum]++
+		}
+	}
+	return refs, nil
+}
+
+// Keys lists the keys of the stored gifs, found by their metadata files.
+func (db *GifDB) Keys() ([]string, error) {
+	if err := db.open(); err != nil {
+		return nil, err
+	}
+	return db.keys()
+}
+
+func (db *GifDB) keys() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(db.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(matches))
+	for _, m := range matches {
+		keys = append(keys, strings.TrimSuffix(filepath.Base(m), ".json"))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// List reads the metadata of every gif.
+func (db *GifDB) List(opts ListOptions) ([]StoreEntry, error) {
+	if err := db.open(); err != nil {
+		return nil, err
+	}
+	db.mu.RLock()
+	entries, err := db.list(db.readMetadata)
+	db.mu.RUnlock()
+	if err == errStale {
+		db.mu.Lock()
+		entries, err = db.list(db.metadata)
+		db.mu.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return opts.Page(entries), nil
+}
+
+// list describes every gif, reading their sidecars with read.
+func (db *GifDB) list(read func(key string) (metadata, error)) ([]StoreEntry, error) {
+	keys, err := db.keys()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]StoreEntry, 0, len(keys))
+	for _, key := range keys {
+		md, err := read(key)
+		if err == errStale {
+			return nil, err
+		}
+		if err != nil {
+			// Deleted since the directory was scanned, or unreadable, which
+			// Check finds.
+			continue
+		}
+		info, err := os.Stat(db.sidecar(key))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		e := md.entry(key)
+		e.LastUsed = info.ModTime()
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Evict removes the gifs that have outlived the TTL, then the least recently
+// used gifs until the store fits within MaxEntries and MaxBytes. Gifs are
+// also evicted as they're inserted. Content shared by several gifs counts
+// towards MaxBytes once, and is only freed with the last of them.
+func (db *GifDB) Evict() (*EvictionReport, error) {
+	if err := db.open(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.evict("")
+}
+
+// evict removes gifs, other than keep, until the store fits.
+func (db *GifDB) evict(keep string) (*EvictionReport, error) {
+	report := &EvictionReport{}
+	if db.MaxBytes <= 0 && db.MaxEntries <= 0 && db.TTL <= 0 {
+		return report, nil
+	}
+	entries, err := db.list(db.metadata)
+	if err != nil {
+		return nil, err
+	}
+	// Most recently used first, so that eviction works back from the end.
+	sort.Slice(entries, func(ii, jj int) bool {
+		return entries[ii].LastUsed.After(entries[jj].LastUsed)
+	})
+	var (
+		expired = time.Now().Add(-db.TTL)
+		kept    = entries[:0]
+		refs    = make(map[string]int)
+	)
+	for _, e := range entries {
+		if refs[e.Checksum]++; refs[e.Checksum] == 1 {
+			report.RemainingBytes += e.Size
+		}
+	}
+	remove := func(e StoreEntry, reason string) error {
+		freed, err := db.remove(e.Key, refs)
+		if err != nil {
+			return err
+		}
+		report.Evicted = append(report.Evicted, Eviction{StoreEntry: e, Reason: reason})
+		report.Bytes += freed
+		report.RemainingBytes -= freed
+		return nil
+	}
+	for _, e := range entries {
+		if db.TTL > 0 && e.Key != keep && e.Created.Before(expired) {
+			if err := remove(e, EvictedExpired); err != nil {
+				return report, err
+			}
+			continue
+		}
+		kept = append(kept, e)
+	}
+	count := len(kept)
+	for ii := len(kept) - 1; ii >= 0; ii-- {
+		var (
+			e      = kept[ii]
+			reason string
+		)
+		switch {
+		case e.Key == keep:
+			continue
+		case db.MaxEntries > 0 && count > db.MaxEntries:
+			reason = EvictedCount
+		case db.MaxBytes > 0 && report.RemainingBytes > db.MaxBytes:
+			reason = EvictedSize
+		default:
+			continue
+		}
+		if err := remove(e, reason); err != nil {
+			return report, err
+		}
+		count--
+	}
+	report.Remaining = len(entries) - len(report.Evicted)
+	return report, nil
+}
+
+// open prepares the store directory, upgrading a store written by an earlier
+// version, the first time the store is used.
+func (db *GifDB) open() error {
+	db.init.Do(func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if err := os.MkdirAll(filepath.Join(db.Dir, blobDir), 0755); err != nil {
+			db.initErr = errors.Wrap(err, "initialising")
+			return
+		}
+		if err := db.migrate(); err != nil {
+			db.initErr = errors.Wrap(err, "upgrading store")
+		}
+	})
+	return db.initErr
+}
+
+// migrate upgrades the sidecars written by earlier versions. Entries that
+// can't be upgraded are left for Check to find.
+func (db *GifDB) migrate() error {
+	keys, err := db.keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		var md metadata
+		raw, err := ioutil.ReadFile(db.sidecar(key))
+		if err != nil || json.Unmarshal(raw, &md) != nil || md.Schema >= metadataSchema {
+			continue
+		}
+		if err := db.upgrade(key, &md); err != nil {
+			continue
+		}
+		if err := db.writeMetadata(key, md); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errStale is returned when reading a sidecar written by an earlier version
+// since the store was opened. Upgrading it moves files about, which readers
+// sharing the lock would race to do, so it needs the lock for writing.
+var errStale = errors.New("metadata needs upgrading")
+
+// readMetadata reads the sidecar of the gif stored under key, or returns
+// errStale if it has to be upgraded first. It only reads, so it can be used
+// with the store locked for reading.
+func (db *GifDB) readMetadata(key string) (metadata, error) {
+	var md metadata
+	data, err := ioutil.ReadFile(db.sidecar(key))
+	if err != nil {
+		return md, errors.Wrap(err, "reading metadata file")
+	}
+	if err := json.Unmarshal(data, &md); err != nil {
+		return md, errors.Wrapf(err, "decoding metadata for %s", key)
+	}
+	if md.Schema < metadataSchema || md.Record == nil || md.Checksum == "" {
+		return md, errStale
+	}
+	return md, nil
+}
+
+// metadata reads the sidecar of the gif stored under key, upgrading it to
+// the current schema if it was written by an earlier version since the store
+// was opened. The store must be locked for writing.
+func (db *GifDB) metadata(key string) (metadata, error) {
+	md, err := db.readMetadata(key)
+	if err != errStale {
+		return md, err
+	}
+	if err := db.upgrade(key, &md); err != nil {
+		return md, errors.Wrapf(err, "upgrading metadata for %s", key)
+	}
+	// The upgrade is kept in memory if it can't be written, and tried again
+	// next time.
+	_ = db.writeMetadata(key, md)
+	return md, nil
+}
+
+// upgrade migrates the sidecar to the current schema.
+func (db *GifDB) upgrade(key string, md *metadata) error {
+	var (
+		img  = db.blob(md.Checksum)
+		info os.FileInfo
+		err  error
+	)
+	if md.Schema < 3 || md.Checksum == "" {
+		// Gifs used to be kept beside their sidecar.
+		img = filepath.Join(db.Dir, key+".gif")
+	}
+	if info, err = os.Stat(img); err != nil {
+		return err
+	}
+	f, err := os.Open(img)
+	if err != nil {
+		return errors.Wrap(err, "reading gif file")
+	}
+	defer f.Close()
+	if md.Record == nil {
+		// Sidecars without a record date from before renders were
+		// recorded, so all there is to go on is the gif itself. Its
+		// modification time stands in for when it was created.
+		if md.Provenance == nil {
+			md.Provenance = readProvenance(f)
+		}
+		md.Record = recordProvenance(f, md.Provenance, info.ModTime())
+	}
+	if md.Checksum == "" {
+		// The gif is trusted as it is, so long as it is a whole one.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrap(err, "reading gif file")
+		}
+		if _, err := Inspect(f); err != nil {
+			return errors.Wrap(err, "scanning gif")
+		}
+	}
+	sum, _, err := hashContent(f)
+	if err != nil {
+		return errors.Wrap(err, "reading gif file")
+	}
+	if md.Checksum == "" {
+		md.Checksum = sum
+	}
+	if sum != md.Checksum {
+		return fmt.Errorf("gif content is %s, recorded %s", sum, md.Checksum)
+	}
+	// Windows won't move an open file.
+	f.Close()
+	if img != db.blob(md.Checksum) {
+		if _, err := os.Stat(db.blob(md.Checksum)); err == nil {
+			// Another gif has the same content.
+			if err := os.Remove(img); err != nil {
+				return err
+			}
+		} else if err := os.Rename(img, db.blob(md.Checksum)); err != nil {
+			return errors.Wrap(err, "moving gif into blobs")
+		}
+	}
+	md.Schema = metadataSchema
+	return nil
+}
+
+// writeMetadata replaces the sidecar of the gif stored under key with an
+// upgraded one. The sidecar keeps its modification time, since upgrading a
+// gif mustn't make it look used.
+func (db *GifDB) writeMetadata(key string, md metadata) error {
+	info, err := os.Stat(db.sidecar(key))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(md)
+	if err != nil {
+		return errors.Wrap(err, "encoding metadata")
+	}
+	if err := writeFileAtomic(db.sidecar(key), data); err != nil {
+		return err
+	}
+	return os.Chtimes(db.sidecar(key), info.ModTime(), info.ModTime())
+}
+
+func (db *GifDB) logf(f string, v ...interface{}) {
+	if db.Log == nil {
+		log.Printf(f, v...)
+		return
+	}
+	db.Log.Printf(f, v...)
+}
+
+// sidecar is the path of the metadata of the gif stored under key.
+func (db *GifDB) sidecar(key string) string {
+	return filepath.Join(db.Dir, key+".json")
+}
+
+// blob is the path of the gif content with the checksum.
+func (db *GifDB) blob(sum string) string {
+	return filepath.Join(db.Dir, blobDir, strings.TrimPrefix(sum, "sha256:")+".gif")
+}
+
+// checksum identifies the content of a gif.
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// fileChecksum reads the checksum and size of the file at path.
+func fileChecksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	return hashContent(f)
+}
+
+// readProvenance reads the provenance embedded in the gif, if it can, from
+// the start of the content. The content is left at the start.
+func readProvenance(r io.ReadSeeker) *Provenance {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+	// Not a problem if the gif can't be scanned, it just won't be indexed.
+	info, err := Inspect(r)
+	if _, seekErr := r.Seek(0, io.SeekStart); err != nil || seekErr != nil {
+		return nil
+	}
+	return info.Provenance
+}
@@ -0,0 +1,257 @@
+package giffer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Kinds of problem found by Check.
+const (
+	// ProblemOrphan is a gif without metadata, or metadata without a gif.
+	ProblemOrphan = "orphan"
+	// ProblemMetadata is metadata that can't be decoded.
+	ProblemMetadata = "metadata"
+	// ProblemTruncated is a gif shorter than recorded, or cut short.
+	ProblemTruncated = "truncated"
+	// ProblemChecksum is a gif whose content doesn't match its checksum.
+	ProblemChecksum = "checksum"
+	// ProblemTemp is a file left behind by an interrupted write.
+	ProblemTemp = "temp"
+)
+
+// quarantineDir is where Check sets aside the files of damaged gifs, within
+// the store directory.
+const quarantineDir = "quarantine"
+
+// staleTemp is how old a temporary file must be before Check considers the
+// write it belonged to abandoned, rather than in progress in another process.
+const staleTemp = time.Minute
+
+// Problem is something wrong with a stored gif.
+type Problem struct {
+	Key    string
+	Kind   string
+	Detail string
+	// Files involved, relative to the store directory.
+	Files []string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s: %s", p.Key, p.Kind, p.Detail)
+}
+
+// CheckReport lists the problems found by Check.
+type CheckReport struct {
+	// Checked is the number of gifs checked.
+	Checked  int
+	Problems []Problem
+	// Repaired reports whether the problems were set aside.
+	Repaired bool
+}
+
+func (r *CheckReport) String() string {
+	action := "found"
+	if r.Repaired {
+		action = "repaired"
+	}
+	return fmt.Sprintf("checked %d gifs, %s %d problems", r.Checked, action, len(r.Problems))
+}
+
+// Check looks for damaged gifs: files orphaned by an interrupted insert or
+// delete, undecodable metadata, and gifs that are truncated or don't match
+// their checksum. If repair is set, the files of damaged gifs are moved into
+// the quarantine directory, where they no longer count as stored, and files
+// abandoned by interrupted writes are removed.
+func (db *GifDB) Check(repair bool) (*CheckReport, error) {
+	if err := db.open(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	report := &CheckReport{Repaired: repair}
+	files, err := ioutil.ReadDir(db.Dir)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := ioutil.ReadDir(filepath.Join(db.Dir, blobDir))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		keys []string
+		// referenced blobs, by file name.
+		referenced = make(map[string]bool)
+		// verdicts on blobs already checked, by checksum.
+		verdicts = make(map[string]*Problem)
+	)
+	for _, f := range files {
+		name := f.Name()
+		switch {
+		case f.IsDir():
+		case strings.HasPrefix(name, ".tmp-"):
+			report.stale(name, f)
+		case strings.HasSuffix(name, ".json"):
+			keys = append(keys, strings.TrimSuffix(name, ".json"))
+		case strings.HasSuffix(name, ".gif"):
+			// Left from before blobs, without metadata to upgrade it.
+			report.Problems = append(report.Problems, Problem{
+				Key:    strings.TrimSuffix(name, ".gif"),
+				Kind:   ProblemOrphan,
+				Detail: "gif without metadata",
+				Files:  []string{name},
+			})
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		report.Checked++
+		p, err := db.check(key, referenced, verdicts)
+		if err != nil {
+			return report, errors.Wrapf(err, "checking %s", key)
+		}
+		if p != nil {
+			report.Problems = append(report.Problems, *p)
+		}
+	}
+	for _, f := range blobs {
+		name := f.Name()
+		switch {
+		case f.IsDir():
+		case strings.HasPrefix(name, ".tmp-"):
+			report.stale(filepath.Join(blobDir, name), f)
+		case !referenced[name]:
+			report.Problems = append(report.Problems, Problem{
+				Key:    strings.TrimSuffix(name, ".gif"),
+				Kind:   ProblemOrphan,
+				Detail: "gif that no metadata refers to",
+				Files:  []string{filepath.Join(blobDir, name)},
+			})
+		}
+	}
+	if !repair {
+		return report, nil
+	}
+	for _, p := range report.Problems {
+		if err := db.quarantine(p); err != nil {
+			return report, errors.Wrapf(err, "repairing %s", p.Key)
+		}
+	}
+	return report, nil
+}
+
+// stale reports the temporary file if it has been abandoned.
+func (r *CheckReport) stale(name string, f os.FileInfo) {
+	if time.Since(f.ModTime()) < staleTemp {
+		return
+	}
+	r.Problems = append(r.Problems, Problem{
+		Key:    filepath.Base(name),
+		Kind:   ProblemTemp,
+		Detail: "left by an interrupted write",
+		Files:  []string{name},
+	})
+}
+
+// check finds what is wrong with the gif stored under key, if anything,
+// marking its blob as referenced. Blobs shared by several gifs are checked
+// once, their verdict kept in verdicts.
+func (db *GifDB) check(key string, referenced map[string]bool, verdicts map[string]*Problem) (*Problem, error) {
+	metaName := key + ".json"
+	raw, err := ioutil.ReadFile(db.sidecar(key))
+	if err != nil {
+		return nil, err
+	}
+	var md metadata
+	if err := json.Unmarshal(raw, &md); err != nil {
+		return &Problem{Key: key, Kind: ProblemMetadata, Detail: err.Error(), Files: []string{metaName}}, nil
+	}
+	if md.Checksum == "" {
+		return &Problem{Key: key, Kind: ProblemMetadata, Detail: "no checksum", Files: []string{metaName}}, nil
+	}
+	blobName := filepath.Base(db.blob(md.Checksum))
+	referenced[blobName] = true
+	verdict, checked := verdicts[md.Checksum]
+	if !checked {
+		sum, size, err := fileChecksum(db.blob(md.Checksum))
+		switch {
+		case os.IsNotExist(err):
+			verdict = &Problem{Kind: ProblemOrphan, Detail: "metadata without gif"}
+		case err != nil:
+			return nil, err
+		case md.Record != nil && size < md.Record.Size:
+			verdict = &Problem{
+				Kind:   ProblemTruncated,
+				Detail: fmt.Sprintf("%d of %d bytes", size, md.Record.Size),
+			}
+		case sum != md.Checksum:
+			verdict = &Problem{
+				Kind:   ProblemChecksum,
+				Detail: fmt.Sprintf("content is %s, recorded %s", sum, md.Checksum),
+			}
+		}
+		verdicts[md.Checksum] = verdict
+	}
+	if verdict == nil {
+		return nil, nil
+	}
+	p := *verdict
+	p.Key = key
+	// The metadata comes first, as with remove, so that the gif stops being
+	// visible before its content is moved.
+	p.Files = []string{metaName}
+	if p.Kind != ProblemOrphan {
+		p.Files = append(p.Files, filepath.Join(blobDir, blobName))
+	}
+	return &p, nil
+}
+
+// quarantine sets aside the files of the problem, or removes them if they
+// were abandoned by a write. Blobs shared by several problems are moved with
+// the first.
+func (db *GifDB) quarantine(p Problem) error {
+	if p.Kind == ProblemTemp {
+		for _, name := range p.Files {
+			if err := os.Remove(filepath.Join(db.Dir, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	dir := filepath.Join(db.Dir, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, name := range p.Files {
+		err := os.Rename(filepath.Join(db.Dir, name), quarantinePath(dir, filepath.Base(name)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// quarantinePath picks a path in the quarantine directory dir for a file
+// named name. Files already set aside under the name, by an earlier check or
+// for another gif, are kept by numbering the name, eg "key.2.json".
+func quarantinePath(dir, name string) string {
+	var (
+		ext  = filepath.Ext(name)
+		stem = strings.TrimSuffix(name, ext)
+		path = filepath.Join(dir, name)
+	)
+	for ii := 2; ; ii++ {
+		// Other errors are left for the rename to report.
+		if _, err := os.Lstat(path); err != nil {
+			return path
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s.%d%s", stem, ii, ext))
+	}
+}
@@ -0,0 +1,323 @@
+package giffer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackmordaunt/giffer"
+	"github.com/jackmordaunt/giffer/giffertest"
+)
+
+// insert stores a synthetic gif of the given frames under key.
+func insert(t *testing.T, db *giffer.GifDB, key string, frames int) {
+	t.Helper()
+	data := giffertest.SyntheticGIF(frames, 10)
+	err := db.Insert(key, &giffer.RenderedGif{
+		Content:  giffer.BytesContent(data),
+		Size:     int64(len(data)),
+		FileName: key + ".gif",
+	})
+	if err != nil {
+		t.Fatalf("inserting %s: %v", key, err)
+	}
+}
+
+// keys returns the keys of the store.
+func keys(t *testing.T, db *giffer.GifDB) []string {
+	t.Helper()
+	keys, err := db.Keys()
+	if err != nil {
+		t.Fatalf("keys: %v", err)
+	}
+	return keys
+}
+
+func TestGifDBUpgradeKeepsLastUsed(t *testing.T) {
+	db := &giffer.GifDB{Dir: t.TempDir(), MaxEntries: 2}
+	insert(t, db, "new", 1)
+	// A gif written by an earlier version, after the store was opened.
+	var (
+		sidecar = filepath.Join(db.Dir, "old.json")
+		used    = time.Now().Add(-time.Hour).Truncate(time.Second)
+	)
+	if err := ioutil.WriteFile(filepath.Join(db.Dir, "old.gif"), giffertest.SyntheticGIF(2, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sidecar, []byte(`{"schema":0,"filename":"old.gif"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(sidecar, used, used); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := db.List(giffer.ListOptions{})
+	if err != nil {
+		t.Fatalf("listing: %v", err)
+	}
+	if len(entries) != 2 || entries[1].Key != "old" || entries[1].Record == nil {
+		t.Fatalf("listed %+v, want the old gif upgraded", entries)
+	}
+	if !entries[1].LastUsed.Equal(used) {
+		t.Errorf("old gif was last used %v, want %v", entries[1].LastUsed, used)
+	}
+	info, err := os.Stat(sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(used) {
+		t.Errorf("upgrading the sidecar changed its modification time to %v", info.ModTime())
+	}
+	// The old gif is still the least recently used, so it goes first.
+	insert(t, db, "newer", 3)
+	if got := keys(t, db); len(got) != 2 || got[0] != "new" || got[1] != "newer" {
+		t.Errorf("kept %v, want [new newer]", got)
+	}
+}
+
+func TestGifDBConcurrentUpgrade(t *testing.T) {
+	db := &giffer.GifDB{Dir: t.TempDir()}
+	insert(t, db, "new", 1)
+	// Gifs written by an earlier version, after the store was opened, are
+	// upgraded by whichever reader comes to them first.
+	old := []string{"old0", "old1", "old2", "old3"}
+	for ii, key := range old {
+		if err := ioutil.WriteFile(filepath.Join(db.Dir, key+".gif"), giffertest.SyntheticGIF(ii+2, 10), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(db.Dir, key+".json"), []byte(`{"schema":0,"filename":"`+key+`.gif"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, 16*(len(old)+1))
+	)
+	for ii := 0; ii < 16; ii++ {
+		for _, key := range old {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				img, ok, err := db.Lookup(key)
+				if err != nil || !ok {
+					errs <- fmt.Errorf("looking up %s: found %v: %v", key, ok, err)
+					return
+				}
+				img.Close()
+			}(key)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entries, err := db.List(giffer.ListOptions{})
+			if err != nil || len(entries) != len(old)+1 {
+				errs <- fmt.Errorf("listed %d gifs, want %d: %v", len(entries), len(old)+1, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for _, key := range old {
+		if _, err := os.Stat(filepath.Join(db.Dir, key+".gif")); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't moved into the blobs: %v", key, err)
+		}
+	}
+}
+
+func TestGifDBInsertIgnoresEvictionErrors(t *testing.T) {
+	var (
+		logged bytes.Buffer
+		db     = &giffer.GifDB{Dir: t.TempDir(), MaxEntries: 1, Log: log.New(&logged, "", 0)}
+	)
+	insert(t, db, "a", 1)
+	// A blob that can't be removed makes evicting a fail.
+	blobs, err := filepath.Glob(filepath.Join(db.Dir, "blobs", "*.gif"))
+	if err != nil || len(blobs) != 1 {
+		t.Fatalf("found blobs %v: %v", blobs, err)
+	}
+	if err := os.Remove(blobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(blobs[0], "stuck"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	insert(t, db, "b", 2)
+	if got := keys(t, db); len(got) != 1 || got[0] != "b" {
+		t.Errorf("kept %v, want [b]", got)
+	}
+	if !strings.Contains(logged.String(), "evicting gifs") {
+		t.Errorf("the eviction error wasn't logged: %q", logged.String())
+	}
+}
+
+func TestGifDBSkipsDamagedMetadata(t *testing.T) {
+	db := &giffer.GifDB{Dir: t.TempDir(), MaxEntries: 2}
+	insert(t, db, "a", 1)
+	insert(t, db, "b", 2)
+	if err := os.Truncate(filepath.Join(db.Dir, "a.json"), 10); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := db.List(giffer.ListOptions{})
+	if err != nil {
+		t.Fatalf("listing: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Key != "b" {
+		t.Errorf("listed %+v, want only b", entries)
+	}
+	insert(t, db, "c", 3)
+	insert(t, db, "d", 4)
+	// The damaged gif is left for Check, and doesn't count towards the
+	// limits.
+	if got := keys(t, db); len(got) != 3 || got[0] != "a" || got[1] != "c" || got[2] != "d" {
+		t.Errorf("kept %v, want [a c d]", got)
+	}
+	report, err := db.Check(false)
+	if err != nil {
+		t.Fatalf("checking: %v", err)
+	}
+	var found bool
+	for _, p := range report.Problems {
+		found = found || p.Key == "a" && p.Kind == giffer.ProblemMetadata
+	}
+	if !found {
+		t.Errorf("check found %v, want a's metadata", report.Problems)
+	}
+}
+
+// blob returns the path of the content of the gif stored under key.
+func blob(t *testing.T, db *giffer.GifDB, key string) string {
+	t.Helper()
+	raw, err := ioutil.ReadFile(filepath.Join(db.Dir, key+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var md struct {
+		Checksum string `json:"checksum"`
+	}
+	if err := json.Unmarshal(raw, &md); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(db.Dir, "blobs", strings.TrimPrefix(md.Checksum, "sha256:")+".gif")
+}
+
+func TestGifDBCheckRepair(t *testing.T) {
+	tests := []struct {
+		name string
+		kind string
+		// damage the gif stored under a, whose content is at blob.
+		damage func(db *giffer.GifDB, blob string) error
+		// metadata reports whether a's metadata is quarantined along with
+		// its content.
+		metadata bool
+	}{
+		{
+			name: "truncated",
+			kind: giffer.ProblemTruncated,
+			damage: func(db *giffer.GifDB, blob string) error {
+				info, err := os.Stat(blob)
+				if err != nil {
+					return err
+				}
+				return os.Truncate(blob, info.Size()/2)
+			},
+			metadata: true,
+		},
+		{
+			name: "checksum",
+			kind: giffer.ProblemChecksum,
+			damage: func(db *giffer.GifDB, blob string) error {
+				data, err := ioutil.ReadFile(blob)
+				if err != nil {
+					return err
+				}
+				data[len(data)/2] ^= 0xff
+				return ioutil.WriteFile(blob, data, 0644)
+			},
+			metadata: true,
+		},
+		{
+			name: "orphan",
+			kind: giffer.ProblemOrphan,
+			damage: func(db *giffer.GifDB, blob string) error {
+				return os.Remove(filepath.Join(db.Dir, "a.json"))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &giffer.GifDB{Dir: t.TempDir()}
+			insert(t, db, "a", 2)
+			insert(t, db, "b", 3)
+			damaged := blob(t, db, "a")
+			if err := tt.damage(db, damaged); err != nil {
+				t.Fatal(err)
+			}
+			report, err := db.Check(true)
+			if err != nil {
+				t.Fatalf("checking: %v", err)
+			}
+			if len(report.Problems) != 1 || report.Problems[0].Kind != tt.kind || !report.Repaired {
+				t.Fatalf("check reported %v, want one %s problem repaired", report, tt.kind)
+			}
+			quarantined := []string{filepath.Base(damaged)}
+			if tt.metadata {
+				quarantined = append(quarantined, "a.json")
+			}
+			for _, name := range quarantined {
+				if _, err := os.Stat(filepath.Join(db.Dir, "quarantine", name)); err != nil {
+					t.Errorf("%s wasn't quarantined: %v", name, err)
+				}
+			}
+			if _, err := os.Stat(damaged); !os.IsNotExist(err) {
+				t.Errorf("the damaged gif is still stored: %v", err)
+			}
+			if got := keys(t, db); len(got) != 1 || got[0] != "b" {
+				t.Errorf("kept %v, want [b]", got)
+			}
+			img, ok, err := db.Lookup("b")
+			if err != nil || !ok {
+				t.Fatalf("looking up b: found %v: %v", ok, err)
+			}
+			img.Close()
+			if report, err := db.Check(false); err != nil || len(report.Problems) > 0 {
+				t.Errorf("after repairing, check found %v: %v", report, err)
+			}
+		})
+	}
+}
+
+func TestGifDBCheckKeepsQuarantined(t *testing.T) {
+	db := &giffer.GifDB{Dir: t.TempDir()}
+	// The same gif is damaged the same way twice, and both times its files
+	// are set aside under the same names.
+	for ii := 0; ii < 2; ii++ {
+		insert(t, db, "a", 2)
+		if err := os.Truncate(blob(t, db, "a"), 10); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Check(true); err != nil {
+			t.Fatalf("checking: %v", err)
+		}
+	}
+	files, err := ioutil.ReadDir(filepath.Join(db.Dir, "quarantine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if len(names) != 4 {
+		t.Errorf("quarantined %v, want both damaged gifs and their metadata", names)
+	}
+}
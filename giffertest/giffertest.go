@@ -0,0 +1,221 @@
+// Package giffertest provides fake ffmpeg, ffprobe and convert executables for
+// exercising the giffer Engine without the real binaries.
+//
+// The fakes are built from Go with the local toolchain. Each invocation is
+// appended to a call log, recording the argv and stdin, and then behaves
+// according to a Script: writing scripted stdout, stderr and progress, exiting
+// with a scripted code, and writing a deterministic output file such as a tiny
+// synthetic gif.
+package giffertest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/jackmordaunt/giffer"
+)
+
+// Tools faked by the harness.
+var Tools = []string{"ffmpeg", "ffprobe", "convert"}
+
+// callLog is the name of the file that invocations are appended to.
+const callLog = "calls.jsonl"
+
+// Call records a single invocation of a fake tool.
+type Call struct {
+	Tool  string   `json:"tool"`
+	Args  []string `json:"args"`
+	Stdin []byte   `json:"stdin,omitempty"`
+	Dir   string   `json:"dir"`
+}
+
+// Output selects what a fake writes to its output file.
+type Output string
+
+const (
+	// OutputAuto writes content appropriate to the output file's extension:
+	// a synthetic gif for .gif, a png for .png, and a copy of the input
+	// otherwise.
+	OutputAuto Output = ""
+	// OutputNone leaves the output file alone.
+	OutputNone Output = "none"
+	// OutputEmpty creates an empty output file.
+	OutputEmpty Output = "empty"
+	// OutputTruncated writes the first half of a synthetic gif.
+	OutputTruncated Output = "truncated"
+)
+
+// Script describes how a fake behaves when invoked.
+type Script struct {
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+	// Progress lines are written to the target of -progress, in the
+	// key=value format that ffmpeg uses.
+	Progress []string `json:"progress,omitempty"`
+	ExitCode int      `json:"exit_code,omitempty"`
+	Output   Output   `json:"output,omitempty"`
+	// Frames in the synthetic gif, defaults to 2.
+	Frames int `json:"frames,omitempty"`
+	// Delay of each synthetic gif frame in hundredths of a second.
+	Delay int `json:"delay,omitempty"`
+	// RequireInput fails the call, as the real tools do, if its input file
+	// doesn't exist.
+	RequireInput bool `json:"require_input,omitempty"`
+}
+
+// Harness manages a directory of fake executables.
+type Harness struct {
+	// Dir contains the executables, their scripts and the call log.
+	Dir string
+}
+
+// New builds the fake executables into dir.
+// It must be run from within the giffer module so that the fakes can be built.
+func New(dir string) (*Harness, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("preparing directory: %w", err)
+	}
+	h := &Harness{Dir: dir}
+	bin := h.Path("fake")
+	build := exec.Command(
+		"go", "build",
+		"-o", bin,
+		"github.com/jackmordaunt/giffer/giffertest/internal/fakebin",
+	)
+	if out, err := build.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("building fake: %w: %s", err, out)
+	}
+	data, err := ioutil.ReadFile(bin)
+	if err != nil {
+		return nil, fmt.Errorf("reading fake: %w", err)
+	}
+	for _, tool := range Tools {
+		if err := ioutil.WriteFile(h.Path(tool), data, 0755); err != nil {
+			return nil, fmt.Errorf("installing %s: %w", tool, err)
+		}
+	}
+	return h, nil
+}
+
+// Path to the named fake tool.
+func (h *Harness) Path(tool string) string {
+	if runtime.GOOS == "windows" {
+		tool += ".exe"
+	}
+	return filepath.Join(h.Dir, tool)
+}
+
+// Engine returns an Engine that uses the fakes, with its temporary files in a
+// work directory inside the harness.
+func (h *Harness) Engine() *giffer.Engine {
+	return &giffer.Engine{
+		Dir:     filepath.Join(h.Dir, "work"),
+		FFmpeg:  h.Path("ffmpeg"),
+		FFprobe: h.Path("ffprobe"),
+		Convert: h.Path("convert"),
+	}
+}
+
+// Script sets the behaviour of the tool. Successive invocations take
+// successive scripts, with the last script repeating.
+func (h *Harness) Script(tool string, scripts ...Script) error {
+	data, err := json.Marshal(scripts)
+	if err != nil {
+		return fmt.Errorf("encoding script: %w", err)
+	}
+	return ioutil.WriteFile(ScriptPath(h.Dir, tool), data, 0644)
+}
+
+// Calls returns the recorded invocations in order.
+func (h *Harness) Calls() ([]Call, error) {
+	return ReadCalls(h.Dir)
+}
+
+// Reset clears the recorded invocations and scripts.
+func (h *Harness) Reset() error {
+	for _, tool := range Tools {
+		if err := os.Remove(ScriptPath(h.Dir, tool)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(h.Dir, callLog)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ScriptPath is where the script for tool lives in dir.
+func ScriptPath(dir, tool string) string {
+	return filepath.Join(dir, tool+".script.json")
+}
+
+// ReadCalls reads the call log in dir.
+func ReadCalls(dir string) ([]Call, error) {
+	f, err := os.Open(filepath.Join(dir, callLog))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var (
+		calls []Call
+		s     = bufio.NewScanner(f)
+	)
+	s.Buffer(nil, 1<<26)
+	for s.Scan() {
+		var c Call
+		if err := json.Unmarshal(s.Bytes(), &c); err != nil {
+			return nil, fmt.Errorf("decoding call: %w", err)
+		}
+		calls = append(calls, c)
+	}
+	return calls, s.Err()
+}
+
+// AppendCall appends an invocation to the call log in dir.
+func AppendCall(dir string, c Call) error {
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, callLog), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// SyntheticGIF renders a tiny deterministic animated gif.
+func SyntheticGIF(frames, delay int) []byte {
+	if frames <= 0 {
+		frames = 2
+	}
+	var (
+		pal = color.Palette{color.Black, color.White}
+		img = &gif.GIF{}
+		buf bytes.Buffer
+	)
+	for ii := 0; ii < frames; ii++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 2, 2), pal)
+		frame.SetColorIndex(ii%2, ii/2%2, 1)
+		img.Image = append(img.Image, frame)
+		img.Delay = append(img.Delay, delay)
+	}
+	// Encoding to a bytes.Buffer can't fail.
+	_ = gif.EncodeAll(&buf, img)
+	return buf.Bytes()
+}
@@ -0,0 +1,217 @@
+// Command fakebin stands in for ffmpeg, ffprobe and convert.
+// The tool it pretends to be is taken from the name it was invoked as, and its
+// behaviour from the script that sits beside it.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackmordaunt/giffer/giffertest"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "fakebin: %v\n", err)
+		os.Exit(127)
+	}
+}
+
+func run() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locating executable: %w", err)
+	}
+	var (
+		dir  = filepath.Dir(exe)
+		tool = strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+		args = os.Args[1:]
+	)
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("getting working directory: %w", err)
+	}
+	stdin, err := readStdin()
+	if err != nil {
+		return fmt.Errorf("reading stdin: %w", err)
+	}
+	calls, err := giffertest.ReadCalls(dir)
+	if err != nil {
+		return fmt.Errorf("reading call log: %w", err)
+	}
+	var n int
+	for _, c := range calls {
+		if c.Tool == tool {
+			n++
+		}
+	}
+	if err := giffertest.AppendCall(dir, giffertest.Call{
+		Tool:  tool,
+		Args:  args,
+		Stdin: stdin,
+		Dir:   wd,
+	}); err != nil {
+		return fmt.Errorf("recording call: %w", err)
+	}
+	script, err := loadScript(dir, tool, n)
+	if err != nil {
+		return err
+	}
+	if in := input(tool, args); script.RequireInput && in != "" {
+		if _, err := os.Stat(in); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: No such file or directory\n", in)
+			os.Exit(1)
+		}
+	}
+	io.WriteString(os.Stdout, script.Stdout)
+	io.WriteString(os.Stderr, script.Stderr)
+	if err := progress(args, script.Progress); err != nil {
+		return fmt.Errorf("writing progress: %w", err)
+	}
+	if out := output(tool, args); out != "" {
+		if err := write(out, input(tool, args), script); err != nil {
+			return fmt.Errorf("writing output: %w", err)
+		}
+	}
+	os.Exit(script.ExitCode)
+	return nil
+}
+
+// loadScript loads the nth script for tool. Missing scripts behave as the
+// zero Script.
+func loadScript(dir, tool string, n int) (giffertest.Script, error) {
+	var scripts []giffertest.Script
+	data, err := ioutil.ReadFile(giffertest.ScriptPath(dir, tool))
+	if os.IsNotExist(err) {
+		return giffertest.Script{}, nil
+	}
+	if err != nil {
+		return giffertest.Script{}, fmt.Errorf("reading script: %w", err)
+	}
+	if err := json.Unmarshal(data, &scripts); err != nil {
+		return giffertest.Script{}, fmt.Errorf("decoding script: %w", err)
+	}
+	if len(scripts) == 0 {
+		return giffertest.Script{}, nil
+	}
+	if n >= len(scripts) {
+		n = len(scripts) - 1
+	}
+	return scripts[n], nil
+}
+
+// readStdin reads stdin unless it is a terminal or the null device.
+func readStdin() ([]byte, error) {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice != 0 {
+		return nil, nil
+	}
+	return ioutil.ReadAll(os.Stdin)
+}
+
+// input returns the file the tool reads from.
+func input(tool string, args []string) string {
+	switch tool {
+	case "ffmpeg", "ffprobe":
+		for ii, arg := range args {
+			if arg == "-i" && ii+1 < len(args) {
+				return args[ii+1]
+			}
+		}
+		if tool == "ffprobe" && len(args) > 0 {
+			return args[len(args)-1]
+		}
+	case "convert":
+		if len(args) > 0 {
+			return args[0]
+		}
+	}
+	return ""
+}
+
+// output returns the file the tool writes to, if any.
+func output(tool string, args []string) string {
+	if tool == "ffprobe" || len(args) < 2 {
+		return ""
+	}
+	last := args[len(args)-1]
+	if strings.HasPrefix(last, "-") || args[len(args)-2] == "-i" {
+		return ""
+	}
+	return last
+}
+
+func write(path, in string, script giffertest.Script) error {
+	if script.ExitCode != 0 && script.Output == giffertest.OutputAuto {
+		return nil
+	}
+	var data []byte
+	switch script.Output {
+	case giffertest.OutputNone:
+		return nil
+	case giffertest.OutputEmpty:
+	case giffertest.OutputTruncated:
+		data = giffertest.SyntheticGIF(script.Frames, script.Delay)
+		data = data[:len(data)/2]
+	default:
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".gif":
+			data = giffertest.SyntheticGIF(script.Frames, script.Delay)
+		case ".png":
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+				return err
+			}
+			data = buf.Bytes()
+		default:
+			if in == path {
+				return nil
+			}
+			data, _ = ioutil.ReadFile(in)
+		}
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// progress writes the progress lines to the -progress target.
+func progress(args []string, lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	var target string
+	for ii, arg := range args {
+		if arg == "-progress" && ii+1 < len(args) {
+			target = args[ii+1]
+		}
+	}
+	var w io.Writer
+	switch target {
+	case "":
+		return nil
+	case "pipe:", "pipe:1", "-":
+		w = os.Stdout
+	case "pipe:2":
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(strings.TrimPrefix(target, "file:"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
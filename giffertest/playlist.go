@@ -0,0 +1,96 @@
+package giffertest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackmordaunt/giffer"
+	"github.com/jackmordaunt/giffer/y4m"
+)
+
+// PlaylistScheme is the URL scheme that fake playlists are addressed by, eg
+// "playlist://episodes".
+const PlaylistScheme = "playlist"
+
+// Playlist is a fake source of collections, for exercising batches without
+// a network. Entries are usually local files, see Clips.
+type Playlist struct {
+	// Lists maps names to their entries.
+	Lists map[string][]giffer.Entry
+	// Err, if not nil, fails every listing.
+	Err error
+}
+
+// List returns the entries of the named list.
+func (p *Playlist) List(ctx context.Context, url string) ([]giffer.Entry, error) {
+	if p.Err != nil {
+		return nil, p.Err
+	}
+	name := strings.TrimPrefix(url, PlaylistScheme+"://")
+	entries, ok := p.Lists[name]
+	if !ok {
+		return nil, fmt.Errorf("no playlist %q", name)
+	}
+	return entries, nil
+}
+
+// Resolve fails, since playlists aren't videos.
+func (p *Playlist) Resolve(ctx context.Context, req giffer.Request) (*giffer.Media, error) {
+	return nil, fmt.Errorf("%s is a playlist", req.URL)
+}
+
+// Fetch fails, since playlists aren't videos.
+func (p *Playlist) Fetch(ctx context.Context, m *giffer.Media, dst string) error {
+	return fmt.Errorf("%s is a playlist", m.URL)
+}
+
+// Registry routes playlist URLs to p and local paths to the file source.
+func (p *Playlist) Registry() *giffer.Registry {
+	r := giffer.NewRegistry()
+	r.RegisterScheme(PlaylistScheme, p)
+	r.RegisterScheme("file", giffer.FileSource{})
+	return r
+}
+
+// Clips writes n synthetic y4m clips, of the given duration at 10 fps, into
+// dir and returns them as entries titled "Episode 1" through "Episode n".
+// Each frame shows its number, so that the frames of a gif made from a clip
+// can be traced back to it.
+func Clips(dir string, n int, duration time.Duration) ([]giffer.Entry, error) {
+	const fps = 10
+	var (
+		h = y4m.Header{
+			Width:  32,
+			Height: 24,
+			Rate:   y4m.Ratio{Num: fps, Den: 1},
+		}
+		frames  = int(duration.Seconds() * fps)
+		entries = make([]giffer.Entry, n)
+	)
+	for ii := range entries {
+		path := filepath.Join(dir, fmt.Sprintf("episode-%d.y4m", ii+1))
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		clip := y4m.Counter(y4m.Gradient(h.Width, h.Height, ii+1), 1)
+		if err := y4m.Generate(f, h, frames, clip); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("generating clip: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+		entries[ii] = giffer.Entry{
+			URL:      path,
+			ID:       "file:" + path,
+			Title:    fmt.Sprintf("Episode %d", ii+1),
+			Duration: duration,
+		}
+	}
+	return entries, nil
+}
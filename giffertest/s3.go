@@ -0,0 +1,167 @@
+package giffertest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// S3 is an in memory stand in for an S3 compatible object store, for
+// exercising giffer.S3Store offline. Serve it with httptest and point the
+// store's endpoint at it.
+//
+// It supports getting, putting and deleting objects, conditional puts with
+// If-Match and If-None-Match, and listing objects with ListObjectsV2. It
+// doesn't check signatures.
+type S3 struct {
+	// PageSize bounds the objects in a listing, defaults to 1000.
+	PageSize int
+
+	mu      sync.Mutex
+	objects map[string]s3Object
+}
+
+type s3Object struct {
+	data []byte
+	etag string
+}
+
+func (s *S3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.objects == nil {
+		s.objects = make(map[string]s3Object)
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.Contains(path, "/") {
+		if r.Method != http.MethodGet || r.URL.Query().Get("list-type") != "2" {
+			s3Fail(w, http.StatusNotImplemented, "NotImplemented", "only ListObjectsV2 is supported on buckets")
+			return
+		}
+		s.list(w, r, path)
+		return
+	}
+	obj, exists := s.objects[path]
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			s3Fail(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case http.MethodPut:
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || match != obj.etag) {
+			s3Fail(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			s3Fail(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s3Fail(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		sum := md5.Sum(data)
+		obj = s3Object{data: data, etag: `"` + hex.EncodeToString(sum[:]) + `"`}
+		s.objects[path] = obj
+		w.Header().Set("ETag", obj.etag)
+	case http.MethodDelete:
+		delete(s.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	}
+}
+
+// Objects lists the paths of the stored objects, bucket first, in order.
+func (s *S3) Objects() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths := make([]string, 0, len(s.objects))
+	for path := range s.objects {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// list answers a ListObjectsV2 request for the bucket.
+func (s *S3) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	var (
+		query  = r.URL.Query()
+		prefix = query.Get("prefix")
+		after  = query.Get("continuation-token")
+		limit  = s.PageSize
+		names  []string
+	)
+	if limit <= 0 {
+		limit = 1000
+	}
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+	for path := range s.objects {
+		name := strings.TrimPrefix(path, bucket+"/")
+		if name != path && strings.HasPrefix(name, prefix) && name > after {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	type content struct {
+		Key  string
+		ETag string
+		Size int
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}{
+		Name:    bucket,
+		Prefix:  prefix,
+		MaxKeys: limit,
+	}
+	if len(names) > limit {
+		names = names[:limit]
+		result.IsTruncated = true
+		result.NextContinuationToken = names[limit-1]
+	}
+	for _, name := range names {
+		obj := s.objects[bucket+"/"+name]
+		result.Contents = append(result.Contents, content{Key: name, ETag: obj.etag, Size: len(obj.data)})
+	}
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(result)
+}
+
+// s3Fail writes an error response in the form S3 does.
+func s3Fail(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
@@ -0,0 +1,194 @@
+package giffertest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"time"
+
+	"github.com/jackmordaunt/giffer"
+)
+
+// TestStore checks that s behaves as a GifStore should: gifs can be
+// inserted, looked up, replaced and deleted, and are listed in order of
+// creation. The store must start empty. It reports the first misbehaviour
+// found.
+func TestStore(s giffer.GifStore) error {
+	keys, err := s.Keys()
+	if err != nil {
+		return fmt.Errorf("keys: %w", err)
+	}
+	if len(keys) != 0 {
+		return fmt.Errorf("store is not empty: %v", keys)
+	}
+	if _, ok, err := s.Lookup("missing"); err != nil || ok {
+		return fmt.Errorf("lookup of missing key: found %v, error %v", ok, err)
+	}
+	// Keys sort in the order they're inserted, so that listings are ordered
+	// the same even when stores can't tell their creation times apart.
+	inserted := []string{"a", "b", "c"}
+	var (
+		gifs = make(map[string]*giffer.RenderedGif)
+		data = make(map[string][]byte)
+	)
+	for ii, key := range inserted {
+		data[key] = SyntheticGIF(ii+1, 10)
+		img := &giffer.RenderedGif{
+			Content:  giffer.BytesContent(data[key]),
+			Size:     int64(len(data[key])),
+			FileName: key + ".gif",
+			Metadata: giffer.SourceMetadata{Title: "Gif " + key},
+		}
+		if key != "a" {
+			// Stores record gifs inserted without a record themselves.
+			img.Record = giffer.NewRenderRecord(giffer.JobSpec{
+				Source: "https://example.com/" + key,
+				End:    float64(ii + 1),
+				FPS:    10,
+				Fuzz:   ii,
+			}, bytes.NewReader(data[key]), time.Second)
+		}
+		if err := s.Insert(key, img); err != nil {
+			return fmt.Errorf("inserting %s: %w", key, err)
+		}
+		gifs[key] = img
+	}
+	for key, want := range gifs {
+		if err := lookup(s, key, want, data[key]); err != nil {
+			return err
+		}
+	}
+	if keys, err = s.Keys(); err != nil {
+		return fmt.Errorf("keys: %w", err)
+	}
+	if !reflect.DeepEqual(keys, inserted) {
+		return fmt.Errorf("keys: got %v, want %v", keys, inserted)
+	}
+	for _, tt := range []struct {
+		opts giffer.ListOptions
+		want []string
+	}{
+		{giffer.ListOptions{}, []string{"a", "b", "c"}},
+		{giffer.ListOptions{NewestFirst: true}, []string{"c", "b", "a"}},
+		{giffer.ListOptions{Limit: 2}, []string{"a", "b"}},
+		{giffer.ListOptions{Offset: 1, Limit: 1}, []string{"b"}},
+		{giffer.ListOptions{Offset: 2, Limit: 5, NewestFirst: true}, []string{"a"}},
+		{giffer.ListOptions{Offset: 3}, nil},
+	} {
+		entries, err := s.List(tt.opts)
+		if err != nil {
+			return fmt.Errorf("list %+v: %w", tt.opts, err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Key)
+			want := gifs[e.Key]
+			if e.FileName != want.FileName || e.Metadata.Title != want.Metadata.Title {
+				return fmt.Errorf("list %+v: entry %s describes the wrong gif: %+v", tt.opts, e.Key, e)
+			}
+			if e.Size != want.Size {
+				return fmt.Errorf("list %+v: entry %s has size %d, want %d", tt.opts, e.Key, e.Size, want.Size)
+			}
+			if e.Created.IsZero() {
+				return fmt.Errorf("list %+v: entry %s has no creation time", tt.opts, e.Key)
+			}
+			if e.Record == nil || e.Record.Frames != int(e.Key[0]-'a')+1 {
+				return fmt.Errorf("list %+v: entry %s has the wrong record: %+v", tt.opts, e.Key, e.Record)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			return fmt.Errorf("list %+v: got %v, want %v", tt.opts, got, tt.want)
+		}
+	}
+	data["b2"] = SyntheticGIF(5, 10)
+	replacement := &giffer.RenderedGif{
+		Content:  giffer.BytesContent(data["b2"]),
+		Size:     int64(len(data["b2"])),
+		FileName: "b2.gif",
+	}
+	// Insert reads content from the start, wherever it was left.
+	if _, err := replacement.Content.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if err := s.Insert("b", replacement); err != nil {
+		return fmt.Errorf("replacing b: %w", err)
+	}
+	if err := lookup(s, "b", replacement, data["b2"]); err != nil {
+		return err
+	}
+	if err := s.Delete("a"); err != nil {
+		return fmt.Errorf("deleting a: %w", err)
+	}
+	if _, ok, err := s.Lookup("a"); err != nil || ok {
+		return fmt.Errorf("lookup of deleted key: found %v, error %v", ok, err)
+	}
+	if err := s.Delete("a"); err != nil {
+		return fmt.Errorf("deleting a twice: %w", err)
+	}
+	if keys, err = s.Keys(); err != nil {
+		return fmt.Errorf("keys: %w", err)
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(keys, want) {
+		return fmt.Errorf("keys after delete: got %v, want %v", keys, want)
+	}
+	entries, err := s.List(giffer.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+	if len(entries) != 2 {
+		return fmt.Errorf("list after delete: got %d entries, want 2", len(entries))
+	}
+	// Stores may share identical content between keys, but deleting one
+	// mustn't take the content from the other.
+	twin := &giffer.RenderedGif{
+		Content:  giffer.BytesContent(data["c"]),
+		Size:     int64(len(data["c"])),
+		FileName: "twin.gif",
+	}
+	if err := s.Insert("d", twin); err != nil {
+		return fmt.Errorf("inserting d: %w", err)
+	}
+	if err := s.Delete("c"); err != nil {
+		return fmt.Errorf("deleting c: %w", err)
+	}
+	if err := lookup(s, "d", twin, data["c"]); err != nil {
+		return fmt.Errorf("after deleting its twin: %w", err)
+	}
+	return nil
+}
+
+// lookup checks that the gif stored under key is want, with the content
+// data.
+func lookup(s giffer.GifStore, key string, want *giffer.RenderedGif, data []byte) error {
+	got, ok, err := s.Lookup(key)
+	if err != nil {
+		return fmt.Errorf("lookup %s: %w", key, err)
+	}
+	if !ok || got == nil {
+		return fmt.Errorf("lookup %s: not found", key)
+	}
+	defer got.Close()
+	content, err := ioutil.ReadAll(got.Content)
+	if err != nil {
+		return fmt.Errorf("lookup %s: reading content: %w", key, err)
+	}
+	if !bytes.Equal(content, data) || got.Size != int64(len(data)) {
+		return fmt.Errorf("lookup %s: content differs", key)
+	}
+	if got.FileName != want.FileName || got.Metadata.Title != want.Metadata.Title {
+		return fmt.Errorf("lookup %s: got %s %q, want %s %q", key,
+			got.FileName, got.Metadata.Title, want.FileName, want.Metadata.Title)
+	}
+	if got.Record == nil {
+		return fmt.Errorf("lookup %s: no record", key)
+	}
+	if want.Record != nil && (got.Record.Job != want.Record.Job ||
+		got.Record.Frames != want.Record.Frames ||
+		got.Record.RenderTime != want.Record.RenderTime ||
+		!got.Record.Created.Equal(want.Record.Created)) {
+		return fmt.Errorf("lookup %s: got record %+v, want %+v", key, got.Record, want.Record)
+	}
+	return nil
+}
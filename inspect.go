@@ -0,0 +1,195 @@
+package giffer
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"strings"
+	"time"
+)
+
+// GifInfo describes the structure of an encoded gif.
+// Useful for figuring out why a gif is as big as it is.
+type GifInfo struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Size of the gif in bytes.
+	Size int `json:"size"`
+	// Duration of one loop of the animation, as players play it. See
+	// DelayDuration.
+	Duration time.Duration `json:"duration"`
+	// LoopCount follows image/gif: -1 plays once, 0 loops forever, and n
+	// plays n+1 times.
+	LoopCount int `json:"loop_count"`
+	// GlobalPalette is the number of entries in the global color table.
+	GlobalPalette int `json:"global_palette"`
+	// Transparency is true if any frame uses a transparent color.
+	Transparency bool        `json:"transparency"`
+	Frames       []FrameInfo `json:"frames"`
+	// Provenance embedded in the gif, if any.
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+// FrameInfo describes a single frame of a gif.
+type FrameInfo struct {
+	// Delay in hundredths of a second.
+	Delay    int             `json:"delay"`
+	Disposal Disposal        `json:"disposal"`
+	Bounds   image.Rectangle `json:"bounds"`
+	// LocalPalette is the number of entries in the local color table, zero
+	// if the frame uses the global color table.
+	LocalPalette int  `json:"local_palette"`
+	Transparent  bool `json:"transparent"`
+	// Size of the frame in bytes, including its graphic control extension.
+	Size int `json:"size"`
+}
+
+// Disposal method of a frame, as per the image/gif Disposal constants.
+type Disposal byte
+
+func (d Disposal) String() string {
+	switch d {
+	case 0:
+		return "unspecified"
+	case gif.DisposalNone:
+		return "none"
+	case gif.DisposalBackground:
+		return "background"
+	case gif.DisposalPrevious:
+		return "previous"
+	default:
+		return fmt.Sprintf("reserved(%d)", byte(d))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Disposal) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// String summarises the gif in a single line.
+func (info *GifInfo) String() string {
+	var (
+		parts = []string{
+			fmt.Sprintf("%dx%d", info.Width, info.Height),
+			fmt.Sprintf("%d frames", len(info.Frames)),
+			fmt.Sprintf("%.2fs", info.Duration.Seconds()),
+			formatBytes(int64(info.Size)),
+		}
+		locals int
+	)
+	for _, f := range info.Frames {
+		if f.LocalPalette > 0 {
+			locals++
+		}
+	}
+	if locals > 0 {
+		parts = append(parts, fmt.Sprintf("%d local palettes", locals))
+	}
+	switch {
+	case info.LoopCount == 0:
+		parts = append(parts, "loops forever")
+	case info.LoopCount < 0:
+		parts = append(parts, "plays once")
+	default:
+		parts = append(parts, fmt.Sprintf("plays %d times", info.LoopCount+1))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Inspect reads a gif and reports its structure. Only the structure is kept
+// in memory, not the image data.
+func Inspect(r io.Reader) (*GifInfo, error) {
+	skim, sizes, total, err := skimGIF(r)
+	if err != nil {
+		return nil, err
+	}
+	info, err := InspectBytes(skim)
+	if err != nil {
+		return nil, err
+	}
+	info.Size = int(total)
+	for ii := range info.Frames {
+		info.Frames[ii].Size = sizes[ii]
+	}
+	return info, nil
+}
+
+// InspectBytes reports the structure of an encoded gif.
+func InspectBytes(data []byte) (*GifInfo, error) {
+	layout, err := scanGIF(data)
+	if err != nil {
+		return nil, err
+	}
+	info := &GifInfo{
+		Width:         int(data[6]) | int(data[7])<<8,
+		Height:        int(data[8]) | int(data[9])<<8,
+		Size:          len(data),
+		LoopCount:     -1,
+		GlobalPalette: layout.GlobalTable,
+		Frames:        make([]FrameInfo, len(layout.Frames)),
+	}
+	for _, ext := range layout.Extensions {
+		if loop, ok := netscapeLoop(data, ext); ok {
+			info.LoopCount = loop
+		}
+	}
+	for ii, f := range layout.Frames {
+		var (
+			d     = data[f.Descriptor:]
+			x, y  = int(d[1]) | int(d[2])<<8, int(d[3]) | int(d[4])<<8
+			w, h  = int(d[5]) | int(d[6])<<8, int(d[7]) | int(d[8])<<8
+			frame = FrameInfo{
+				Bounds:       image.Rect(x, y, x+w, y+h),
+				LocalPalette: f.LocalTable,
+				Size:         f.Size(),
+			}
+		)
+		if f.Control >= 0 && data[f.Control+2] >= 4 {
+			c := data[f.Control+3:]
+			frame.Disposal = Disposal((c[0] >> 2) & 0x07)
+			frame.Transparent = c[0]&0x01 != 0
+			frame.Delay = int(c[1]) | int(c[2])<<8
+		}
+		if frame.Transparent {
+			info.Transparency = true
+		}
+		info.Duration += DelayDuration(frame.Delay)
+		info.Frames[ii] = frame
+	}
+	// Provenance that can't be read, such as another tool's comment that
+	// looks like ours, is as good as none.
+	info.Provenance, _ = ReadProvenance(data)
+	return info, nil
+}
+
+// netscapeLoop reads the loop count from a NETSCAPE2.0 application extension.
+func netscapeLoop(data []byte, ext gifBlock) (int, bool) {
+	if ext.Label != gifAppLabel {
+		return 0, false
+	}
+	payload := readSubBlocks(data, ext.Offset+2)
+	if len(payload) < 14 ||
+		!(bytes.HasPrefix(payload, []byte("NETSCAPE2.0")) ||
+			bytes.HasPrefix(payload, []byte("ANIMEXTS1.0"))) ||
+		payload[11] != 0x01 {
+		return 0, false
+	}
+	return int(payload[12]) | int(payload[13])<<8, true
+}
+
+// formatBytes renders a byte count in human readable units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,211 @@
+package giffer_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackmordaunt/giffer"
+	"github.com/jackmordaunt/giffer/y4m"
+)
+
+// encodeGIF encodes frames of f as a gif with the given delays, one frame per
+// delay, onto the palette p.
+func encodeGIF(t *testing.T, f y4m.FrameFunc, p color.Palette, delays []int, loop int, disposal byte) []byte {
+	t.Helper()
+	g := &gif.GIF{LoopCount: loop}
+	for ii, d := range delays {
+		src := f(ii)
+		frame := image.NewPaletted(src.Bounds(), p)
+		draw.Draw(frame, frame.Bounds(), src, src.Bounds().Min, draw.Src)
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, d)
+		g.Disposal = append(g.Disposal, disposal)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// withComment inserts a comment extension before the gif's trailer.
+func withComment(data []byte, comment string) []byte {
+	out := append([]byte{}, data[:len(data)-1]...)
+	out = append(out, 0x21, 0xFE, byte(len(comment)))
+	out = append(out, comment...)
+	return append(out, 0x00, 0x3B)
+}
+
+func TestInspect(t *testing.T) {
+	var (
+		gradient    = y4m.Gradient(32, 16, 4)
+		transparent = color.Palette{color.Transparent, color.White, color.Black}
+		stamped, _  = giffer.EmbedProvenance(
+			encodeGIF(t, gradient, palette.Plan9, []int{4, 4}, 0, 0),
+			giffer.Provenance{Source: "video.mp4", End: 1},
+			giffer.ProvenanceComment,
+		)
+	)
+	tests := []struct {
+		name       string
+		gif        []byte
+		frames     int
+		duration   time.Duration
+		loop       int
+		disposal   giffer.Disposal
+		transp     bool
+		provenance *giffer.Provenance
+	}{
+		{
+			name:     "loops",
+			gif:      encodeGIF(t, gradient, palette.Plan9, []int{4, 4, 5, 4}, 0, gif.DisposalNone),
+			frames:   4,
+			duration: 170 * time.Millisecond,
+			loop:     0,
+			disposal: gif.DisposalNone,
+		},
+		{
+			name:     "plays once",
+			gif:      encodeGIF(t, gradient, palette.Plan9, []int{10, 10}, -1, 0),
+			frames:   2,
+			duration: 200 * time.Millisecond,
+			loop:     -1,
+		},
+		{
+			name:     "plays three times",
+			gif:      encodeGIF(t, gradient, palette.Plan9, []int{10, 10}, 2, gif.DisposalBackground),
+			frames:   2,
+			duration: 200 * time.Millisecond,
+			loop:     2,
+			disposal: gif.DisposalBackground,
+		},
+		{
+			// Players show delays of 1cs or less for 10cs.
+			name:     "short delays",
+			gif:      encodeGIF(t, gradient, palette.Plan9, []int{0, 1, 2}, 0, 0),
+			frames:   3,
+			duration: 220 * time.Millisecond,
+		},
+		{
+			name:     "transparent",
+			gif:      encodeGIF(t, y4m.Solid(32, 16, color.Transparent), transparent, []int{2, 2}, 0, gif.DisposalPrevious),
+			frames:   2,
+			duration: 40 * time.Millisecond,
+			disposal: gif.DisposalPrevious,
+			transp:   true,
+		},
+		{
+			name:       "provenance",
+			gif:        stamped,
+			frames:     2,
+			duration:   80 * time.Millisecond,
+			provenance: &giffer.Provenance{Source: "video.mp4", End: 1},
+		},
+		{
+			name:     "another tool's comment",
+			gif:      withComment(encodeGIF(t, gradient, palette.Plan9, []int{4, 4}, 0, 0), "giffer: made by another tool"),
+			frames:   2,
+			duration: 80 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := giffer.Inspect(bytes.NewReader(tt.gif))
+			if err != nil {
+				t.Fatalf("inspecting: %v", err)
+			}
+			if info.Width != 32 || info.Height != 16 {
+				t.Errorf("size %dx%d, want 32x16", info.Width, info.Height)
+			}
+			if info.Size != len(tt.gif) {
+				t.Errorf("size %d bytes, want %d", info.Size, len(tt.gif))
+			}
+			if len(info.Frames) != tt.frames {
+				t.Fatalf("%d frames, want %d", len(info.Frames), tt.frames)
+			}
+			if info.Duration != tt.duration {
+				t.Errorf("duration %v, want %v", info.Duration, tt.duration)
+			}
+			if info.LoopCount != tt.loop {
+				t.Errorf("loop count %d, want %d", info.LoopCount, tt.loop)
+			}
+			if info.Transparency != tt.transp {
+				t.Errorf("transparency %v, want %v", info.Transparency, tt.transp)
+			}
+			if !reflect.DeepEqual(info.Provenance, tt.provenance) {
+				t.Errorf("provenance %+v, want %+v", info.Provenance, tt.provenance)
+			}
+			var sizes int
+			for ii, f := range info.Frames {
+				if f.Disposal != tt.disposal {
+					t.Errorf("frame %d has disposal %v, want %v", ii, f.Disposal, tt.disposal)
+				}
+				if f.Bounds != image.Rect(0, 0, 32, 16) {
+					t.Errorf("frame %d has bounds %v", ii, f.Bounds)
+				}
+				sizes += f.Size
+			}
+			if sizes <= 0 || sizes >= info.Size {
+				t.Errorf("frames total %d bytes of %d", sizes, info.Size)
+			}
+			// Inspecting the bytes in memory agrees with streaming them.
+			mem, err := giffer.InspectBytes(tt.gif)
+			if err != nil {
+				t.Fatalf("inspecting bytes: %v", err)
+			}
+			if !reflect.DeepEqual(mem, info) {
+				t.Errorf("InspectBytes = %+v, want %+v", mem, info)
+			}
+		})
+	}
+}
+
+func TestInspectPalettes(t *testing.T) {
+	// Frames on a palette other than the global one carry their own.
+	var (
+		f     = y4m.Solid(8, 8, color.White)
+		first = image.NewPaletted(image.Rect(0, 0, 8, 8), palette.Plan9)
+		other = image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{color.White, color.Black})
+	)
+	draw.Draw(first, first.Bounds(), f(0), image.Point{}, draw.Src)
+	draw.Draw(other, other.Bounds(), f(1), image.Point{}, draw.Src)
+	g := &gif.GIF{
+		Image:  []*image.Paletted{first, other},
+		Delay:  []int{5, 5},
+		Config: image.Config{ColorModel: color.Palette(palette.Plan9), Width: 8, Height: 8},
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	info, err := giffer.InspectBytes(buf.Bytes())
+	if err != nil {
+		t.Fatalf("inspecting: %v", err)
+	}
+	if info.GlobalPalette != 256 {
+		t.Errorf("global palette has %d entries, want 256", info.GlobalPalette)
+	}
+	if info.Frames[0].LocalPalette != 0 || info.Frames[1].LocalPalette == 0 {
+		t.Errorf("local palettes %d and %d, want only the second", info.Frames[0].LocalPalette, info.Frames[1].LocalPalette)
+	}
+}
+
+func TestInspectErrors(t *testing.T) {
+	data := encodeGIF(t, y4m.Gradient(8, 8, 1), palette.Plan9, []int{4, 4}, 0, 0)
+	for name, bad := range map[string][]byte{
+		"empty":     nil,
+		"not a gif": []byte("PNG and other things"),
+		"truncated": data[:len(data)/2],
+	} {
+		if _, err := giffer.Inspect(bytes.NewReader(bad)); err == nil {
+			t.Errorf("inspecting %s succeeded", name)
+		}
+	}
+}
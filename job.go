@@ -0,0 +1,171 @@
+package giffer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+// jobSchema versions the canonical encoding of jobs. Changing the encoding
+// changes every key, so it must be bumped along with it.
+//
+//	1: source, range, rate, size, fuzz, palette and format
+//	2: adds the download format and drops the palette, which was never set
+const jobSchema = 2
+
+// EngineRevision is bumped whenever a change to the Engine changes the gifs
+// it makes from the same job, so that gifs made before aren't mistaken for
+// the new ones.
+const EngineRevision = 1
+
+// JobSpec describes a gif to render: the video it is made from, which part of
+// it and how.
+type JobSpec struct {
+	// Source is the URL or file of the video.
+	Source string `json:"source"`
+	// Start and End of the clip in seconds.
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	FPS   float64 `json:"fps"`
+	// Width and Height of the frames in pixels, 0 keeps the video's size and
+	// -1 or -2 keep its aspect ratio.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Fuzz is the crush level, see Engine.Crush.
+	Fuzz int `json:"fuzz"`
+	// Download overrides the format of the video that is downloaded, see
+	// Request.Format. Empty lets the source choose.
+	Download string `json:"download,omitempty"`
+	// Format of the output, "gif".
+	Format string `json:"format"`
+}
+
+// Canonical encodes the job such that jobs which make the same gif encode
+// the same, as one "name=value" line per field in order of name, after a
+// line naming the schema and engine revision. The source is canonicalised,
+// times and rates have millisecond precision, and defaults are filled in.
+//
+//	giffer-job/2 engine/1
+//	download=
+//	end=4.500
+//	format=gif
+//	fps=24.000
+//	fuzz=4
+//	height=0
+//	source=https://www.youtube.com/watch?v=dQw4w9WgXcQ
+//	start=1.000
+//	width=320
+func (j JobSpec) Canonical() string {
+	var (
+		b      strings.Builder
+		format = j.Format
+		fuzz   = j.Fuzz
+		width  = j.Width
+		height = j.Height
+	)
+	if format == "" {
+		format = "gif"
+	}
+	// Out of range values behave as the nearest in range, see Transcode and
+	// Crush.
+	if width < -2 {
+		width = -2
+	}
+	if height < -2 {
+		height = -2
+	}
+	if fuzz < 0 {
+		fuzz = 0
+	}
+	if fuzz > 100 {
+		fuzz = 100
+	}
+	fmt.Fprintf(&b, "giffer-job/%d engine/%d\n", jobSchema, EngineRevision)
+	for _, field := range [][2]string{
+		{"download", j.Download},
+		{"end", millis(j.End)},
+		{"format", strings.ToLower(format)},
+		{"fps", millis(j.FPS)},
+		{"fuzz", strconv.Itoa(fuzz)},
+		{"height", strconv.Itoa(height)},
+		{"source", CanonicalSource(j.Source)},
+		{"start", millis(j.Start)},
+		{"width", strconv.Itoa(width)},
+	} {
+		fmt.Fprintf(&b, "%s=%s\n", field[0], canonicalEscaper.Replace(field[1]))
+	}
+	return b.String()
+}
+
+// canonicalEscaper escapes newlines within values, which would otherwise let
+// one field pass for several.
+var canonicalEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// Key identifies the gif that the job makes: the hex encoded SHA-256 of its
+// canonical encoding, truncated to 128 bits.
+func (j JobSpec) Key() string {
+	sum := sha256.Sum256([]byte(j.Canonical()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// millis formats seconds with millisecond precision.
+func millis(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 3, 64)
+	if s == "-0.000" {
+		return "0.000"
+	}
+	return s
+}
+
+// CanonicalSource rewrites a video URL such that the variations of a link to
+// the same video are the same: timestamps are removed, see NormalizeURL,
+// schemes and hosts are lower case, default ports, fragments and the order of
+// query parameters are dropped, and YouTube links of every form become
+// watch URLs. Local paths are made absolute.
+func CanonicalSource(source string) string {
+	source = NormalizeURL(strings.TrimSpace(source))
+	u, err := url.Parse(source)
+	if err != nil {
+		return source
+	}
+	if isLocalPath(source, u) || strings.EqualFold(u.Scheme, "file") {
+		path := source
+		if !isLocalPath(source, u) {
+			path = filepath.FromSlash(u.Path)
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		return filepath.ToSlash(filepath.Clean(path))
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range youtubeHosts {
+		if host != h && !strings.HasSuffix(host, "."+h) {
+			continue
+		}
+		if id, err := youtube.ExtractVideoID(source); err == nil {
+			return "https://www.youtube.com/watch?v=" + id
+		}
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	switch port := u.Port(); {
+	case port == "", u.Scheme == "http" && port == "80", u.Scheme == "https" && port == "443":
+		u.Host = host
+	default:
+		u.Host = net.JoinHostPort(host, port)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawQuery = u.Query().Encode()
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
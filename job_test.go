@@ -0,0 +1,139 @@
+package giffer_test
+
+import (
+	"testing"
+
+	"github.com/jackmordaunt/giffer"
+)
+
+// The golden encodings and keys below identify gifs already stored. A change
+// that fails them must bump the job schema or engine revision.
+func TestJobCanonical(t *testing.T) {
+	tests := []struct {
+		name      string
+		job       giffer.JobSpec
+		canonical string
+		key       string
+	}{
+		{
+			"youtube",
+			giffer.JobSpec{Source: "https://youtu.be/dQw4w9WgXcQ?t=42", Start: 1, End: 4.5, FPS: 24, Width: 320, Fuzz: 4},
+			`giffer-job/2 engine/1
+download=
+end=4.500
+format=gif
+fps=24.000
+fuzz=4
+height=0
+source=https://www.youtube.com/watch?v=dQw4w9WgXcQ
+start=1.000
+width=320
+`,
+			"d1a79e423bf10ac1626d3e3ad588b953",
+		},
+		{
+			"out of range",
+			giffer.JobSpec{
+				Source:   "HTTPS://Example.com:443/v.mp4?b=2&a=1#frag",
+				End:      2,
+				FPS:      10,
+				Width:    -7,
+				Height:   -3,
+				Fuzz:     300,
+				Download: "720p",
+				Format:   "GIF",
+			},
+			`giffer-job/2 engine/1
+download=720p
+end=2.000
+format=gif
+fps=10.000
+fuzz=100
+height=-2
+source=https://example.com/v.mp4?a=1&b=2
+start=0.000
+width=-2
+`,
+			"896519dc57cac1f8642858f7a966d212",
+		},
+		{
+			"rounding and escapes",
+			giffer.JobSpec{Source: "https://example.com/v.mp4", Start: -0.0001, End: 1.23456, FPS: 12.5, Fuzz: -4, Download: "a\nb=c\\"},
+			`giffer-job/2 engine/1
+download=a\nb=c\\
+end=1.235
+format=gif
+fps=12.500
+fuzz=0
+height=0
+source=https://example.com/v.mp4
+start=0.000
+width=0
+`,
+			"671959e9c5a802d73432912b418f1931",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.job.Canonical(); got != tt.canonical {
+				t.Errorf("canonical encoding is\n%s\nwant\n%s", got, tt.canonical)
+			}
+			if got := tt.job.Key(); got != tt.key {
+				t.Errorf("key is %s, want %s", got, tt.key)
+			}
+		})
+	}
+}
+
+func TestJobKey(t *testing.T) {
+	base := giffer.JobSpec{Source: "https://www.youtube.com/watch?v=dQw4w9WgXcQ", Start: 1, End: 3, FPS: 24, Width: 320, Fuzz: 4}
+	same := []giffer.JobSpec{
+		{Source: "https://youtu.be/dQw4w9WgXcQ", Start: 1, End: 3, FPS: 24, Width: 320, Fuzz: 4},
+		{Source: "https://m.youtube.com/watch?v=dQw4w9WgXcQ&t=10s", Start: 1.0001, End: 3, FPS: 24, Width: 320, Fuzz: 4, Format: "gif"},
+		{Source: " https://www.youtube.com/embed/dQw4w9WgXcQ ", Start: 1, End: 2.9999, FPS: 24.0004, Width: 320, Fuzz: 4},
+	}
+	for _, j := range same {
+		if j.Key() != base.Key() {
+			t.Errorf("%+v has key %s, want %s the same as %+v", j, j.Key(), base.Key(), base)
+		}
+	}
+	different := []giffer.JobSpec{
+		{Source: "https://www.youtube.com/watch?v=aaaaaaaaaaa", Start: 1, End: 3, FPS: 24, Width: 320, Fuzz: 4},
+		{Source: base.Source, Start: 1.001, End: 3, FPS: 24, Width: 320, Fuzz: 4},
+		{Source: base.Source, Start: 1, End: 3, FPS: 25, Width: 320, Fuzz: 4},
+		{Source: base.Source, Start: 1, End: 3, FPS: 24, Width: 320, Height: -1, Fuzz: 4},
+		{Source: base.Source, Start: 1, End: 3, FPS: 24, Width: 320, Fuzz: 5},
+		{Source: base.Source, Start: 1, End: 3, FPS: 24, Width: 320, Fuzz: 4, Download: "18"},
+	}
+	seen := map[string]int{base.Key(): -1}
+	for ii, j := range different {
+		if prev, ok := seen[j.Key()]; ok {
+			t.Errorf("job %d has the same key as job %d: %+v", ii, prev, j)
+		}
+		seen[j.Key()] = ii
+	}
+	// A newline in a value can't pass for another field.
+	a := giffer.JobSpec{Source: base.Source, Download: "x\nsource=other"}
+	b := giffer.JobSpec{Source: base.Source, Download: `x\nsource=other`}
+	if a.Key() == b.Key() {
+		t.Errorf("a download format with a newline has the same key as one with an escaped newline")
+	}
+}
+
+func TestCanonicalSource(t *testing.T) {
+	for _, tt := range []struct {
+		source, want string
+	}{
+		{"https://youtu.be/dQw4w9WgXcQ?t=1m2s", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"https://www.youtube.com/shorts/dQw4w9WgXcQ", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"HTTP://Example.COM:80/a/b.mp4", "http://example.com/a/b.mp4"},
+		{"https://example.com:8443/v?z=1&a=2#t=3", "https://example.com:8443/v?a=2&z=1"},
+		{"https://example.com", "https://example.com/"},
+		{"/videos/../clip.mp4", "/clip.mp4"},
+		{"file:///videos/clip.mp4", "/videos/clip.mp4"},
+	} {
+		if got := giffer.CanonicalSource(tt.source); got != tt.want {
+			t.Errorf("CanonicalSource(%q) = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package giffer
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a GifStore in memory, for when gifs needn't outlive the
+// process. The zero value is ready to use.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryGif
+}
+
+// memoryGif is a gif in a MemoryStore, its content held apart from the
+// handle that serves it.
+type memoryGif struct {
+	RenderedGif
+	data []byte
+}
+
+// Lookup returns a copy of the gif stored under key.
+func (s *MemoryStore) Lookup(key string) (*RenderedGif, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	// The stored content is never modified, so it can be served as it is.
+	img := stored.RenderedGif
+	img.Content = BytesContent(stored.data)
+	record := *img.Record
+	img.Record = &record
+	return &img, true, nil
+}
+
+// Insert stores a copy of the gif under key.
+func (s *MemoryStore) Insert(key string, img *RenderedGif) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[string]memoryGif)
+	}
+	if _, err := img.Content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(img.Content)
+	if err != nil {
+		return err
+	}
+	stored := memoryGif{RenderedGif: *img, data: data}
+	stored.Content = nil
+	stored.Size = int64(len(data))
+	stored.Tags = append([]string(nil), img.Tags...)
+	if stored.Provenance == nil {
+		stored.Provenance = readProvenance(BytesContent(data))
+	}
+	if stored.Record == nil {
+		stored.Record = recordProvenance(BytesContent(data), stored.Provenance, time.Now())
+	} else {
+		record := *stored.Record
+		stored.Record = &record
+	}
+	s.entries[key] = stored
+	return nil
+}
+
+// Delete removes the gif stored under key.
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// Keys lists the keys of the stored gifs.
+func (s *MemoryStore) Keys() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// List describes the stored gifs.
+func (s *MemoryStore) List(opts ListOptions) ([]StoreEntry, error) {
+	s.mu.Lock()
+	entries := make([]StoreEntry, 0, len(s.entries))
+	for key, img := range s.entries {
+		entries = append(entries, StoreEntry{
+			Key:        key,
+			FileName:   img.FileName,
+			Created:    img.Record.Created,
+			Size:       img.Size,
+			Provenance: img.Provenance,
+			Metadata:   img.Metadata,
+			Record:     img.Record,
+			Tags:       img.Tags,
+		})
+	}
+	s.mu.Unlock()
+	return opts.Page(entries), nil
+}
@@ -0,0 +1,141 @@
+package giffer
+
+import (
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackmordaunt/giffer/y4m"
+	"github.com/pkg/errors"
+)
+
+// isY4M reports whether the video is a YUV4MPEG2 stream, which the Engine can
+// transcode natively.
+func isY4M(video string) bool {
+	return strings.EqualFold(filepath.Ext(video), ".y4m")
+}
+
+// transcodeY4M renders the Y4M stream into a gif without FFmpeg.
+// Frames are sampled at fps, scaled with nearest neighbour and dithered onto
+// the Plan9 palette.
+func (eng *Engine) transcodeY4M(
+	video, output string,
+	start, end float64,
+	width, height int,
+	fps float64,
+) error {
+	f, err := os.Open(video)
+	if err != nil {
+		return errors.Wrap(err, "opening video")
+	}
+	defer f.Close()
+	r, err := y4m.NewReader(f)
+	if err != nil {
+		return errors.Wrap(err, "reading y4m header")
+	}
+	var (
+		src    = r.Header.FPS()
+		bounds = image.Rect(0, 0, r.Header.Width, r.Header.Height)
+		size   = scaleSize(bounds.Size(), width, height)
+		img    = &gif.GIF{}
+	)
+	if src <= 0 {
+		return errors.Errorf("invalid frame rate %s", r.Header.Rate)
+	}
+	if fps <= 0 {
+		fps = src
+	}
+	for ii := 0; ; ii++ {
+		frame, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "reading frame %d", ii)
+		}
+		// Emit an output frame for every output timestamp that falls within
+		// this source frame, which drops or duplicates frames as needed.
+		var (
+			from = float64(ii) / src
+			to   = from + 1/src
+		)
+		if end > start && from >= end {
+			break
+		}
+		for {
+			next := start + float64(len(img.Image))/fps
+			if next >= to || (end > start && next >= end) {
+				break
+			}
+			img.Image = append(img.Image, quantize(frame, size))
+		}
+	}
+	if len(img.Image) == 0 {
+		return errors.New("no frames in range")
+	}
+	img.Delay = Delays(fps, len(img.Image))
+	out, err := os.Create(output)
+	if err != nil {
+		return errors.Wrap(err, "creating gif")
+	}
+	defer out.Close()
+	if err := gif.EncodeAll(out, img); err != nil {
+		return errors.Wrap(err, "encoding gif")
+	}
+	return out.Close()
+}
+
+// scaleSize resolves the requested dimensions the same way FFmpeg's scale
+// filter does: a non-positive dimension follows the aspect ratio of the
+// source, with -2 rounding to an even number.
+func scaleSize(src image.Point, width, height int) image.Point {
+	var (
+		w, h   = width, height
+		aspect = func(a, b, c int) int { return a * b / c }
+	)
+	switch {
+	case w <= 0 && h <= 0:
+		return src
+	case w <= 0:
+		w = aspect(h, src.X, src.Y)
+		if width == -2 {
+			w += w % 2
+		}
+	case h <= 0:
+		h = aspect(w, src.Y, src.X)
+		if height == -2 {
+			h += h % 2
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return image.Pt(w, h)
+}
+
+// quantize scales the frame to size and dithers it onto a fixed palette.
+func quantize(frame image.Image, size image.Point) *image.Paletted {
+	var (
+		b      = frame.Bounds()
+		scaled = image.NewRGBA(image.Rectangle{Max: size})
+		out    = image.NewPaletted(scaled.Bounds(), palette.Plan9)
+	)
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			scaled.Set(x, y, frame.At(
+				b.Min.X+x*b.Dx()/size.X,
+				b.Min.Y+y*b.Dy()/size.Y,
+			))
+		}
+	}
+	draw.FloydSteinberg.Draw(out, out.Bounds(), scaled, image.Point{})
+	return out
+}
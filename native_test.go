@@ -0,0 +1,128 @@
+package giffer_test
+
+import (
+	"image"
+	"image/color"
+	"image/color/palette"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jackmordaunt/giffer"
+	"github.com/jackmordaunt/giffer/y4m"
+)
+
+// writeY4M generates a y4m clip of count frames at 10fps.
+func writeY4M(t *testing.T, f y4m.FrameFunc, width, height, count int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "clip.y4m")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	h := y4m.Header{Width: width, Height: height, Rate: y4m.Ratio{Num: 10, Den: 1}, ColorSpace: "444"}
+	if err := y4m.Generate(out, h, count, f); err != nil {
+		t.Fatalf("generating: %v", err)
+	}
+	return path
+}
+
+func TestTranscodeY4M(t *testing.T) {
+	video := writeY4M(t, y4m.Counter(y4m.Gradient(32, 16, 3), 1), 32, 16, 20)
+	tests := []struct {
+		name          string
+		start, end    float64
+		width, height int
+		fps           float64
+		frames        int
+		size          image.Point
+		delay         int
+	}{
+		{"source rate", 0, 0, 0, 0, 0, 20, image.Pt(32, 16), 10},
+		{"half rate", 0, 0, 0, 0, 5, 10, image.Pt(32, 16), 20},
+		{"double rate", 0, 0, 0, 0, 20, 40, image.Pt(32, 16), 5},
+		{"range", 0.5, 1.5, 0, 0, 0, 10, image.Pt(32, 16), 10},
+		{"scaled by width", 0, 0, 16, -2, 0, 20, image.Pt(16, 8), 10},
+		{"scaled by height", 0, 0, -1, 4, 0, 20, image.Pt(8, 4), 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eng := &giffer.Engine{Dir: t.TempDir()}
+			defer eng.Clean()
+			gif, err := eng.Transcode(video, tt.start, tt.end, tt.width, tt.height, tt.fps)
+			if err != nil {
+				t.Fatalf("transcoding: %v", err)
+			}
+			img := decode(t, gif)
+			if len(img.Image) != tt.frames {
+				t.Errorf("got %d frames, want %d", len(img.Image), tt.frames)
+			}
+			for ii, frame := range img.Image {
+				if size := frame.Bounds().Size(); size != tt.size {
+					t.Fatalf("frame %d is %v, want %v", ii, size, tt.size)
+				}
+				if img.Delay[ii] != tt.delay {
+					t.Fatalf("frame %d has delay %d, want %d", ii, img.Delay[ii], tt.delay)
+				}
+			}
+		})
+	}
+	t.Run("empty range", func(t *testing.T) {
+		eng := &giffer.Engine{Dir: t.TempDir()}
+		defer eng.Clean()
+		if _, err := eng.Transcode(video, 5, 6, 0, 0, 0); err == nil {
+			t.Errorf("transcoding past the end succeeded")
+		}
+	})
+}
+
+func TestTranscodeY4MPalette(t *testing.T) {
+	// Dithering onto the palette keeps the average color of each frame.
+	colors := []color.Color{
+		color.RGBA{R: 0xff, A: 0xff},
+		color.RGBA{G: 0x80, B: 0x40, A: 0xff},
+		color.RGBA{R: 0x33, G: 0x66, B: 0x99, A: 0xff},
+		color.White,
+		color.Black,
+	}
+	var scenes []y4m.FrameFunc
+	for _, c := range colors {
+		scenes = append(scenes, y4m.Solid(8, 8, c))
+	}
+	video := writeY4M(t, y4m.SceneCuts(2, scenes...), 8, 8, 2*len(colors))
+	eng := &giffer.Engine{Dir: t.TempDir()}
+	defer eng.Clean()
+	gif, err := eng.Transcode(video, 0, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("transcoding: %v", err)
+	}
+	img := decode(t, gif)
+	if len(img.Image) != 2*len(colors) {
+		t.Fatalf("got %d frames, want %d", len(img.Image), 2*len(colors))
+	}
+	for ii, frame := range img.Image {
+		if !reflect.DeepEqual(frame.Palette, color.Palette(palette.Plan9)) {
+			t.Fatalf("frame %d isn't on the Plan9 palette", ii)
+		}
+		var (
+			sum  [3]int
+			want = color.RGBAModel.Convert(colors[ii/2]).(color.RGBA)
+		)
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				r, g, b, _ := frame.At(x, y).RGBA()
+				sum[0] += int(r >> 8)
+				sum[1] += int(g >> 8)
+				sum[2] += int(b >> 8)
+			}
+		}
+		for ch, w := range []uint8{want.R, want.G, want.B} {
+			if mean := sum[ch] / 64; mean < int(w)-8 || mean > int(w)+8 {
+				t.Errorf("frame %d has mean %v, want %v", ii, [3]int{sum[0] / 64, sum[1] / 64, sum[2] / 64}, want)
+				break
+			}
+		}
+	}
+}
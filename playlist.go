@@ -0,0 +1,79 @@
+package giffer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Lister is implemented by sources that can expand collections of videos,
+// such as playlists and channels, into their entries.
+type Lister interface {
+	// List returns the entries of the collection at url, in order, or nil if
+	// url refers to a single video.
+	List(ctx context.Context, url string) ([]Entry, error)
+}
+
+// Entry is a video within a collection.
+type Entry struct {
+	// URL of the video, which can be downloaded like any other.
+	URL   string
+	ID    string
+	Title string
+	// Duration of the video, 0 if unknown.
+	Duration time.Duration
+}
+
+// Filter selects entries from a collection.
+type Filter struct {
+	// Include, if not nil, keeps only entries with a matching title.
+	Include *regexp.Regexp
+	// Exclude, if not nil, drops entries with a matching title.
+	Exclude *regexp.Regexp
+	// Max is the maximum number of entries kept, 0 keeps them all.
+	Max int
+}
+
+// Apply returns the entries that pass the filter, in order.
+func (f Filter) Apply(entries []Entry) []Entry {
+	var kept []Entry
+	for _, e := range entries {
+		if f.Max > 0 && len(kept) >= f.Max {
+			break
+		}
+		if f.Include != nil && !f.Include.MatchString(e.Title) {
+			continue
+		}
+		if f.Exclude != nil && f.Exclude.MatchString(e.Title) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// Expand lists the videos that url refers to, applying the filter if url is
+// a collection. A url that refers to a single video, or whose source can't
+// list collections, expands to itself.
+func (dl Downloader) Expand(ctx context.Context, url string, f Filter) ([]Entry, error) {
+	src, err := dl.sources().Lookup(url)
+	if err != nil {
+		return nil, err
+	}
+	lister, ok := src.(Lister)
+	if !ok {
+		return []Entry{{URL: url}}, nil
+	}
+	var entries []Entry
+	if err := dl.retry(ctx, "listing", func() (err error) {
+		entries, err = lister.List(ctx, url)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("listing entries: %w", err)
+	}
+	if entries == nil {
+		return []Entry{{URL: url}}, nil
+	}
+	return f.Apply(entries), nil
+}
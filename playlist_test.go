@@ -0,0 +1,98 @@
+package giffer_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jackmordaunt/giffer"
+	"github.com/jackmordaunt/giffer/giffertest"
+)
+
+// titles returns the titles of the entries.
+func titles(entries []giffer.Entry) []string {
+	var titles []string
+	for _, e := range entries {
+		titles = append(titles, e.Title)
+	}
+	return titles
+}
+
+func TestFilter(t *testing.T) {
+	var entries []giffer.Entry
+	for _, title := range []string{"Intro", "Episode 1", "Episode 2", "Bonus: Episode 2 bloopers", "Episode 3"} {
+		entries = append(entries, giffer.Entry{Title: title})
+	}
+	tests := []struct {
+		name   string
+		filter giffer.Filter
+		want   []string
+	}{
+		{"none", giffer.Filter{}, []string{"Intro", "Episode 1", "Episode 2", "Bonus: Episode 2 bloopers", "Episode 3"}},
+		{"include", giffer.Filter{Include: regexp.MustCompile(`^Episode`)}, []string{"Episode 1", "Episode 2", "Episode 3"}},
+		{"exclude", giffer.Filter{Exclude: regexp.MustCompile(`(?i)bonus|intro`)}, []string{"Episode 1", "Episode 2", "Episode 3"}},
+		{
+			"include and exclude",
+			giffer.Filter{Include: regexp.MustCompile(`Episode 2`), Exclude: regexp.MustCompile(`bloopers`)},
+			[]string{"Episode 2"},
+		},
+		{"max", giffer.Filter{Max: 2}, []string{"Intro", "Episode 1"}},
+		{
+			"max counts kept entries",
+			giffer.Filter{Include: regexp.MustCompile(`^Episode`), Max: 2},
+			[]string{"Episode 1", "Episode 2"},
+		},
+		{"nothing matches", giffer.Filter{Include: regexp.MustCompile(`Season 2`)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := titles(tt.filter.Apply(entries)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	dir := t.TempDir()
+	clips, err := giffertest.Clips(dir, 4, time.Second)
+	if err != nil {
+		t.Fatalf("making clips: %v", err)
+	}
+	p := &giffertest.Playlist{Lists: map[string][]giffer.Entry{"episodes": clips}}
+	dl := giffer.Downloader{Dir: t.TempDir(), Sources: p.Registry(), Backoff: time.Millisecond}
+	ctx := context.Background()
+
+	entries, err := dl.Expand(ctx, "playlist://episodes", giffer.Filter{
+		Exclude: regexp.MustCompile(`2`),
+		Max:     2,
+	})
+	if err != nil {
+		t.Fatalf("expanding: %v", err)
+	}
+	if got, want := titles(entries), []string{"Episode 1", "Episode 3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expanded to %q, want %q", got, want)
+	}
+
+	// A single video expands to itself, unfiltered.
+	single := filepath.Join(dir, "episode-1.y4m")
+	entries, err = dl.Expand(ctx, single, giffer.Filter{Include: regexp.MustCompile(`nothing`)})
+	if err != nil {
+		t.Fatalf("expanding: %v", err)
+	}
+	if want := []giffer.Entry{{URL: single}}; !reflect.DeepEqual(entries, want) {
+		t.Errorf("expanded a video to %+v, want %+v", entries, want)
+	}
+
+	if _, err := dl.Expand(ctx, "playlist://missing", giffer.Filter{}); err == nil {
+		t.Errorf("expanding a missing playlist succeeded")
+	}
+	p.Err = errors.New("listing is broken")
+	if _, err := dl.Expand(ctx, "playlist://episodes", giffer.Filter{}); !errors.Is(err, p.Err) {
+		t.Errorf("got error %v, want %v", err, p.Err)
+	}
+}
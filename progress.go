@@ -0,0 +1,114 @@
+package giffer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// progressInterval is how often download progress is reported.
+const progressInterval = 250 * time.Millisecond
+
+// DownloadProgress describes how far through a download is.
+type DownloadProgress struct {
+	// Bytes downloaded so far, including bytes resumed from a partial file.
+	Bytes int64
+	// Total size of the download in bytes, 0 if unknown.
+	Total int64
+	// Rate of transfer in bytes per second.
+	Rate float64
+	// ETA is the estimated time remaining, 0 if unknown.
+	ETA time.Duration
+}
+
+// Fraction of the download that is complete, in [0, 1]. -1 if the total is
+// unknown.
+func (p DownloadProgress) Fraction() float64 {
+	if p.Total <= 0 {
+		return -1
+	}
+	if p.Bytes >= p.Total {
+		return 1
+	}
+	return float64(p.Bytes) / float64(p.Total)
+}
+
+func (p DownloadProgress) String() string {
+	s := formatBytes(p.Bytes)
+	if p.Total > 0 {
+		s += " / " + formatBytes(p.Total)
+	}
+	if p.Rate > 0 {
+		s += fmt.Sprintf(" (%s/s", formatBytes(int64(p.Rate)))
+		if eta := p.ETA.Round(time.Second); eta > 0 {
+			s += fmt.Sprintf(", %s left", eta)
+		}
+		s += ")"
+	}
+	return s
+}
+
+// watchProgress reports the growth of the file at path to f until the
+// returned function is called, which reports once more and stops.
+//
+// Polling the file works for every source, including external commands,
+// without them having to report how much they have written.
+func watchProgress(
+	ctx context.Context,
+	path string,
+	total int64,
+	f func(DownloadProgress),
+) (stop func()) {
+	if f == nil {
+		return func() {}
+	}
+	var (
+		began   = time.Now()
+		initial = fileSize(path)
+		done    = make(chan struct{})
+		stopped = make(chan struct{})
+	)
+	report := func() {
+		p := DownloadProgress{
+			Bytes: fileSize(path),
+			Total: total,
+		}
+		if elapsed := time.Since(began).Seconds(); elapsed > 0 && p.Bytes > initial {
+			p.Rate = float64(p.Bytes-initial) / elapsed
+		}
+		if p.Rate > 0 && p.Total > p.Bytes {
+			p.ETA = time.Duration(float64(p.Total-p.Bytes) / p.Rate * float64(time.Second))
+		}
+		f(p)
+	}
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(progressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				report()
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		report()
+	}
+}
+
+// fileSize returns the size of the file at path, 0 if it doesn't exist.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
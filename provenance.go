@@ -0,0 +1,199 @@
+package giffer
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+)
+
+// Provenance describes where a gif came from.
+type Provenance struct {
+	// Source is the URL or file the gif was made from.
+	Source string `json:"source"`
+	// Title and Author of the source video, if known.
+	Title  string  `json:"title,omitempty"`
+	Author string  `json:"author,omitempty"`
+	Start  float64 `json:"start"`
+	End    float64 `json:"end"`
+	FPS    float64 `json:"fps"`
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	// Giffer is the version of giffer that made the gif.
+	Giffer string `json:"giffer"`
+	// FFmpeg is the version of FFmpeg that made the gif.
+	FFmpeg string `json:"ffmpeg"`
+}
+
+// ProvenanceFormat selects which metadata blocks carry provenance.
+// Formats can be combined.
+type ProvenanceFormat int
+
+const (
+	// ProvenanceComment embeds provenance as json in a comment extension.
+	ProvenanceComment ProvenanceFormat = 1 << iota
+	// ProvenanceXMP embeds provenance as an XMP application extension.
+	ProvenanceXMP
+)
+
+const (
+	commentPrefix = "giffer:"
+	xmpIdentifier = "XMP DataXMP"
+	xmpNamespace  = "https://github.com/jackmordaunt/giffer/ns/1.0/"
+)
+
+// xmpTrailer is the "magic trailer" that lets decoders that know nothing of
+// XMP skip the raw packet as if it were a chain of sub-blocks.
+var xmpTrailer = func() []byte {
+	t := []byte{0x01}
+	for ii := 0xFF; ii >= 0; ii-- {
+		t = append(t, byte(ii))
+	}
+	return append(t, 0x00)
+}()
+
+// EmbedProvenance returns a copy of the gif with provenance embedded in the
+// requested formats. Provenance previously embedded by giffer is replaced.
+func EmbedProvenance(data []byte, p Provenance, format ProvenanceFormat) ([]byte, error) {
+	layout, err := scanGIF(data)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		out  = make([]byte, 0, len(data)+1024)
+		prev = 0
+	)
+	for _, ext := range layout.Extensions {
+		if isProvenance(data, ext) {
+			out = append(out, data[prev:ext.Offset]...)
+			prev = ext.End
+		}
+	}
+	out = append(out, data[prev:layout.Trailer]...)
+	if format&ProvenanceComment != 0 {
+		comment, err := json.Marshal(p)
+		if err != nil {
+			return nil, fmt.Errorf("encoding comment: %w", err)
+		}
+		out = append(out, gifExtension, gifCommentLabel)
+		out = subBlocks(out, append([]byte(commentPrefix), comment...))
+	}
+	if format&ProvenanceXMP != 0 {
+		out = append(out, gifExtension, gifAppLabel, byte(len(xmpIdentifier)))
+		out = append(out, xmpIdentifier...)
+		out = append(out, p.xmp()...)
+		out = append(out, xmpTrailer...)
+	}
+	return append(out, data[layout.Trailer:]...), nil
+}
+
+// ReadProvenance extracts provenance embedded by EmbedProvenance.
+// Returns nil if the gif doesn't carry any.
+func ReadProvenance(data []byte) (*Provenance, error) {
+	layout, err := scanGIF(data)
+	if err != nil {
+		return nil, err
+	}
+	var xmp []byte
+	for _, ext := range layout.Extensions {
+		switch {
+		case isComment(data, ext):
+			var p Provenance
+			comment := readSubBlocks(data, ext.Offset+2)
+			if err := json.Unmarshal(comment[len(commentPrefix):], &p); err != nil {
+				return nil, fmt.Errorf("decoding comment: %w", err)
+			}
+			return &p, nil
+		case isXMP(data, ext) && xmp == nil:
+			xmp = data[ext.Offset+3+len(xmpIdentifier) : ext.End-len(xmpTrailer)]
+		}
+	}
+	if xmp == nil {
+		return nil, nil
+	}
+	return parseXMP(xmp)
+}
+
+func isProvenance(data []byte, ext gifBlock) bool {
+	return isComment(data, ext) || isXMP(data, ext)
+}
+
+func isComment(data []byte, ext gifBlock) bool {
+	return ext.Label == gifCommentLabel &&
+		bytes.HasPrefix(readSubBlocks(data, ext.Offset+2), []byte(commentPrefix))
+}
+
+func isXMP(data []byte, ext gifBlock) bool {
+	id := data[ext.Offset+2 : ext.End]
+	return ext.Label == gifAppLabel &&
+		len(id) > len(xmpIdentifier)+len(xmpTrailer) &&
+		int(id[0]) == len(xmpIdentifier) &&
+		string(id[1:1+len(xmpIdentifier)]) == xmpIdentifier &&
+		bytes.HasSuffix(id, xmpTrailer)
+}
+
+// xmp renders the provenance as an XMP packet.
+func (p Provenance) xmp() []byte {
+	var buf bytes.Buffer
+	attr := func(name, value string) {
+		fmt.Fprintf(&buf, "\n    giffer:%s=\"", name)
+		xml.EscapeText(&buf, []byte(value))
+		buf.WriteString("\"")
+	}
+	buf.WriteString("<?xpacket begin=\"\uFEFF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	buf.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	buf.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	buf.WriteString("  <rdf:Description rdf:about=\"\"\n    xmlns:giffer=\"" + xmpNamespace + "\"")
+	attr("source", p.Source)
+	if p.Title != "" {
+		attr("title", p.Title)
+	}
+	if p.Author != "" {
+		attr("author", p.Author)
+	}
+	attr("start", strconv.FormatFloat(p.Start, 'f', -1, 64))
+	attr("end", strconv.FormatFloat(p.End, 'f', -1, 64))
+	attr("fps", strconv.FormatFloat(p.FPS, 'f', -1, 64))
+	attr("width", strconv.Itoa(p.Width))
+	attr("height", strconv.Itoa(p.Height))
+	attr("giffer", p.Giffer)
+	attr("ffmpeg", p.FFmpeg)
+	buf.WriteString("/>\n </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"r\"?>")
+	return buf.Bytes()
+}
+
+func parseXMP(packet []byte) (*Provenance, error) {
+	var meta struct {
+		RDF struct {
+			Description struct {
+				Source string  `xml:"https://github.com/jackmordaunt/giffer/ns/1.0/ source,attr"`
+				Title  string  `xml:"https://github.com/jackmordaunt/giffer/ns/1.0/ title,attr"`
+				Author string  `xml:"https://github.com/jackmordaunt/giffer/ns/1.0/ author,attr"`
+				Start  float64 `xml:"https://github.com/jackmordaunt/giffer/ns/1.0/ start,attr"`
+				End    float64 `xml:"https://github.com/jackmordaunt/giffer/ns/1.0/ end,attr"`
+				FPS    float64 `xml:"https://github.com/jackmordaunt/giffer/ns/1.0/ fps,attr"`
+				Width  int     `xml:"https://github.com/jackmordaunt/giffer/ns/1.0/ width,attr"`
+				Height int     `xml:"https://github.com/jackmordaunt/giffer/ns/1.0/ height,attr"`
+				Giffer string  `xml:"https://github.com/jackmordaunt/giffer/ns/1.0/ giffer,attr"`
+				FFmpeg string  `xml:"https://github.com/jackmordaunt/giffer/ns/1.0/ ffmpeg,attr"`
+			} `xml:"http://www.w3.org/1999/02/22-rdf-syntax-ns# Description"`
+		} `xml:"http://www.w3.org/1999/02/22-rdf-syntax-ns# RDF"`
+	}
+	if err := xml.Unmarshal(packet, &meta); err != nil {
+		return nil, fmt.Errorf("decoding xmp: %w", err)
+	}
+	d := meta.RDF.Description
+	return &Provenance{
+		Source: d.Source,
+		Title:  d.Title,
+		Author: d.Author,
+		Start:  d.Start,
+		End:    d.End,
+		FPS:    d.FPS,
+		Width:  d.Width,
+		Height: d.Height,
+		Giffer: d.Giffer,
+		FFmpeg: d.FFmpeg,
+	}, nil
+}
@@ -0,0 +1,156 @@
+package giffer_test
+
+import (
+	"bytes"
+	"image/gif"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackmordaunt/giffer"
+	"github.com/jackmordaunt/giffer/giffertest"
+)
+
+// countBlocks counts the provenance comments and XMP packets in the gif.
+func countBlocks(data []byte) (comments, xmp int) {
+	return bytes.Count(data, []byte("giffer:{")), bytes.Count(data, []byte("XMP DataXMP"))
+}
+
+func TestProvenanceRoundTrip(t *testing.T) {
+	p := giffer.Provenance{
+		Source: "https://example.com/watch?v=1&list=2",
+		Title:  `Tom & Jerry: "The <Best> Bits" — ünïcödé 'quoted'` + "\nsecond line",
+		Author: "A. N. Other & Co",
+		Start:  1.25,
+		End:    3.5,
+		FPS:    23.976,
+		Width:  320,
+		Height: 180,
+		Giffer: "v1.2.3",
+		FFmpeg: "6.0",
+	}
+	tests := []struct {
+		name          string
+		format        giffer.ProvenanceFormat
+		comments, xmp int
+	}{
+		{"comment", giffer.ProvenanceComment, 1, 0},
+		{"xmp", giffer.ProvenanceXMP, 0, 1},
+		{"both", giffer.ProvenanceComment | giffer.ProvenanceXMP, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := giffer.EmbedProvenance(giffertest.SyntheticGIF(3, 10), p, tt.format)
+			if err != nil {
+				t.Fatalf("embedding: %v", err)
+			}
+			got, err := giffer.ReadProvenance(data)
+			if err != nil {
+				t.Fatalf("reading: %v", err)
+			}
+			if got == nil || *got != p {
+				t.Errorf("read %+v, want %+v", got, p)
+			}
+			if comments, xmp := countBlocks(data); comments != tt.comments || xmp != tt.xmp {
+				t.Errorf("embedded %d comments and %d xmp packets, want %d and %d", comments, xmp, tt.comments, tt.xmp)
+			}
+			// Decoders that know nothing of provenance still see every frame.
+			img, err := gif.DecodeAll(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			if len(img.Image) != 3 {
+				t.Errorf("decoded %d frames, want 3", len(img.Image))
+			}
+		})
+	}
+}
+
+func TestProvenanceAbsent(t *testing.T) {
+	p, err := giffer.ReadProvenance(giffertest.SyntheticGIF(2, 10))
+	if err != nil || p != nil {
+		t.Errorf("read %+v, %v from a gif without provenance", p, err)
+	}
+	if _, err := giffer.ReadProvenance([]byte("not a gif")); err == nil {
+		t.Errorf("reading provenance from garbage succeeded")
+	}
+}
+
+func TestProvenanceRestamp(t *testing.T) {
+	var (
+		both   = giffer.ProvenanceComment | giffer.ProvenanceXMP
+		first  = giffer.Provenance{Source: "https://example.com/first", Title: "First", End: 1}
+		second = giffer.Provenance{Source: "https://example.com/second", Title: "Second", End: 2}
+	)
+	data, err := giffer.EmbedProvenance(giffertest.SyntheticGIF(2, 10), first, both)
+	if err != nil {
+		t.Fatalf("embedding: %v", err)
+	}
+	for _, format := range []giffer.ProvenanceFormat{both, giffer.ProvenanceXMP} {
+		if data, err = giffer.EmbedProvenance(data, second, format); err != nil {
+			t.Fatalf("embedding again: %v", err)
+		}
+		got, err := giffer.ReadProvenance(data)
+		if err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+		if got == nil || *got != second {
+			t.Errorf("read %+v after restamping, want %+v", got, second)
+		}
+	}
+	// The first stamp is replaced rather than added to, in either format.
+	if comments, xmp := countBlocks(data); comments != 0 || xmp != 1 {
+		t.Errorf("restamped gif has %d comments and %d xmp packets, want 0 and 1", comments, xmp)
+	}
+}
+
+func TestStamp(t *testing.T) {
+	h := harness(t)
+	if err := h.Script("ffmpeg", giffertest.Script{Stdout: "ffmpeg version 6.0-test Copyright (c) the FFmpeg developers\n"}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "clip.gif")
+	if err := ioutil.WriteFile(path, giffertest.SyntheticGIF(2, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	eng := h.Engine()
+	defer eng.Clean()
+	if err := eng.Stamp(path, giffer.Provenance{Source: "video.mp4"}); err != nil {
+		t.Fatalf("stamping without formats: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(path); !bytes.Equal(data, giffertest.SyntheticGIF(2, 10)) {
+		t.Errorf("stamping without formats changed the gif")
+	}
+	eng.Provenance = giffer.ProvenanceComment | giffer.ProvenanceXMP
+	for _, title := range []string{"First", "Second & <last>"} {
+		if err := eng.Stamp(path, giffer.Provenance{Source: "video.mp4", Title: title}); err != nil {
+			t.Fatalf("stamping: %v", err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := giffer.ReadProvenance(data)
+	if err != nil || got == nil {
+		t.Fatalf("reading: %+v, %v", got, err)
+	}
+	img, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := giffer.Provenance{
+		Source: "video.mp4",
+		Title:  "Second & <last>",
+		Width:  img.Width,
+		Height: img.Height,
+		Giffer: giffer.Version,
+		FFmpeg: "6.0-test",
+	}
+	if *got != want {
+		t.Errorf("stamped %+v, want %+v", *got, want)
+	}
+	if comments, xmp := countBlocks(data); comments != 1 || xmp != 1 {
+		t.Errorf("stamping twice left %d comments and %d xmp packets, want 1 of each", comments, xmp)
+	}
+}
@@ -0,0 +1,88 @@
+package giffer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+var (
+	// DefaultRetries is the number of times a download is retried after a
+	// transient error.
+	DefaultRetries = 5
+	// DefaultBackoff is the delay before the first retry. Each retry waits
+	// twice as long as the last, up to MaxBackoff.
+	DefaultBackoff = 500 * time.Millisecond
+	// MaxBackoff bounds the delay between retries.
+	MaxBackoff = 30 * time.Second
+)
+
+// StatusError is an unsuccessful HTTP response.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (err *StatusError) Error() string {
+	return err.Status
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (err *StatusError) Temporary() bool {
+	return err.Code == http.StatusTooManyRequests || err.Code >= 500
+}
+
+// transient reports whether the error is likely to go away by itself, such as
+// a dropped connection, in which case the operation is worth retrying.
+func transient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var temp interface{ Temporary() bool }
+	if errors.As(err, &temp) && temp.Temporary() {
+		return true
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// retry calls f until it succeeds, fails with an error that isn't transient,
+// or has been retried Retries times. Retries back off exponentially.
+func (dl Downloader) retry(ctx context.Context, what string, f func() error) error {
+	retries := dl.Retries
+	if retries == 0 {
+		retries = DefaultRetries
+	}
+	backoff := dl.Backoff
+	if backoff <= 0 {
+		backoff = DefaultBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= retries || !transient(err) {
+			return err
+		}
+		dl.logf("download: %s failed, retrying in %s: %v\n", what, backoff, err)
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		if backoff *= 2; backoff > MaxBackoff {
+			backoff = MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package giffer
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kkdai/youtube/v2/downloader"
+)
+
+// Source resolves and fetches videos from somewhere, such as a video site.
+type Source interface {
+	// Resolve identifies the video a request refers to, without fetching it.
+	Resolve(ctx context.Context, req Request) (*Media, error)
+	// Fetch downloads the whole video into the file dst. If dst holds part
+	// of the video from an interrupted fetch, sources that are able to
+	// resume from the end of it do so. Others overwrite it.
+	Fetch(ctx context.Context, m *Media, dst string) error
+}
+
+// Request describes the video a caller wants from a source.
+type Request struct {
+	URL string
+	// Start and End of the wanted range in seconds. End at or before Start
+	// means the whole video.
+	Start, End float64
+	// Width and Height of the output, in pixels. Sources with a choice of
+	// formats use these to avoid fetching more than is needed.
+	// Non-positive values are unconstrained.
+	Width, Height int
+	// Format overrides format selection, eg with an itag or "720p".
+	Format string
+	// Codecs that can be decoded. Nil allows any codec.
+	Codecs Codecs
+}
+
+// Media is a video that has been resolved by a Source.
+type Media struct {
+	// ID identifies the video regardless of which URL referred to it,
+	// eg "youtube:dQw4w9WgXcQ". It changes when the video does, since it
+	// keys the download cache.
+	ID string
+	// URL the video was resolved from.
+	URL string
+	// Metadata describing the video.
+	Metadata SourceMetadata
+	// Ext is the file extension, including the dot, of fetched files.
+	Ext string
+	// Stream is a URL or path that FFmpeg can read directly, which allows
+	// portions of the video to be fetched without fetching the whole thing.
+	// Empty if the video can only be fetched whole.
+	Stream string
+	// Size of the fetched file in bytes, 0 if unknown.
+	Size int64
+	// Format identifies the format chosen, if the source offers a choice.
+	Format string
+	// Note explains why the format was chosen.
+	Note string
+	// Extra holds source specific state, carried from Resolve to Fetch.
+	Extra interface{}
+}
+
+// SourceMetadata describes a video that gifs are made from.
+type SourceMetadata struct {
+	Title  string `json:"title,omitempty"`
+	Author string `json:"author,omitempty"`
+	// Duration of the video, 0 if unknown.
+	Duration time.Duration `json:"duration,omitempty"`
+	// Uploaded is when the video was published, zero if unknown.
+	Uploaded time.Time `json:"uploaded,omitempty"`
+	// URL is the canonical URL of the video, the same however the video was
+	// referred to.
+	URL string `json:"url,omitempty"`
+	// Thumbnail is the URL of an image representing the video.
+	Thumbnail string `json:"thumbnail,omitempty"`
+	// Chapters of the video, in order. Nil if it has none.
+	Chapters []Chapter `json:"chapters,omitempty"`
+}
+
+// FileName names a file made from the video, with the given extension, after
+// the video's title.
+func (m SourceMetadata) FileName(ext string) string {
+	title := m.Title
+	if title == "" {
+		title = "video"
+	}
+	return downloader.SanitizeFilename(title) + ext
+}
+
+// Registry maps URLs to the Source that handles them, by host or by scheme.
+// Hosts take precedence over schemes.
+type Registry struct {
+	mu      sync.RWMutex
+	hosts   map[string]Source
+	schemes map[string]Source
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		hosts:   make(map[string]Source),
+		schemes: make(map[string]Source),
+	}
+}
+
+// youtubeHosts serve YouTube videos.
+var youtubeHosts = []string{"youtube.com", "youtu.be", "youtube-nocookie.com"}
+
+// DefaultSources handles YouTube, direct HTTP(S) media URLs, file:// URLs and
+// local paths.
+var DefaultSources = func() *Registry {
+	r := NewRegistry()
+	yt := &YouTubeSource{}
+	for _, host := range youtubeHosts {
+		r.RegisterHost(host, yt)
+	}
+	h := &HTTPSource{}
+	r.RegisterScheme("http", h)
+	r.RegisterScheme("https", h)
+	r.RegisterScheme("file", FileSource{})
+	return r
+}()
+
+// RegisterHost routes URLs for host, and any of its subdomains, to s.
+func (r *Registry) RegisterHost(host string, s Source) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts[strings.ToLower(host)] = s
+}
+
+// RegisterScheme routes URLs with the scheme to s. Local paths are routed as
+// the "file" scheme.
+func (r *Registry) RegisterScheme(scheme string, s Source) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemes[strings.ToLower(scheme)] = s
+}
+
+// Lookup finds the Source for the URL.
+func (r *Registry) Lookup(rawURL string) (Source, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	u, err := url.Parse(rawURL)
+	if err != nil || isLocalPath(rawURL, u) {
+		if s, ok := r.schemes["file"]; ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("no source for local path %q", rawURL)
+	}
+	for host := strings.ToLower(u.Hostname()); host != ""; {
+		if s, ok := r.hosts[host]; ok {
+			return s, nil
+		}
+		dot := strings.IndexByte(host, '.')
+		if dot < 0 {
+			break
+		}
+		host = host[dot+1:]
+	}
+	if s, ok := r.schemes[strings.ToLower(u.Scheme)]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("no source for %q", rawURL)
+}
+
+// isLocalPath reports whether the URL is really a file path. Single letter
+// schemes are Windows drive letters.
+func isLocalPath(raw string, u *url.URL) bool {
+	return u.Scheme == "" || len(u.Scheme) == 1 || filepath.IsAbs(raw)
+}
+
+// extension picks a file extension for a media type, defaulting to ".mp4".
+func extension(mediaType string) string {
+	mediaType, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return ".mp4"
+	}
+	switch mediaType {
+	case "video/mp4", "audio/mp4":
+		return ".mp4"
+	case "video/webm", "audio/webm":
+		return ".webm"
+	case "video/x-matroska":
+		return ".mkv"
+	case "video/quicktime":
+		return ".mov"
+	case "video/3gpp":
+		return ".3gp"
+	case "image/gif":
+		return ".gif"
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ".mp4"
+}
@@ -0,0 +1,177 @@
+package giffer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CommandSource fetches videos with an external command line tool that speaks
+// the yt-dlp interface.
+type CommandSource struct {
+	// Command to run, defaults to "yt-dlp".
+	Command string
+	// Format selects the format to fetch, defaults to "bv*/b": the best video
+	// only stream, or the best stream with video if there isn't one.
+	Format string
+	// Args are passed to every invocation, before the URL.
+	Args []string
+}
+
+func (s CommandSource) command() string {
+	if s.Command == "" {
+		return "yt-dlp"
+	}
+	return s.Command
+}
+
+func (s CommandSource) format() string {
+	if s.Format == "" {
+		return "bv*/b"
+	}
+	return s.Format
+}
+
+// resolveFields are printed by the command, one per line, in order. Urls
+// come last since merged formats print one line per stream.
+var resolveFields = []string{
+	"id",
+	"title",
+	"ext",
+	"uploader",
+	"duration",
+	"upload_date",
+	"webpage_url",
+	"thumbnail",
+	"%(chapters)j",
+	"urls",
+}
+
+// Resolve asks the command for the video's id, metadata, extension and
+// stream url.
+func (s CommandSource) Resolve(ctx context.Context, req Request) (*Media, error) {
+	args := []string{
+		"--no-warnings",
+		"--no-playlist",
+		"-f", s.format(),
+	}
+	for _, f := range resolveFields {
+		args = append(args, "--print", f)
+	}
+	args = append(args, s.Args...)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command(), append(args, "--", req.URL)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("resolving with %s: %w: %s", s.command(), err, stderr.String())
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) < len(resolveFields) {
+		return nil, fmt.Errorf("resolving with %s: unexpected output %q", s.command(), stdout.String())
+	}
+	// Missing fields are printed as "NA".
+	field := func(ii int) string {
+		if lines[ii] == "NA" {
+			return ""
+		}
+		return lines[ii]
+	}
+	m := &Media{
+		ID:  s.command() + ":" + lines[0],
+		URL: req.URL,
+		Ext: "." + lines[2],
+		Metadata: SourceMetadata{
+			Title:     field(1),
+			Author:    field(3),
+			URL:       field(6),
+			Thumbnail: field(7),
+		},
+	}
+	if d, err := strconv.ParseFloat(field(4), 64); err == nil {
+		m.Metadata.Duration = time.Duration(d * float64(time.Second))
+	}
+	if t, err := time.Parse("20060102", field(5)); err == nil {
+		m.Metadata.Uploaded = t
+	}
+	var chapters []struct {
+		Title string  `json:"title"`
+		Start float64 `json:"start_time"`
+		End   float64 `json:"end_time"`
+	}
+	if err := json.Unmarshal([]byte(lines[8]), &chapters); err == nil {
+		for _, c := range chapters {
+			m.Metadata.Chapters = append(m.Metadata.Chapters, Chapter(c))
+		}
+	}
+	// Formats that merge separate streams print one url per stream, which
+	// FFmpeg can't read as a single input.
+	if len(lines) == len(resolveFields) {
+		m.Stream = lines[len(resolveFields)-1]
+	}
+	return m, nil
+}
+
+// Fetch downloads the video with the command, which continues a partial
+// download in dst.
+func (s CommandSource) Fetch(ctx context.Context, m *Media, dst string) error {
+	args := append([]string{
+		"--no-warnings",
+		"--no-playlist",
+		"--no-part",
+		"-f", s.format(),
+		"-o", dst,
+	}, s.Args...)
+	cmd := exec.CommandContext(ctx, s.command(), append(args, "--", m.URL)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("fetching with %s: %w: %s", s.command(), err, out)
+	}
+	return nil
+}
+
+// List asks the command to expand playlists and channels, without resolving
+// each of their entries.
+func (s CommandSource) List(ctx context.Context, url string) ([]Entry, error) {
+	args := append([]string{
+		"--no-warnings",
+		"--flat-playlist",
+		"--dump-single-json",
+	}, s.Args...)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command(), append(args, "--", url)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("listing with %s: %w: %s", s.command(), err, stderr.String())
+	}
+	var info struct {
+		Type    string `json:"_type"`
+		Entries []struct {
+			ID       string  `json:"id"`
+			Title    string  `json:"title"`
+			URL      string  `json:"url"`
+			Duration float64 `json:"duration"`
+		} `json:"entries"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &info); err != nil {
+		return nil, fmt.Errorf("listing with %s: decoding output: %w", s.command(), err)
+	}
+	if info.Type != "playlist" {
+		return nil, nil
+	}
+	entries := make([]Entry, len(info.Entries))
+	for ii, e := range info.Entries {
+		entries[ii] = Entry{
+			URL:      e.URL,
+			ID:       s.command() + ":" + e.ID,
+			Title:    e.Title,
+			Duration: time.Duration(e.Duration * float64(time.Second)),
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,78 @@
+package giffer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileSource "fetches" videos from the local filesystem, addressed either by
+// path or by file:// URL.
+type FileSource struct{}
+
+// Resolve checks that the file exists.
+func (FileSource) Resolve(ctx context.Context, req Request) (*Media, error) {
+	p, err := localPath(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", p)
+	}
+	var (
+		base = filepath.Base(p)
+		// Editing or replacing the file changes its size or modification
+		// time, so the cached copy of the old one isn't used.
+		id = fmt.Sprintf("file:%s:%d:%d", p, info.Size(), info.ModTime().UnixNano())
+	)
+	return &Media{
+		ID:  id,
+		URL: req.URL,
+		Metadata: SourceMetadata{
+			Title:    strings.TrimSuffix(base, filepath.Ext(base)),
+			Uploaded: info.ModTime(),
+			URL:      (&url.URL{Scheme: "file", Path: filepath.ToSlash(p)}).String(),
+		},
+		Ext:    filepath.Ext(p),
+		Stream: p,
+	}, nil
+}
+
+// Fetch copies the file to dst. It isn't linked, since then changing either
+// the file or the cached copy would change both.
+func (FileSource) Fetch(ctx context.Context, m *Media, dst string) error {
+	in, err := os.Open(m.Stream)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("copying file: %w", err)
+	}
+	return out.Close()
+}
+
+// localPath converts a file:// URL or path into an absolute path.
+func localPath(raw string) (string, error) {
+	if strings.HasPrefix(raw, "file://") {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return "", fmt.Errorf("parsing url: %w", err)
+		}
+		raw = filepath.FromSlash(u.Path)
+	}
+	return filepath.Abs(raw)
+}
@@ -0,0 +1,170 @@
+package giffer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// HTTPSource fetches media files directly over HTTP(S).
+type HTTPSource struct {
+	// Client to make requests with. Nil uses http.DefaultClient.
+	Client *http.Client
+}
+
+func (s *HTTPSource) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+// Resolve checks that the URL serves media.
+func (s *HTTPSource) Resolve(ctx context.Context, req Request) (*Media, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing url: %w", err)
+	}
+	head, err := http.NewRequestWithContext(ctx, http.MethodHead, req.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client().Do(head)
+	if err != nil {
+		return nil, fmt.Errorf("requesting media: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("requesting media: %w", &StatusError{
+			Code:   resp.StatusCode,
+			Status: resp.Status,
+		})
+	}
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	var (
+		base = path.Base(u.Path)
+		ext  = path.Ext(base)
+	)
+	if ct := resp.Header.Get("Content-Type"); ext == "" && ct != "" {
+		ext = extension(ct)
+	}
+	var size int64
+	if resp.ContentLength > 0 {
+		size = resp.ContentLength
+	}
+	if base == "/" || base == "." {
+		base = u.Hostname()
+	}
+	return &Media{
+		ID:  "url:" + req.URL,
+		URL: req.URL,
+		Metadata: SourceMetadata{
+			Title: strings.TrimSuffix(base, path.Ext(base)),
+			URL:   req.URL,
+		},
+		Ext:    ext,
+		Stream: req.URL,
+		Size:   size,
+		Extra:  httpMedia{validator: validator},
+	}, nil
+}
+
+// httpMedia is the state carried from Resolve to Fetch.
+type httpMedia struct {
+	// validator identifies the version of the file, so that a partial
+	// download is only resumed if the file hasn't changed.
+	validator string
+}
+
+// Fetch downloads the media file, resuming a partial download in dst.
+func (s *HTTPSource) Fetch(ctx context.Context, m *Media, dst string) error {
+	h, _ := m.Extra.(httpMedia)
+	return fetchHTTP(ctx, s.client(), m.URL, h.validator, m.Size, 0, dst)
+}
+
+// fetchHTTP downloads url into dst, resuming from the end of dst if it holds
+// a partial download. validator is an ETag or Last-Modified date, sent so
+// that the server restarts the download if the file has changed since.
+// Positive chunk sizes split the download into ranges of that many bytes,
+// for servers that throttle long transfers.
+func fetchHTTP(
+	ctx context.Context,
+	client *http.Client,
+	url, validator string,
+	size, chunk int64,
+	dst string,
+) error {
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	defer out.Close()
+	for {
+		offset, err := out.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if size > 0 && offset >= size {
+			break
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		switch {
+		case chunk > 0:
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+chunk-1))
+		case offset > 0:
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		if offset > 0 && validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("requesting media: %w", err)
+		}
+		switch {
+		case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && size <= 0:
+			// The partial file already holds the whole file.
+			resp.Body.Close()
+			return out.Close()
+		case resp.StatusCode >= 400:
+			resp.Body.Close()
+			return fmt.Errorf("requesting media: %w", &StatusError{
+				Code:   resp.StatusCode,
+				Status: resp.Status,
+			})
+		case resp.StatusCode != http.StatusPartialContent && offset > 0:
+			// The server ignored the range, so start again.
+			if err := out.Truncate(0); err != nil {
+				resp.Body.Close()
+				return err
+			}
+			if _, err := out.Seek(0, io.SeekStart); err != nil {
+				resp.Body.Close()
+				return err
+			}
+		}
+		n, err := io.Copy(out, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("downloading media: %w", err)
+		}
+		if resp.ContentLength > 0 && n < resp.ContentLength {
+			return fmt.Errorf("downloading media: %w", io.ErrUnexpectedEOF)
+		}
+		if chunk <= 0 || resp.StatusCode != http.StatusPartialContent || n < chunk {
+			break
+		}
+	}
+	return out.Close()
+}
@@ -0,0 +1,109 @@
+package giffer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+// youtubeChunk is the size of the ranges YouTube streams are fetched in.
+// Longer transfers are throttled.
+const youtubeChunk = 10 << 20
+
+// YouTubeSource fetches videos from YouTube.
+type YouTubeSource struct {
+	Client youtube.Client
+}
+
+// youtubeMedia is the state carried from Resolve to Fetch.
+type youtubeMedia struct {
+	video  *youtube.Video
+	format *youtube.Format
+}
+
+// Resolve looks up the video and picks a format to fetch, see selectFormat.
+func (s *YouTubeSource) Resolve(ctx context.Context, req Request) (*Media, error) {
+	v, err := s.Client.GetVideoContext(ctx, req.URL)
+	if err != nil {
+		return nil, fmt.Errorf("getting video: %w", err)
+	}
+	format, note, err := selectFormat(v.Formats, req)
+	if err != nil {
+		return nil, fmt.Errorf("selecting format: %w", err)
+	}
+	stream, err := s.Client.GetStreamURLContext(ctx, v, format)
+	if err != nil {
+		return nil, fmt.Errorf("getting stream url: %w", err)
+	}
+	return &Media{
+		ID:  "youtube:" + v.ID,
+		URL: req.URL,
+		Metadata: SourceMetadata{
+			Title:     v.Title,
+			Author:    v.Author,
+			Duration:  v.Duration,
+			Uploaded:  v.PublishDate,
+			URL:       "https://www.youtube.com/watch?v=" + v.ID,
+			Thumbnail: thumbnail(v.Thumbnails),
+			Chapters:  ParseChapters(v.Description, v.Duration),
+		},
+		Ext:    extension(format.MimeType),
+		Stream: stream,
+		Size:   format.ContentLength,
+		Format: strconv.Itoa(format.ItagNo),
+		Note:   note + ": " + describeFormat(format),
+		Extra:  youtubeMedia{video: v, format: format},
+	}, nil
+}
+
+// Fetch downloads the resolved format, resuming a partial download in dst.
+func (s *YouTubeSource) Fetch(ctx context.Context, m *Media, dst string) error {
+	if _, ok := m.Extra.(youtubeMedia); !ok {
+		return fmt.Errorf("media was not resolved by youtube")
+	}
+	client := s.Client.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return fetchHTTP(ctx, client, m.Stream, "", m.Size, youtubeChunk, dst)
+}
+
+// List expands playlist URLs, including watch URLs within a playlist.
+func (s *YouTubeSource) List(ctx context.Context, rawURL string) ([]Entry, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing url: %w", err)
+	}
+	if u.Query().Get("list") == "" {
+		return nil, nil
+	}
+	p, err := s.Client.GetPlaylistContext(ctx, rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("getting playlist: %w", err)
+	}
+	entries := make([]Entry, len(p.Videos))
+	for ii, v := range p.Videos {
+		entries[ii] = Entry{
+			URL:      "https://www.youtube.com/watch?v=" + v.ID,
+			ID:       "youtube:" + v.ID,
+			Title:    v.Title,
+			Duration: v.Duration,
+		}
+	}
+	return entries, nil
+}
+
+// thumbnail picks the largest thumbnail.
+func thumbnail(thumbnails youtube.Thumbnails) string {
+	var best youtube.Thumbnail
+	for _, t := range thumbnails {
+		if t.Width*t.Height >= best.Width*best.Height {
+			best = t
+		}
+	}
+	return best.URL
+}
@@ -0,0 +1,239 @@
+package giffer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Stages of rendering a gif whose output can be reused.
+const (
+	// StageSource is the downloaded video, cached by DownloadCache.
+	StageSource = "source"
+	// StageSegment is the video trimmed to the clip, losslessly.
+	StageSegment = "segment"
+	// StagePalette is the palette generated for the clip.
+	StagePalette = "palette"
+	// StageGIF is the gif before it is crushed and stamped.
+	StageGIF = "gif"
+)
+
+// StageCache keeps the intermediate files of rendering on disk, so that
+// rendering a clip again with different settings only reruns the stages that
+// the settings affect. Changing the fuzz, for instance, only reruns the crush.
+//
+// Each file is named by a key derived from every input that affects it,
+// including the key of the stage it was made from, so that a change to an
+// input invalidates that stage and those after it. The modification time of
+// each file records when it was last used.
+type StageCache struct {
+	Dir string
+	// MaxBytes bounds the total size of the files. When exceeded the least
+	// recently used are evicted, once the renders using them are done. Zero
+	// is unbounded.
+	MaxBytes int64
+
+	mu sync.Mutex
+	// inUse counts the renders in progress using each file, which are
+	// spared from eviction.
+	inUse map[string]int
+}
+
+// StageResult describes how a stage of a render was done.
+type StageResult struct {
+	Stage string
+	// Hit reports whether the output of the stage was reused.
+	Hit bool
+	// Elapsed is how long the stage took.
+	Elapsed time.Duration
+}
+
+func (r StageResult) String() string {
+	if r.Hit {
+		return r.Stage + " hit"
+	}
+	return fmt.Sprintf("%s miss (%s)", r.Stage, r.Elapsed.Round(time.Millisecond))
+}
+
+// StageReport lists the stages of a render, in the order they were done.
+type StageReport []StageResult
+
+func (r StageReport) String() string {
+	parts := make([]string, len(r))
+	for ii, s := range r {
+		parts[ii] = s.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// stage returns the file of the stage with key, running run to make it if it
+// isn't cached. run makes the file at the path it is given, which has the
+// extension ext. The result is recorded on eng. The file is kept from
+// eviction until it is released.
+func (c *StageCache) stage(eng *Engine, stage, key, ext string, run func(path string) error) (string, error) {
+	var (
+		began = time.Now()
+		dir   = filepath.Join(c.Dir, stage)
+		path  = filepath.Join(dir, key+ext)
+	)
+	c.mu.Lock()
+	_, err := os.Stat(path)
+	if err == nil {
+		// Not a problem if the use can't be recorded, the file just looks
+		// less recently used than it is.
+		now := time.Now()
+		_ = os.Chtimes(path, now, now)
+		c.use(path)
+	}
+	c.mu.Unlock()
+	if err == nil {
+		eng.stage(StageResult{Stage: stage, Hit: true, Elapsed: time.Since(began)})
+		return path, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "preparing stage cache")
+	}
+	// The file is made aside and renamed into place, so that an interrupted
+	// stage is never mistaken for a finished one. Concurrent renders of the
+	// same stage each make their own.
+	tmp, err := ioutil.TempFile(dir, ".tmp-*"+ext)
+	if err != nil {
+		return "", errors.Wrap(err, "preparing stage cache")
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := run(tmp.Name()); err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", errors.Wrap(err, "caching stage")
+	}
+	c.use(path)
+	eng.stage(StageResult{Stage: stage, Elapsed: time.Since(began)})
+	return path, nil
+}
+
+// use marks the file as used by a render in progress.
+func (c *StageCache) use(path string) {
+	if c.inUse == nil {
+		c.inUse = make(map[string]int)
+	}
+	c.inUse[path]++
+}
+
+// release marks the files as no longer used by a render, then evicts what no
+// longer fits.
+func (c *StageCache) release(paths ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, path := range paths {
+		if c.inUse[path]--; c.inUse[path] <= 0 {
+			delete(c.inUse, path)
+		}
+	}
+	return c.evict()
+}
+
+// evict removes the least recently used files, other than those in use,
+// until the cache fits within MaxBytes.
+func (c *StageCache) evict() error {
+	if c.MaxBytes <= 0 {
+		return nil
+	}
+	type file struct {
+		path string
+		info os.FileInfo
+	}
+	var (
+		files []file
+		total int64
+	)
+	for _, stage := range []string{StageSegment, StagePalette, StageGIF} {
+		infos, err := ioutil.ReadDir(filepath.Join(c.Dir, stage))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+				continue
+			}
+			files = append(files, file{filepath.Join(c.Dir, stage, info.Name()), info})
+			total += info.Size()
+		}
+	}
+	sort.Slice(files, func(ii, jj int) bool {
+		return files[ii].info.ModTime().After(files[jj].info.ModTime())
+	})
+	for ii := len(files) - 1; ii >= 0 && total > c.MaxBytes; ii-- {
+		f := files[ii]
+		if c.inUse[f.path] > 0 {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= f.info.Size()
+	}
+	return nil
+}
+
+// stageKey derives the key of a stage from the inputs that affect it. The
+// engine's revision is among them, since a new engine may render differently.
+func stageKey(stage string, inputs ...string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\nengine/%d\n", stage, EngineRevision)
+	for _, in := range inputs {
+		fmt.Fprintf(h, "%q\n", in)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// fingerprintSpan is how much of each end of a video fingerprint reads.
+const fingerprintSpan = 1 << 20
+
+// fingerprint identifies the content of the video at path, by its size and
+// the bytes at each end, without reading all of what may be a large file.
+// Its path and modification time aren't enough, since the download cache
+// touches videos as they're used.
+func fingerprint(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.CopyN(h, f, fingerprintSpan); err != nil && err != io.EOF {
+		return "", err
+	}
+	if info.Size() > 2*fingerprintSpan {
+		if _, err := f.Seek(info.Size()-fingerprintSpan, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%s", info.Size(), hex.EncodeToString(h.Sum(nil))), nil
+}
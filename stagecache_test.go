@@ -0,0 +1,102 @@
+package giffer_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jackmordaunt/giffer"
+	"github.com/jackmordaunt/giffer/giffertest"
+)
+
+// stages returns the report of the last render, without the timings.
+func stages(eng *giffer.Engine) giffer.StageReport {
+	got := make(giffer.StageReport, len(eng.Stages))
+	for ii, r := range eng.Stages {
+		r.Elapsed = 0
+		got[ii] = r
+	}
+	return got
+}
+
+// hit and miss are stages as reported by stages.
+func hit(stage string) giffer.StageResult  { return giffer.StageResult{Stage: stage, Hit: true} }
+func miss(stage string) giffer.StageResult { return giffer.StageResult{Stage: stage} }
+
+// cachedVideo writes a video for the fake ffmpeg, and returns an engine that
+// caches its stages.
+func cachedVideo(t *testing.T, maxBytes int64) (*giffer.Engine, string) {
+	t.Helper()
+	h := harness(t)
+	if err := h.Script("ffmpeg", giffertest.Script{Delay: 4, RequireInput: true}); err != nil {
+		t.Fatal(err)
+	}
+	video := filepath.Join(t.TempDir(), "clip.mp4")
+	if err := ioutil.WriteFile(video, make([]byte, 4000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	eng := h.Engine()
+	eng.Cache = &giffer.StageCache{Dir: t.TempDir(), MaxBytes: maxBytes}
+	t.Cleanup(eng.Clean)
+	return eng, video
+}
+
+func TestStageCacheReuse(t *testing.T) {
+	eng, video := cachedVideo(t, 0)
+	for _, tt := range []struct {
+		name string
+		fps  float64
+		want giffer.StageReport
+	}{
+		{"first", 10, giffer.StageReport{miss(giffer.StageSegment), miss(giffer.StagePalette), miss(giffer.StageGIF)}},
+		{"again", 10, giffer.StageReport{hit(giffer.StageGIF)}},
+		{"new rate", 5, giffer.StageReport{hit(giffer.StageSegment), miss(giffer.StagePalette), miss(giffer.StageGIF)}},
+	} {
+		if _, err := eng.Transcode(video, 1, 3, 0, 0, tt.fps); err != nil {
+			t.Fatalf("%s: transcoding: %v", tt.name, err)
+		}
+		if got := stages(eng); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: stages %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestStageCacheEviction renders with a cache too small for every stage, so
+// that each stage would evict the one before it while it is still needed.
+// Later renders reuse whichever stages survived.
+func TestStageCacheEviction(t *testing.T) {
+	eng, video := cachedVideo(t, 100)
+	for _, tt := range []struct {
+		name string
+		fps  float64
+		want giffer.StageReport
+	}{
+		{"first", 10, giffer.StageReport{miss(giffer.StageSegment), miss(giffer.StagePalette), miss(giffer.StageGIF)}},
+		// Only the gif fits, which is all that the same render needs.
+		{"again", 10, giffer.StageReport{hit(giffer.StageGIF)}},
+		// The segment was evicted, so another rate starts over.
+		{"new rate", 5, giffer.StageReport{miss(giffer.StageSegment), miss(giffer.StagePalette), miss(giffer.StageGIF)}},
+	} {
+		if _, err := eng.Transcode(video, 1, 3, 0, 0, tt.fps); err != nil {
+			t.Fatalf("%s: transcoding: %v", tt.name, err)
+		}
+		if got := stages(eng); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: stages %v, want %v", tt.name, got, tt.want)
+		}
+		var total int64
+		err := filepath.Walk(eng.Cache.Dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				total += info.Size()
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total > eng.Cache.MaxBytes {
+			t.Errorf("%s: cache holds %d bytes after the render, want at most %d", tt.name, total, eng.Cache.MaxBytes)
+		}
+	}
+}
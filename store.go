@@ -0,0 +1,302 @@
+package giffer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GifStore contains rendered gifs, addressed by key.
+type GifStore interface {
+	// Lookup opens the gif stored under key. Reports false if there isn't
+	// one. The caller closes the gif.
+	Lookup(key string) (*RenderedGif, bool, error)
+	// Insert stores the gif under key, replacing any gif already there. The
+	// content is read from the start, and left open.
+	Insert(key string, img *RenderedGif) error
+	// Delete removes the gif stored under key. Deleting a key that isn't
+	// stored is not an error.
+	Delete(key string) error
+	// Keys lists the keys of the stored gifs, in lexical order.
+	Keys() ([]string, error)
+	// List describes the stored gifs, without opening them, ordered
+	// by when they were created.
+	List(opts ListOptions) ([]StoreEntry, error)
+}
+
+// checkKey reports an error if key can't name a stored gif. Keys are job
+// keys, see JobSpec.Key, or other names of letters, digits, '-', '_' and '.'
+// that don't begin with a dot, such as the "key-2" of ConflictKeepBoth. Stores
+// name files after keys, so any other key could name a file outside the store
+// or one of the store's own.
+func checkKey(key string) error {
+	if key == "" || key[0] == '.' {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	for _, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("invalid key %q", key)
+		}
+	}
+	return nil
+}
+
+// RenderedGif is a handle on the gif content, with some metadata. Content is
+// streamed rather than held in memory, since gifs can be large.
+type RenderedGif struct {
+	// Content of the gif, closed with the gif.
+	Content io.ReadSeekCloser
+	// Size of the content in bytes.
+	Size int64
+	// FileName is <title>.<ext>
+	FileName string
+	// Provenance embedded in the gif, if any.
+	Provenance *Provenance
+	// Metadata describing the video the gif was made from.
+	Metadata SourceMetadata
+	// Record of how the gif was rendered, if known.
+	Record *RenderRecord
+	// Tags label the gif, for finding it again.
+	Tags []string
+}
+
+// Close closes the content.
+func (img *RenderedGif) Close() error {
+	if img.Content == nil {
+		return nil
+	}
+	return img.Content.Close()
+}
+
+// RenderRecord describes how a gif was rendered and what came out.
+type RenderRecord struct {
+	Job     JobSpec   `json:"job"`
+	Created time.Time `json:"created"`
+	// Size of the gif in bytes.
+	Size   int64 `json:"size"`
+	Width  int   `json:"width"`
+	Height int   `json:"height"`
+	Frames int   `json:"frames"`
+	// RenderTime is how long the gif took to make, zero if unknown.
+	RenderTime time.Duration `json:"render_time"`
+	// Version of giffer that made the gif.
+	Version string `json:"version"`
+}
+
+// NewRenderRecord records the rendering of the gif read from gif for job,
+// which took elapsed.
+func NewRenderRecord(job JobSpec, gif io.Reader, elapsed time.Duration) *RenderRecord {
+	r := &RenderRecord{
+		Job:        job,
+		Created:    time.Now(),
+		RenderTime: elapsed,
+		Version:    Version,
+	}
+	if r.Job.Format == "" {
+		r.Job.Format = "gif"
+	}
+	// A gif that can't be scanned is recorded without dimensions. Whatever
+	// is left of it after scanning still counts towards its size.
+	counted := &countingReader{r: gif}
+	if info, err := Inspect(counted); err == nil {
+		r.Width = info.Width
+		r.Height = info.Height
+		r.Frames = len(info.Frames)
+	}
+	io.Copy(ioutil.Discard, counted)
+	r.Size = counted.n
+	return r
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// recordProvenance records a gif that was stored without a record, as best
+// it can from the provenance embedded in it.
+func recordProvenance(gif io.Reader, p *Provenance, created time.Time) *RenderRecord {
+	r := NewRenderRecord(JobSpec{}, gif, 0)
+	r.Created = created
+	r.Version = ""
+	if p != nil {
+		r.Job.Source = p.Source
+		r.Job.Start = p.Start
+		r.Job.End = p.End
+		r.Job.FPS = p.FPS
+		r.Version = p.Giffer
+	}
+	return r
+}
+
+// StoreEntry describes a stored gif.
+type StoreEntry struct {
+	Key      string
+	FileName string
+	// Created is when the gif was inserted.
+	Created time.Time
+	// LastUsed is when the gif was last looked up, zero if the store
+	// doesn't keep track.
+	LastUsed time.Time
+	// Size of the gif in bytes.
+	Size int64
+	// Checksum of the gif's content, if the store keeps one.
+	Checksum   string
+	Provenance *Provenance
+	Metadata   SourceMetadata
+	// Record of how the gif was rendered.
+	Record *RenderRecord
+	Tags   []string
+}
+
+// ListOptions paginates and orders a listing.
+type ListOptions struct {
+	// Offset is the number of entries to skip.
+	Offset int
+	// Limit is the maximum number of entries to list, 0 lists them all.
+	Limit int
+	// NewestFirst lists the most recently created entries first. By default
+	// the oldest are first.
+	NewestFirst bool
+}
+
+// Page sorts the entries by creation time, ties broken by key, and returns
+// the page that the options select. Stores that can't order entries
+// themselves list every entry and page through them with this.
+func (opts ListOptions) Page(entries []StoreEntry) []StoreEntry {
+	sort.Slice(entries, func(ii, jj int) bool {
+		a, b := entries[ii], entries[jj]
+		if opts.NewestFirst {
+			a, b = b, a
+		}
+		if !a.Created.Equal(b.Created) {
+			return a.Created.Before(b.Created)
+		}
+		return a.Key < b.Key
+	})
+	if opts.Offset >= len(entries) {
+		return nil
+	}
+	if opts.Offset > 0 {
+		entries = entries[opts.Offset:]
+	}
+	if opts.Limit > 0 && opts.Limit < len(entries) {
+		entries = entries[:opts.Limit]
+	}
+	return entries
+}
+
+// HasTag reports whether the entry is tagged with tag, ignoring case.
+func (e StoreEntry) HasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reasons for evicting a gif.
+const (
+	EvictedExpired = "expired"
+	EvictedCount   = "count"
+	EvictedSize    = "size"
+)
+
+// Eviction describes an evicted gif.
+type Eviction struct {
+	StoreEntry
+	// Reason the gif was evicted, one of the Evicted constants.
+	Reason string
+}
+
+// EvictionReport describes what an eviction removed, and what remains.
+type EvictionReport struct {
+	Evicted []Eviction
+	// Bytes freed by the eviction.
+	Bytes          int64
+	Remaining      int
+	RemainingBytes int64
+}
+
+func (r *EvictionReport) String() string {
+	return fmt.Sprintf("evicted %d gifs (%s), %d remain (%s)",
+		len(r.Evicted), formatBytes(r.Bytes), r.Remaining, formatBytes(r.RemainingBytes))
+}
+
+// SearchStore finds the stored gifs whose source title, author or url
+// contains the query, ignoring case. Newest first.
+func SearchStore(s GifStore, query string) ([]StoreEntry, error) {
+	entries, err := s.List(ListOptions{NewestFirst: true})
+	if err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(query)
+	var found []StoreEntry
+	for _, e := range entries {
+		for _, field := range []string{e.Metadata.Title, e.Metadata.Author, e.Metadata.URL} {
+			if strings.Contains(strings.ToLower(field), query) {
+				found = append(found, e)
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+// OpenStore opens the store that spec describes, so that the store can be
+// chosen by configuration:
+//
+//	memory:                                    a MemoryStore
+//	s3://bucket/prefix?endpoint=URL&region=R   an S3Store
+//	/path/to/dir or file:///path/to/dir        a GifDB
+//
+// S3 credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN. The endpoint defaults to AWS in the region.
+func OpenStore(spec string) (GifStore, error) {
+	if spec == "memory:" {
+		return &MemoryStore{}, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil || !strings.Contains(spec, "://") {
+		return &GifDB{Dir: spec}, nil
+	}
+	switch u.Scheme {
+	case "file":
+		return &GifDB{Dir: filepath.FromSlash(u.Path)}, nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("store %q: missing bucket", spec)
+		}
+		s := &S3Store{
+			Endpoint:     u.Query().Get("endpoint"),
+			Bucket:       u.Host,
+			Prefix:       strings.TrimPrefix(u.Path, "/"),
+			Region:       u.Query().Get("region"),
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if s.Endpoint == "" {
+			s.Endpoint = "https://s3." + s.region() + ".amazonaws.com"
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("store %q: unknown scheme %q, want s3 or file", spec, u.Scheme)
+}
@@ -0,0 +1,472 @@
+package giffer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// S3Store is a GifStore in a bucket of an S3 compatible object store, so that
+// several machines can share their gifs.
+//
+// Each gif is two objects: its metadata, in the same form as GifDB, named by
+// its key, and its content named by its key and checksum. Content is never
+// overwritten, and metadata is replaced conditionally on the version that
+// was read, so that concurrent inserts of a key don't leave metadata pointing
+// at the wrong content.
+type S3Store struct {
+	// Endpoint is the base URL of the service, such as
+	// "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000".
+	// Buckets are addressed by path.
+	Endpoint string
+	Bucket   string
+	// Prefix of the objects within the bucket, such as "gifs/".
+	Prefix string
+	// Region the bucket is in, defaults to "us-east-1".
+	Region string
+	// Credentials to sign requests with. Requests are unsigned without an
+	// access key.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Client to make requests with. Nil uses http.DefaultClient.
+	Client *http.Client
+}
+
+// Lookup downloads the gif stored under key into a temporary file, which is
+// removed when the gif is closed.
+func (s *S3Store) Lookup(key string) (*RenderedGif, bool, error) {
+	md, _, ok, err := s.metadata(key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	content, sum, size, ok, err := s.get(s.gifObject(key, md.Checksum))
+	if err != nil {
+		return nil, false, errors.Wrap(err, "downloading gif")
+	}
+	if !ok {
+		// Deleted or replaced since the metadata was read.
+		return nil, false, nil
+	}
+	if sum != md.Checksum {
+		// Damaged, which is as good as none.
+		content.Close()
+		return nil, false, nil
+	}
+	return md.rendered(content, size), true, nil
+}
+
+// Insert uploads the gif under key. If another insert of the key wins a
+// race with this one, its gif is kept, since gifs of the same key are
+// interchangeable.
+func (s *S3Store) Insert(key string, img *RenderedGif) error {
+	sum, size, err := hashContent(img.Content)
+	if err != nil {
+		return errors.Wrap(err, "reading gif")
+	}
+	md, err := newMetadata(img, sum)
+	if err != nil {
+		return errors.Wrap(err, "reading gif")
+	}
+	gif := s.gifObject(key, sum)
+	data, err := json.Marshal(md)
+	if err != nil {
+		return errors.Wrap(err, "encoding metadata")
+	}
+	prev, etag, exists, err := s.metadata(key)
+	if err != nil {
+		return err
+	}
+	// The content goes first, since the metadata is what makes it visible.
+	// It only fails the condition if it is already there.
+	// The client closes what it sends, which is for the caller to do.
+	content := s3Body{
+		r:    struct{ io.Reader }{img.Content},
+		size: size,
+		sum:  strings.TrimPrefix(sum, "sha256:"),
+	}
+	if _, err := s.put(gif, content, http.Header{"If-None-Match": {"*"}}); err != nil {
+		return errors.Wrap(err, "uploading gif")
+	}
+	condition := http.Header{"If-None-Match": {"*"}}
+	if exists {
+		condition = http.Header{"If-Match": {etag}}
+	}
+	won, err := s.put(s.metaObject(key), s3Bytes(data), condition)
+	if err != nil {
+		return errors.Wrap(err, "uploading metadata")
+	}
+	if !won {
+		// Leave the content to the winner, unless it is the same.
+		winner, _, _, err := s.metadata(key)
+		if err == nil && winner.Checksum != md.Checksum {
+			return s.delete(gif)
+		}
+		return err
+	}
+	if exists && prev.Checksum != md.Checksum {
+		return s.delete(s.gifObject(key, prev.Checksum))
+	}
+	return nil
+}
+
+// Delete removes the gif stored under key.
+func (s *S3Store) Delete(key string) error {
+	md, _, ok, err := s.metadata(key)
+	if err != nil || !ok {
+		return err
+	}
+	if err := s.delete(s.metaObject(key)); err != nil {
+		return err
+	}
+	return s.delete(s.gifObject(key, md.Checksum))
+}
+
+// Keys lists the keys of the stored gifs, found by their metadata objects.
+func (s *S3Store) Keys() ([]string, error) {
+	var (
+		keys   []string
+		prefix = s.prefix()
+		token  string
+	)
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, s3Body{})
+		if err != nil {
+			return nil, errors.Wrap(err, "listing objects")
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "listing objects")
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Wrap(s3Error(resp, body), "listing objects")
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, errors.Wrap(err, "decoding object listing")
+		}
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, prefix)
+			if strings.HasSuffix(name, ".json") && !strings.Contains(name, "/") {
+				keys = append(keys, strings.TrimSuffix(name, ".json"))
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// List downloads the metadata of every gif.
+func (s *S3Store) List(opts ListOptions) ([]StoreEntry, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]StoreEntry, 0, len(keys))
+	for _, key := range keys {
+		md, _, ok, err := s.metadata(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || md.Record == nil {
+			// Deleted since the listing, or not written by a store.
+			continue
+		}
+		entries = append(entries, md.entry(key))
+	}
+	return opts.Page(entries), nil
+}
+
+// metadata downloads the metadata of the gif stored under key, with its
+// ETag. Reports false if there isn't one.
+func (s *S3Store) metadata(key string) (md metadata, etag string, ok bool, err error) {
+	resp, err := s.do(http.MethodGet, s.metaObject(key), nil, nil, s3Body{})
+	if err != nil {
+		return md, "", false, errors.Wrap(err, "downloading metadata")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return md, "", false, errors.Wrap(err, "downloading metadata")
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return md, "", false, nil
+	default:
+		return md, "", false, errors.Wrap(s3Error(resp, body), "downloading metadata")
+	}
+	if err := json.Unmarshal(body, &md); err != nil {
+		return md, "", false, errors.Wrapf(err, "decoding metadata for %s", key)
+	}
+	return md, resp.Header.Get("ETag"), true, nil
+}
+
+// get downloads the object into a temporary file, removed when it is
+// closed, with its checksum and size. Reports false if there isn't one.
+func (s *S3Store) get(name string) (content io.ReadSeekCloser, sum string, size int64, ok bool, err error) {
+	resp, err := s.do(http.MethodGet, name, nil, nil, s3Body{})
+	if err != nil {
+		return nil, "", 0, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, "", 0, false, nil
+	default:
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, "", 0, false, s3Error(resp, body)
+	}
+	content, sum, size, err = spool("", resp.Body)
+	if err != nil {
+		return nil, "", 0, false, err
+	}
+	return content, sum, size, true, nil
+}
+
+// put uploads the object, subject to the conditional headers. Reports false
+// if the condition failed.
+func (s *S3Store) put(name string, body s3Body, header http.Header) (bool, error) {
+	resp, err := s.do(http.MethodPut, name, nil, header, body)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	answer, _ := ioutil.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return true, nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// Conflict is what some services answer to a conditional write that
+		// races another.
+		return false, nil
+	}
+	return false, s3Error(resp, answer)
+}
+
+// delete removes the object, which needn't exist.
+func (s *S3Store) delete(name string) error {
+	resp, err := s.do(http.MethodDelete, name, nil, nil, s3Body{})
+	if err != nil {
+		return errors.Wrap(err, "deleting object")
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return errors.Wrap(s3Error(resp, body), "deleting object")
+}
+
+// s3Body is the payload of a request, with the size and sha256 that it is
+// sent and signed with.
+type s3Body struct {
+	r    io.Reader
+	size int64
+	// sum is the sha256 of the payload, in hex.
+	sum string
+}
+
+// s3Bytes is the payload of data.
+func s3Bytes(data []byte) s3Body {
+	sum := sha256.Sum256(data)
+	return s3Body{
+		r:    bytes.NewReader(data),
+		size: int64(len(data)),
+		sum:  hex.EncodeToString(sum[:]),
+	}
+}
+
+// do makes a request for the named object, relative to the prefix, or for
+// the bucket if name is empty. A zero body sends none.
+func (s *S3Store) do(method, name string, query url.Values, header http.Header, body s3Body) (*http.Response, error) {
+	if body.r == nil {
+		body = s3Bytes(nil)
+	}
+	object := "/" + s.Bucket
+	if name != "" {
+		object += "/" + s.prefix() + name
+	}
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/") + escapeS3(object, false))
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint: %w", err)
+	}
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(context.Background(), method, u.String(), body.r)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = body.size
+	if body.size == 0 {
+		req.Body = http.NoBody
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.AccessKey != "" {
+		s.sign(req, body.sum, time.Now())
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// sign signs the request, whose payload has the sha256 payloadHash in hex,
+// with AWS Signature Version 4.
+func (s *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	var (
+		region  = s.region()
+		amzDate = now.UTC().Format("20060102T150405Z")
+		date    = amzDate[:8]
+		scope   = date + "/" + region + "/s3/aws4_request"
+	)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	// Every x-amz header must be signed, as must the host. Others are left
+	// out, so that proxies may change them.
+	headers := []string{"host"}
+	for k := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			headers = append(headers, k)
+		}
+	}
+	sort.Strings(headers)
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, req.URL.EscapedPath(), req.URL.RawQuery)
+	for _, h := range headers {
+		value := req.URL.Host
+		if h != "host" {
+			value = strings.TrimSpace(req.Header.Get(h))
+		}
+		fmt.Fprintf(&canonical, "%s:%s\n", h, value)
+	}
+	signed := strings.Join(headers, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, payloadHash)
+	hashed := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign)),
+	))
+}
+
+func (s *S3Store) prefix() string {
+	if s.Prefix == "" || strings.HasSuffix(s.Prefix, "/") {
+		return s.Prefix
+	}
+	return s.Prefix + "/"
+}
+
+func (s *S3Store) region() string {
+	if s.Region == "" {
+		return "us-east-1"
+	}
+	return s.Region
+}
+
+// metaObject names the metadata object of the gif stored under key.
+func (s *S3Store) metaObject(key string) string {
+	return key + ".json"
+}
+
+// gifObject names the content object of the gif stored under key. The
+// checksum is part of the name so that content is never overwritten.
+func (s *S3Store) gifObject(key, sum string) string {
+	sum = strings.TrimPrefix(sum, "sha256:")
+	if len(sum) > 16 {
+		sum = sum[:16]
+	}
+	return key + "." + sum + ".gif"
+}
+
+// s3Error describes an unsuccessful response, with the error code from its
+// body if there is one.
+func s3Error(resp *http.Response, body []byte) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	status := resp.Status
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		status = fmt.Sprintf("%s: %s %s", resp.Status, e.Code, e.Message)
+	}
+	return &StatusError{Code: resp.StatusCode, Status: status}
+}
+
+// escapeS3 percent encodes everything but unreserved characters, as
+// signatures require, keeping slashes unless they are to be escaped too.
+func escapeS3(s string, slash bool) string {
+	var b strings.Builder
+	for ii := 0; ii < len(s); ii++ {
+		c := s[ii]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes the query sorted by name, as signatures require.
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, escapeS3(k, true)+"="+escapeS3(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,162 @@
+package giffer_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackmordaunt/giffer"
+	"github.com/jackmordaunt/giffer/giffertest"
+)
+
+// synthetic returns a gif of the given frames, with its content.
+func synthetic(frames int) (*giffer.RenderedGif, []byte) {
+	data := giffertest.SyntheticGIF(frames, 10)
+	return &giffer.RenderedGif{
+		Content:  giffer.BytesContent(data),
+		Size:     int64(len(data)),
+		FileName: fmt.Sprintf("%d.gif", frames),
+	}, data
+}
+
+// content looks up the gif stored under key and returns its content.
+func content(t *testing.T, s giffer.GifStore, key string) []byte {
+	t.Helper()
+	img, ok, err := s.Lookup(key)
+	if err != nil || !ok {
+		t.Fatalf("looking up %s: found %v, error %v", key, ok, err)
+	}
+	defer img.Close()
+	data, err := ioutil.ReadAll(img.Content)
+	if err != nil {
+		t.Fatalf("reading %s: %v", key, err)
+	}
+	return data
+}
+
+func TestS3StoreKeysPaginated(t *testing.T) {
+	service := &giffertest.S3{PageSize: 2}
+	s := s3Store(t, service)
+	var want []string
+	for ii := 0; ii < 7; ii++ {
+		key := fmt.Sprintf("key-%d", ii)
+		img, _ := synthetic(ii + 1)
+		if err := s.Insert(key, img); err != nil {
+			t.Fatalf("inserting %s: %v", key, err)
+		}
+		want = append(want, key)
+	}
+	keys, err := s.Keys()
+	if err != nil {
+		t.Fatalf("keys: %v", err)
+	}
+	if fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+	entries, err := s.List(giffer.ListOptions{Offset: 5})
+	if err != nil {
+		t.Fatalf("listing: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Key != "key-5" || entries[1].Key != "key-6" {
+		t.Errorf("listed %+v, want key-5 and key-6", entries)
+	}
+	if objects := service.Objects(); len(objects) != 14 {
+		t.Errorf("stored %d objects, want 14: %v", len(objects), objects)
+	}
+}
+
+// TestS3StoreInsertRace has a rival insert the key between an insert reading
+// the metadata and writing it, so that the insert's conditional write fails.
+func TestS3StoreInsertRace(t *testing.T) {
+	tests := []struct {
+		name string
+		// prev is the frames of the gif already stored, if any.
+		prev         int
+		mine, rivals int
+	}{
+		{"new", 0, 1, 2},
+		{"replace", 3, 1, 2},
+		{"same content", 0, 1, 1},
+		{"replace with same content", 3, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				service  = &giffertest.S3{}
+				rival    = s3Store(t, service)
+				once     sync.Once
+				raced    bool
+				rivalErr error
+			)
+			race := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conditional := r.Header.Get("If-None-Match") == "*" || r.Header.Get("If-Match") != ""
+				if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/race.json") && conditional {
+					once.Do(func() {
+						raced = true
+						img, _ := synthetic(tt.rivals)
+						rivalErr = rival.Insert("race", img)
+					})
+				}
+				service.ServeHTTP(w, r)
+			})
+			s := s3Store(t, race)
+			if tt.prev > 0 {
+				img, _ := synthetic(tt.prev)
+				if err := rival.Insert("race", img); err != nil {
+					t.Fatalf("inserting the previous gif: %v", err)
+				}
+			}
+			img, _ := synthetic(tt.mine)
+			if err := s.Insert("race", img); err != nil {
+				t.Fatalf("inserting: %v", err)
+			}
+			if !raced || rivalErr != nil {
+				t.Fatalf("the rival raced %v, with error %v", raced, rivalErr)
+			}
+			// The rival's gif is kept, and nothing else.
+			_, want := synthetic(tt.rivals)
+			if got := content(t, s, "race"); !bytes.Equal(got, want) {
+				t.Errorf("stored the losing gif")
+			}
+			if objects := service.Objects(); len(objects) != 2 {
+				t.Errorf("stored objects %v, want the metadata and one gif", objects)
+			}
+		})
+	}
+}
+
+func TestS3StoreConcurrentInserts(t *testing.T) {
+	var (
+		service = &giffertest.S3{}
+		s       = s3Store(t, service)
+		wg      sync.WaitGroup
+		errs    = make(chan error, 8)
+	)
+	for ii := 0; ii < 8; ii++ {
+		wg.Add(1)
+		go func(frames int) {
+			defer wg.Done()
+			img, _ := synthetic(frames)
+			errs <- s.Insert("race", img)
+		}(ii + 1)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("inserting: %v", err)
+		}
+	}
+	img, ok, err := s.Lookup("race")
+	if err != nil || !ok {
+		t.Fatalf("looking up: found %v, error %v", ok, err)
+	}
+	defer img.Close()
+	if objects := service.Objects(); len(objects) != 2 {
+		t.Errorf("stored objects %v, want the metadata and one gif", objects)
+	}
+}
@@ -0,0 +1,53 @@
+package giffer_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jackmordaunt/giffer"
+	"github.com/jackmordaunt/giffer/giffertest"
+)
+
+// s3Store returns an S3Store backed by the service, usually a giffertest.S3,
+// which is closed with the test.
+func s3Store(t *testing.T, service http.Handler) *giffer.S3Store {
+	t.Helper()
+	srv := httptest.NewServer(service)
+	t.Cleanup(srv.Close)
+	return &giffer.S3Store{
+		Endpoint:  srv.URL,
+		Bucket:    "gifs",
+		Prefix:    "test/",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Client:    srv.Client(),
+	}
+}
+
+func TestStore(t *testing.T) {
+	tests := []struct {
+		name  string
+		store func(t *testing.T) giffer.GifStore
+	}{
+		{"memory", func(t *testing.T) giffer.GifStore {
+			return &giffer.MemoryStore{}
+		}},
+		{"gifdb", func(t *testing.T) giffer.GifStore {
+			return &giffer.GifDB{Dir: t.TempDir()}
+		}},
+		{"s3", func(t *testing.T) giffer.GifStore {
+			return s3Store(t, &giffertest.S3{})
+		}},
+		{"s3 paginated", func(t *testing.T) giffer.GifStore {
+			return s3Store(t, &giffertest.S3{PageSize: 1})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := giffertest.TestStore(tt.store(t)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
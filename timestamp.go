@@ -0,0 +1,181 @@
+package giffer
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// timestampHosts are the sites whose t, start and end query parameters are
+// timestamps. Other sites may use those names for something else.
+var timestampHosts = []string{
+	"youtube.com",
+	"youtu.be",
+	"youtube-nocookie.com",
+	"twitch.tv",
+	"vimeo.com",
+}
+
+// URLTimes finds the time that a link to a video points at, in seconds.
+// Recognises the t, start and end query parameters of sites that use them,
+// eg "?t=95" or "&t=1m35s", and media fragments such as "#t=95" or
+// "#t=1:35,1:40". End is 0 if the link only has a start.
+func URLTimes(rawURL string) (start, end float64, ok bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || isLocalPath(rawURL, u) {
+		return 0, 0, false
+	}
+	if timestampHost(u.Hostname()) {
+		q := u.Query()
+		if t := q.Get("t"); t != "" {
+			start, err = parseTimestamp(t)
+			ok = err == nil
+		} else if s := q.Get("start"); s != "" {
+			start, err = parseTimestamp(s)
+			ok = err == nil
+		}
+		if e := q.Get("end"); e != "" && ok {
+			if end, err = parseTimestamp(e); err != nil {
+				end = 0
+			}
+		}
+		if ok {
+			return start, end, true
+		}
+	}
+	if t, found := fragmentTime(u.Fragment); found {
+		// Media fragments are "t=start" or "t=start,end", with an optional
+		// "npt:" prefix.
+		t = strings.TrimPrefix(t, "npt:")
+		from, to := t, ""
+		if comma := strings.IndexByte(t, ','); comma >= 0 {
+			from, to = t[:comma], t[comma+1:]
+		}
+		if start, err = parseTimestamp(from); err != nil {
+			return 0, 0, false
+		}
+		if to != "" {
+			if end, err = parseTimestamp(to); err != nil {
+				end = 0
+			}
+		}
+		return start, end, true
+	}
+	return 0, 0, false
+}
+
+// NormalizeURL removes the timestamps recognised by URLTimes, so that links to
+// different moments of a video are the same URL.
+func NormalizeURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || isLocalPath(rawURL, u) {
+		return rawURL
+	}
+	if timestampHost(u.Hostname()) {
+		var (
+			q       = u.Query()
+			changed = false
+		)
+		for _, key := range []string{"t", "start", "end"} {
+			if _, ok := q[key]; ok {
+				q.Del(key)
+				changed = true
+			}
+		}
+		// Encoding sorts the parameters, so leave the query alone unless
+		// it changed.
+		if changed {
+			u.RawQuery = q.Encode()
+		}
+	}
+	if _, found := fragmentTime(u.Fragment); found {
+		u.Fragment = ""
+		u.RawFragment = ""
+	}
+	return u.String()
+}
+
+// fragmentTime finds the value of the t parameter within a fragment, which
+// can hold several "&" separated parameters.
+func fragmentTime(fragment string) (string, bool) {
+	for _, param := range strings.Split(fragment, "&") {
+		if strings.HasPrefix(param, "t=") {
+			return strings.TrimPrefix(param, "t="), true
+		}
+	}
+	return "", false
+}
+
+func timestampHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range timestampHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTimestamp parses a time in seconds, such as "95", "95.5s", "1m35s",
+// "1h2m3s", "1:35" or "1:02:03".
+func parseTimestamp(s string) (float64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty timestamp")
+	}
+	if strings.Contains(s, ":") {
+		var seconds float64
+		for _, part := range strings.Split(s, ":") {
+			v, err := parseSeconds(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid timestamp %q", s)
+			}
+			seconds = seconds*60 + v
+		}
+		return seconds, nil
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		v, err := parseSeconds(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		return v, nil
+	}
+	var (
+		seconds float64
+		rest    = strings.ToLower(s)
+	)
+	for _, unit := range []struct {
+		suffix string
+		scale  float64
+	}{{"h", 3600}, {"m", 60}, {"s", 1}} {
+		ii := strings.Index(rest, unit.suffix)
+		if ii < 0 {
+			continue
+		}
+		v, err := parseSeconds(rest[:ii])
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		seconds += v * unit.scale
+		rest = rest[ii+1:]
+	}
+	if rest != "" {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return seconds, nil
+}
+
+// parseSeconds parses a single number of a timestamp, which has to be finite
+// and not negative.
+func parseSeconds(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+		return 0, fmt.Errorf("out of range: %q", s)
+	}
+	return v, nil
+}
@@ -0,0 +1,79 @@
+package giffer
+
+import "testing"
+
+func TestURLTimes(t *testing.T) {
+	tests := []struct {
+		url        string
+		start, end float64
+		ok         bool
+	}{
+		{"https://www.youtube.com/watch?v=abc&t=95", 95, 0, true},
+		{"https://www.youtube.com/watch?v=abc&t=95s", 95, 0, true},
+		{"https://www.youtube.com/watch?v=abc&t=1m2s", 62, 0, true},
+		{"https://www.youtube.com/watch?v=abc&t=1h2m3s", 3723, 0, true},
+		{"https://www.youtube.com/watch?v=abc&t=1m", 60, 0, true},
+		{"https://www.youtube.com/watch?v=abc&t=2.5", 2.5, 0, true},
+		{"https://youtu.be/abc?t=42", 42, 0, true},
+		{"https://m.youtube.com/watch?v=abc&t=42", 42, 0, true},
+		{"https://www.youtube.com/embed/abc?start=10&end=20", 10, 20, true},
+		{"https://www.youtube.com/embed/abc?start=10&end=bad", 10, 0, true},
+		{"https://www.youtube.com/watch?v=abc", 0, 0, false},
+		{"https://example.com/video.mp4?t=95", 0, 0, false},
+		{"https://example.com/video.mp4#t=95", 95, 0, true},
+		{"https://example.com/video.mp4#t=1:35,1:40", 95, 100, true},
+		{"https://example.com/video.mp4#t=npt:10,20.5", 10, 20.5, true},
+		{"https://example.com/video.mp4#a=b&t=1:02:03", 3723, 0, true},
+		{"https://example.com/video.mp4#t=10,bad", 10, 0, true},
+		{"https://example.com/video.mp4#top", 0, 0, false},
+		{"/videos/movie.mp4#t=10", 0, 0, false},
+		{"https://youtu.be/abc?t=NaN", 0, 0, false},
+		{"https://youtu.be/abc?t=nans", 0, 0, false},
+		{"https://youtu.be/abc?t=Inf", 0, 0, false},
+		{"https://youtu.be/abc?t=-Inf", 0, 0, false},
+		{"https://youtu.be/abc?t=infm", 0, 0, false},
+		{"https://youtu.be/abc?t=1e400", 0, 0, false},
+		{"https://youtu.be/abc?t=-5", 0, 0, false},
+		{"https://youtu.be/abc?t=-1m", 0, 0, false},
+		{"https://youtu.be/abc?t=1s2m", 0, 0, false},
+		{"https://youtu.be/abc?t=10&end=NaN", 10, 0, true},
+		{"https://example.com/video.mp4#t=-1:00", 0, 0, false},
+		{"https://example.com/video.mp4#t=1:nan", 0, 0, false},
+		{"https://example.com/video.mp4#t=inf", 0, 0, false},
+		{"https://example.com/video.mp4#t=10,inf", 10, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			start, end, ok := URLTimes(tt.url)
+			if start != tt.start || end != tt.end || ok != tt.ok {
+				t.Errorf("URLTimes() = %v, %v, %v, want %v, %v, %v", start, end, ok, tt.start, tt.end, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"https://www.youtube.com/watch?v=abc&t=95", "https://www.youtube.com/watch?v=abc"},
+		{"https://www.youtube.com/watch?v=abc&t=1m2s", "https://www.youtube.com/watch?v=abc"},
+		{"https://youtu.be/abc?t=42", "https://youtu.be/abc"},
+		{"https://www.youtube.com/embed/abc?start=10&end=20", "https://www.youtube.com/embed/abc"},
+		{"https://www.youtube.com/watch?v=abc&list=xyz", "https://www.youtube.com/watch?v=abc&list=xyz"},
+		{"https://www.youtube.com/watch?v=abc&t=5&list=xyz", "https://www.youtube.com/watch?list=xyz&v=abc"},
+		{"https://example.com/video.mp4?t=95", "https://example.com/video.mp4?t=95"},
+		{"https://example.com/video.mp4#t=95", "https://example.com/video.mp4"},
+		{"https://example.com/video.mp4#t=1:35,1:40", "https://example.com/video.mp4"},
+		{"https://example.com/video.mp4#top", "https://example.com/video.mp4#top"},
+		{"/videos/movie.mp4#t=10", "/videos/movie.mp4#t=10"},
+		{"C:\\videos\\movie.mp4", "C:\\videos\\movie.mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if got := NormalizeURL(tt.url); got != tt.want {
+				t.Errorf("NormalizeURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
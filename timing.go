@@ -0,0 +1,51 @@
+package giffer
+
+import (
+	"math"
+	"time"
+)
+
+// minDelay is the shortest frame delay, in hundredths of a second, that
+// players honour. See DelayDuration.
+const minDelay = 2
+
+// Delays returns the delay of each of n frames played back at fps, in the
+// hundredths of a second that GIF uses.
+//
+// Most frame rates aren't a whole number of centiseconds (24fps is 4.1666cs a
+// frame), so rounding every frame the same way makes the animation drift.
+// Instead each frame ends on the rounded ideal timestamp, which carries the
+// rounding error forward and keeps the total duration within half a
+// centisecond of n/fps.
+//
+// No frame is shorter than minDelay, since players slow shorter frames down
+// to 10cs. Above 50fps the gif therefore plays at 50fps, as close as it can.
+func Delays(fps float64, n int) []int {
+	if fps <= 0 || n <= 0 {
+		return nil
+	}
+	var (
+		delays  = make([]int, n)
+		elapsed = 0
+	)
+	for ii := range delays {
+		next := int(math.Round(float64(ii+1) * 100 / fps))
+		delay := next - elapsed
+		if delay < minDelay {
+			// The frame overruns, and the frames after it catch up.
+			delay = minDelay
+		}
+		delays[ii] = delay
+		elapsed += delay
+	}
+	return delays
+}
+
+// DelayDuration converts a GIF frame delay into a duration.
+// Delays of 0 or 1 are treated as 10, which is how browsers play them.
+func DelayDuration(delay int) time.Duration {
+	if delay <= 1 {
+		delay = 10
+	}
+	return time.Duration(delay) * 10 * time.Millisecond
+}
@@ -0,0 +1,123 @@
+package giffer
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDelays(t *testing.T) {
+	tests := []struct {
+		name string
+		fps  float64
+		n    int
+		want []int
+	}{
+		{"whole centiseconds", 10, 4, []int{10, 10, 10, 10}},
+		{"24fps", 24, 6, []int{4, 4, 5, 4, 4, 4}},
+		{"30fps", 30, 3, []int{3, 4, 3}},
+		{"50fps", 50, 4, []int{2, 2, 2, 2}},
+		{"60fps", 60, 4, []int{2, 2, 2, 2}},
+		{"100fps", 100, 3, []int{2, 2, 2}},
+		{"no frames", 24, 0, nil},
+		{"no fps", 0, 3, nil},
+		{"negative fps", -24, 3, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Delays(tt.fps, tt.n); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Delays(%v, %d) = %v, want %v", tt.fps, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDelaysSum(t *testing.T) {
+	// A second of frames takes a second, whatever the rate.
+	for _, fps := range []float64{10, 12, 15, 23.976, 24, 25, 29.97, 30, 45, 50} {
+		n := int(math.Round(fps))
+		sum := 0
+		for _, d := range Delays(fps, n) {
+			sum += d
+		}
+		want := int(math.Round(float64(n) * 100 / fps))
+		if sum != want {
+			t.Errorf("%vfps: %d frames sum to %dcs, want %dcs", fps, n, sum, want)
+		}
+	}
+	sum := 0
+	for _, d := range Delays(24, 24) {
+		sum += d
+	}
+	if sum != 100 {
+		t.Errorf("24fps: one second of frames sums to %dcs, want 100cs", sum)
+	}
+}
+
+func TestDelaysDrift(t *testing.T) {
+	// Each frame ends within half a centisecond of its ideal timestamp, so the
+	// error doesn't accumulate however long the animation.
+	for _, fps := range []float64{7, 24, 29.97, 33, 47.952, 50} {
+		var (
+			delays  = Delays(fps, 10000)
+			elapsed = 0
+		)
+		for ii, d := range delays {
+			if d < 0 {
+				t.Fatalf("%vfps: frame %d has negative delay %d", fps, ii, d)
+			}
+			elapsed += d
+			ideal := float64(ii+1) * 100 / fps
+			if drift := math.Abs(float64(elapsed) - ideal); drift > 0.5 {
+				t.Fatalf("%vfps: frame %d ends at %dcs, %.2fcs from %.2fcs", fps, ii, elapsed, drift, ideal)
+			}
+		}
+	}
+}
+
+func TestDelaysFast(t *testing.T) {
+	// Faster than 50fps, frames play at 50fps rather than being slowed to
+	// 10cs each, so a second of frames takes at most 1.2s at 60fps.
+	for _, tt := range []struct {
+		fps float64
+		max float64
+	}{
+		{50, 1},
+		{60, 1.2},
+	} {
+		var (
+			n     = int(tt.fps) * 10
+			total time.Duration
+		)
+		for _, d := range Delays(tt.fps, n) {
+			if d < 2 {
+				t.Fatalf("%vfps: delay %d plays as 10cs", tt.fps, d)
+			}
+			total += DelayDuration(d)
+		}
+		want := time.Duration(float64(n) / tt.fps * float64(time.Second))
+		if limit := time.Duration(tt.max * float64(want)); total < want || total > limit {
+			t.Errorf("%vfps: %d frames play for %v, want %v to %v", tt.fps, n, total, want, limit)
+		}
+	}
+}
+
+func TestDelayDuration(t *testing.T) {
+	tests := []struct {
+		delay int
+		want  time.Duration
+	}{
+		{-1, 100 * time.Millisecond},
+		{0, 100 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{4, 40 * time.Millisecond},
+		{100, time.Second},
+	}
+	for _, tt := range tests {
+		if got := DelayDuration(tt.delay); got != tt.want {
+			t.Errorf("DelayDuration(%d) = %v, want %v", tt.delay, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package giffer
+
+import "runtime/debug"
+
+// Version of giffer. Release builds can set it with
+// -ldflags "-X github.com/jackmordaunt/giffer.Version=<version>", otherwise
+// it is taken from the module build info.
+var Version = func() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/jackmordaunt/giffer" {
+				return dep.Version
+			}
+		}
+		if info.Main.Path == "github.com/jackmordaunt/giffer" && info.Main.Version != "" {
+			return info.Main.Version
+		}
+	}
+	return "(devel)"
+}()
@@ -0,0 +1,139 @@
+package y4m
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+)
+
+// FrameFunc renders the nth frame of a synthetic clip.
+type FrameFunc func(n int) image.Image
+
+// Generate writes frames [0, count) of f as a Y4M stream described by h.
+func Generate(w io.Writer, h Header, count int, f FrameFunc) error {
+	enc, err := NewWriter(w, h)
+	if err != nil {
+		return err
+	}
+	for n := 0; n < count; n++ {
+		if err := enc.WriteFrame(f(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gradient renders a diagonal gradient that moves speed pixels each frame.
+func Gradient(width, height, speed int) FrameFunc {
+	return func(n int) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				v := x + y + n*speed
+				img.Set(x, y, color.RGBA{
+					R: uint8(v),
+					G: uint8(v * 2),
+					B: uint8(255 - v),
+					A: 255,
+				})
+			}
+		}
+		return img
+	}
+}
+
+// SceneCuts cycles through scenes, cutting to the next scene every length
+// frames. Each scene is rendered from its own frame numbering, starting at 0.
+func SceneCuts(length int, scenes ...FrameFunc) FrameFunc {
+	return func(n int) image.Image {
+		scene := (n / length) % len(scenes)
+		return scenes[scene](n % length)
+	}
+}
+
+// Solid renders every frame as a single color.
+func Solid(width, height int, c color.Color) FrameFunc {
+	return func(int) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(img, img.Bounds(), &image.Uniform{C: c}, image.Point{}, draw.Src)
+		return img
+	}
+}
+
+// Counter draws the frame number in the top left corner of each frame of f.
+// Digits are drawn at scale times the size of a 3x5 pixel font.
+func Counter(f FrameFunc, scale int) FrameFunc {
+	if scale < 1 {
+		scale = 1
+	}
+	return func(n int) image.Image {
+		var (
+			src = f(n)
+			b   = src.Bounds()
+			img = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				img.Set(x, y, src.At(b.Min.X+x, b.Min.Y+y))
+			}
+		}
+		drawNumber(img, n, scale)
+		return img
+	}
+}
+
+// digits is a 3x5 pixel font for 0-9, one row per entry, most significant
+// bit on the left.
+var digits = [10][5]uint8{
+	{7, 5, 5, 5, 7},
+	{2, 6, 2, 2, 7},
+	{7, 1, 7, 4, 7},
+	{7, 1, 7, 1, 7},
+	{5, 5, 7, 1, 1},
+	{7, 4, 7, 1, 7},
+	{7, 4, 7, 5, 7},
+	{7, 1, 1, 1, 1},
+	{7, 5, 7, 5, 7},
+	{7, 5, 7, 1, 7},
+}
+
+// drawNumber draws white digits on a black background so the number is
+// legible over any content.
+func drawNumber(img *image.RGBA, n, scale int) {
+	var s []int
+	for {
+		s = append([]int{n % 10}, s...)
+		n /= 10
+		if n == 0 {
+			break
+		}
+	}
+	var (
+		pad  = scale
+		w, h = (len(s)*4 + 1) * scale, 7 * scale
+	)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.Black)
+		}
+	}
+	for ii, d := range s {
+		for row := 0; row < 5; row++ {
+			for col := 0; col < 3; col++ {
+				if digits[d][row]&(4>>col) == 0 {
+					continue
+				}
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						img.Set(
+							pad+(ii*4+col)*scale+dx,
+							pad+row*scale+dy,
+							color.White,
+						)
+					}
+				}
+			}
+		}
+	}
+}
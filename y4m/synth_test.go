@@ -0,0 +1,137 @@
+package y4m
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// decode generates count frames of f through a y4m stream and reads them
+// back, so that the checks below see what a pipeline would.
+func decode(t *testing.T, f FrameFunc, width, height, count int) []image.Image {
+	t.Helper()
+	var (
+		buf bytes.Buffer
+		h   = Header{Width: width, Height: height, Rate: Ratio{24, 1}, ColorSpace: "444"}
+	)
+	if err := Generate(&buf, h, count, f); err != nil {
+		t.Fatalf("generating: %v", err)
+	}
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []image.Image
+	for {
+		img, err := r.Next()
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, img)
+	}
+}
+
+// difference is the mean absolute difference in luma between two frames,
+// from 0 to 255.
+func difference(a, b image.Image) float64 {
+	var (
+		bounds = a.Bounds()
+		sum    int
+	)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ya := color.GrayModel.Convert(a.At(x, y)).(color.Gray).Y
+			yb := color.GrayModel.Convert(b.At(x, y)).(color.Gray).Y
+			if ya > yb {
+				sum += int(ya - yb)
+			} else {
+				sum += int(yb - ya)
+			}
+		}
+	}
+	return float64(sum) / float64(bounds.Dx()*bounds.Dy())
+}
+
+// scenes returns the frames that begin a new scene, being much different to
+// the frame before.
+func scenes(frames []image.Image, threshold float64) []int {
+	var cuts []int
+	for ii := 1; ii < len(frames); ii++ {
+		if difference(frames[ii-1], frames[ii]) > threshold {
+			cuts = append(cuts, ii)
+		}
+	}
+	return cuts
+}
+
+// loop returns the shortest period after which the frames repeat exactly,
+// or 0 if they don't.
+func loop(frames []image.Image) int {
+	for p := 1; p < len(frames); p++ {
+		repeats := true
+		for ii := p; ii < len(frames) && repeats; ii++ {
+			repeats = difference(frames[ii], frames[ii-p]) == 0
+		}
+		if repeats {
+			return p
+		}
+	}
+	return 0
+}
+
+func TestSceneCuts(t *testing.T) {
+	const width, height = 16, 16
+	clip := SceneCuts(5,
+		Gradient(width, height, 1),
+		Solid(width, height, color.White),
+		Solid(width, height, color.RGBA{R: 40, A: 255}),
+	)
+	frames := decode(t, clip, width, height, 20)
+	if got, want := scenes(frames, 20), []int{5, 10, 15}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scenes begin at %v, want %v", got, want)
+	}
+}
+
+func TestGradientLoops(t *testing.T) {
+	const width, height = 8, 8
+	// The gradient wraps every 256 pixels, so moving 32 pixels a frame
+	// repeats after 8 frames.
+	frames := decode(t, Gradient(width, height, 32), width, height, 24)
+	if p := loop(frames); p != 8 {
+		t.Errorf("gradient loops every %d frames, want 8", p)
+	}
+	if cuts := scenes(frames[:8], 100); len(cuts) > 1 {
+		t.Errorf("a moving gradient has scene cuts at %v", cuts)
+	}
+	// Numbering the frames makes each one unique.
+	frames = decode(t, Counter(Gradient(width*4, height*2, 32), 1), width*4, height*2, 24)
+	if p := loop(frames); p != 0 {
+		t.Errorf("counted frames loop every %d frames", p)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	const width, height = 20, 9
+	frames := decode(t, Counter(Solid(width, height, color.Black), 1), width, height, 12)
+	// Each frame shows its own number, so frames with the same number of
+	// digits only differ where the digits do.
+	for ii := 1; ii < len(frames); ii++ {
+		if difference(frames[ii-1], frames[ii]) == 0 {
+			t.Errorf("frames %d and %d are the same", ii-1, ii)
+		}
+	}
+	// Digits are white, drawn from one scaled pixel in from the corner.
+	// Frame 1 draws a "1", whose top row is only its middle pixel.
+	img := frames[1]
+	for x, want := range []uint8{0, 0, 255, 0, 0} {
+		if got := color.GrayModel.Convert(img.At(x, 1)).(color.Gray).Y; got != want {
+			t.Errorf("frame 1 (%d, 1) = %d, want %d", x, got, want)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Package y4m reads and writes YUV4MPEG2 streams.
+//
+// Y4M is raw, uncompressed video with a small text header, which makes it a
+// convenient interchange format for pure Go pipelines: no codec is needed to
+// produce or consume it, and FFmpeg reads and writes it natively.
+package y4m
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	magic      = "YUV4MPEG2"
+	frameMagic = "FRAME"
+)
+
+// Header describes the stream.
+type Header struct {
+	Width  int
+	Height int
+	// Rate is the frame rate as a fraction, eg 30000:1001.
+	Rate Ratio
+	// Interlace is one of 'p' (progressive), 't', 'b' or 'm'.
+	Interlace byte
+	// Aspect is the pixel aspect ratio. Zero if unknown.
+	Aspect Ratio
+	// ColorSpace such as "420jpeg", "422", "444" or "mono".
+	// Empty means "420jpeg".
+	ColorSpace string
+	// Extra holds X parameters verbatim, without the leading 'X'.
+	Extra []string
+}
+
+// Ratio is a fraction.
+type Ratio struct {
+	Num, Den int
+}
+
+// Float converts the ratio to a float, 0 if the denominator is 0.
+func (r Ratio) Float() float64 {
+	if r.Den == 0 {
+		return 0
+	}
+	return float64(r.Num) / float64(r.Den)
+}
+
+func (r Ratio) String() string {
+	return fmt.Sprintf("%d:%d", r.Num, r.Den)
+}
+
+// FPS returns the frame rate.
+func (h Header) FPS() float64 {
+	return h.Rate.Float()
+}
+
+// subsample maps the color space to the equivalent image.YCbCr ratio.
+// Mono streams report ok == false.
+func (h Header) subsample() (ratio image.YCbCrSubsampleRatio, ok bool, err error) {
+	switch h.ColorSpace {
+	case "", "420", "420jpeg", "420paldv", "420mpeg2":
+		return image.YCbCrSubsampleRatio420, true, nil
+	case "422":
+		return image.YCbCrSubsampleRatio422, true, nil
+	case "444":
+		return image.YCbCrSubsampleRatio444, true, nil
+	case "mono":
+		return 0, false, nil
+	default:
+		return 0, false, fmt.Errorf("unsupported color space %q", h.ColorSpace)
+	}
+}
+
+// frameSize is the number of bytes in each frame's planes.
+func (h Header) frameSize() (int, error) {
+	ratio, chroma, err := h.subsample()
+	if err != nil {
+		return 0, err
+	}
+	if !chroma {
+		return h.Width * h.Height, nil
+	}
+	img := image.NewYCbCr(image.Rect(0, 0, h.Width, h.Height), ratio)
+	return len(img.Y) + len(img.Cb) + len(img.Cr), nil
+}
+
+func (h Header) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s W%d H%d F%s", magic, h.Width, h.Height, h.Rate)
+	if h.Interlace != 0 {
+		fmt.Fprintf(&b, " I%c", h.Interlace)
+	}
+	if h.Aspect != (Ratio{}) {
+		fmt.Fprintf(&b, " A%s", h.Aspect)
+	}
+	if h.ColorSpace != "" {
+		fmt.Fprintf(&b, " C%s", h.ColorSpace)
+	}
+	for _, x := range h.Extra {
+		fmt.Fprintf(&b, " X%s", x)
+	}
+	return b.String()
+}
+
+// ParseHeader parses a stream header line, without the trailing newline.
+func ParseHeader(line string) (Header, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != magic {
+		return Header{}, fmt.Errorf("not a y4m stream")
+	}
+	var h Header
+	for _, f := range fields[1:] {
+		var (
+			tag, value = f[0], f[1:]
+			err        error
+		)
+		switch tag {
+		case 'W':
+			h.Width, err = strconv.Atoi(value)
+		case 'H':
+			h.Height, err = strconv.Atoi(value)
+		case 'F':
+			h.Rate, err = parseRatio(value)
+		case 'I':
+			if len(value) > 0 {
+				h.Interlace = value[0]
+			}
+		case 'A':
+			h.Aspect, err = parseRatio(value)
+		case 'C':
+			h.ColorSpace = value
+		case 'X':
+			h.Extra = append(h.Extra, value)
+		}
+		if err != nil {
+			return Header{}, fmt.Errorf("parsing %q: %w", f, err)
+		}
+	}
+	if h.Width <= 0 || h.Height <= 0 {
+		return Header{}, fmt.Errorf("invalid dimensions %dx%d", h.Width, h.Height)
+	}
+	if _, _, err := h.subsample(); err != nil {
+		return Header{}, err
+	}
+	return h, nil
+}
+
+func parseRatio(s string) (Ratio, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return Ratio{}, fmt.Errorf("expected n:d")
+	}
+	num, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Ratio{}, err
+	}
+	den, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Ratio{}, err
+	}
+	return Ratio{Num: num, Den: den}, nil
+}
+
+// Reader decodes frames from a Y4M stream.
+type Reader struct {
+	Header Header
+	r      *bufio.Reader
+	size   int
+}
+
+// NewReader reads the stream header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	h, err := ParseHeader(strings.TrimSuffix(line, "\n"))
+	if err != nil {
+		return nil, err
+	}
+	size, err := h.frameSize()
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{Header: h, r: br, size: size}, nil
+}
+
+// Next decodes the next frame. Frames are *image.YCbCr, or *image.Gray for
+// mono streams. Returns io.EOF after the last frame.
+func (r *Reader) Next() (image.Image, error) {
+	line, err := r.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading frame header: %w", err)
+	}
+	if !strings.HasPrefix(line, frameMagic) {
+		return nil, fmt.Errorf("expected frame header, got %q", line)
+	}
+	buf := make([]byte, r.size)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, fmt.Errorf("reading frame: %w", err)
+	}
+	var (
+		h    = r.Header
+		rect = image.Rect(0, 0, h.Width, h.Height)
+	)
+	ratio, chroma, _ := h.subsample()
+	if !chroma {
+		return &image.Gray{Pix: buf, Stride: h.Width, Rect: rect}, nil
+	}
+	img := image.NewYCbCr(rect, ratio)
+	n := copy(img.Y, buf)
+	n += copy(img.Cb, buf[n:])
+	copy(img.Cr, buf[n:])
+	return img, nil
+}
+
+// Writer encodes frames into a Y4M stream.
+type Writer struct {
+	Header Header
+	w      io.Writer
+}
+
+// NewWriter writes the header for a stream described by h.
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	if h.Width <= 0 || h.Height <= 0 {
+		return nil, fmt.Errorf("invalid dimensions %dx%d", h.Width, h.Height)
+	}
+	if h.Rate.Den == 0 {
+		return nil, fmt.Errorf("invalid frame rate %s", h.Rate)
+	}
+	if h.Interlace == 0 {
+		h.Interlace = 'p'
+	}
+	if _, _, err := h.subsample(); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, h.String()+"\n"); err != nil {
+		return nil, fmt.Errorf("writing header: %w", err)
+	}
+	return &Writer{Header: h, w: w}, nil
+}
+
+// WriteFrame converts img to the stream's color space and writes it.
+// Images smaller than the stream are padded with black, larger ones cropped.
+func (w *Writer) WriteFrame(img image.Image) error {
+	var buf bytes.Buffer
+	buf.WriteString(frameMagic + "\n")
+	var (
+		h    = w.Header
+		rect = image.Rect(0, 0, h.Width, h.Height)
+	)
+	ratio, chroma, _ := h.subsample()
+	if !chroma {
+		gray := image.NewGray(rect)
+		for y := 0; y < h.Height; y++ {
+			for x := 0; x < h.Width; x++ {
+				gray.Set(x, y, at(img, x, y))
+			}
+		}
+		buf.Write(gray.Pix)
+	} else {
+		ycc := toYCbCr(img, rect, ratio)
+		buf.Write(ycc.Y)
+		buf.Write(ycc.Cb)
+		buf.Write(ycc.Cr)
+	}
+	_, err := w.w.Write(buf.Bytes())
+	return err
+}
+
+// at returns the color of img at x, y relative to its origin, or black
+// outside of its bounds.
+func at(img image.Image, x, y int) color.Color {
+	b := img.Bounds()
+	p := image.Pt(b.Min.X+x, b.Min.Y+y)
+	if !p.In(b) {
+		return color.Black
+	}
+	return img.At(p.X, p.Y)
+}
+
+// toYCbCr converts img to planar YCbCr, averaging chroma across each
+// subsampled block.
+func toYCbCr(img image.Image, rect image.Rectangle, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	if src, ok := img.(*image.YCbCr); ok &&
+		src.SubsampleRatio == ratio &&
+		src.Rect == rect {
+		return src
+	}
+	var (
+		out    = image.NewYCbCr(rect, ratio)
+		cb, cr = make([]int, len(out.Cb)), make([]int, len(out.Cr))
+		n      = make([]int, len(out.Cb))
+	)
+	for y := 0; y < rect.Dy(); y++ {
+		for x := 0; x < rect.Dx(); x++ {
+			r, g, b, _ := at(img, x, y).RGBA()
+			yy, u, v := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			out.Y[out.YOffset(x, y)] = yy
+			c := out.COffset(x, y)
+			cb[c] += int(u)
+			cr[c] += int(v)
+			n[c]++
+		}
+	}
+	for ii := range n {
+		if n[ii] > 0 {
+			out.Cb[ii] = uint8(cb[ii] / n[ii])
+			out.Cr[ii] = uint8(cr[ii] / n[ii])
+		}
+	}
+	return out
+}
@@ -0,0 +1,206 @@
+package y4m
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	tests := []struct {
+		line string
+		want Header
+	}{
+		{
+			"YUV4MPEG2 W320 H240 F30000:1001",
+			Header{Width: 320, Height: 240, Rate: Ratio{30000, 1001}},
+		},
+		{
+			"YUV4MPEG2 W2 H2 F25:1 Ip A1:1 C444 XYSCSS=444 XCOLORRANGE=FULL",
+			Header{
+				Width:      2,
+				Height:     2,
+				Rate:       Ratio{25, 1},
+				Interlace:  'p',
+				Aspect:     Ratio{1, 1},
+				ColorSpace: "444",
+				Extra:      []string{"YSCSS=444", "COLORRANGE=FULL"},
+			},
+		},
+		{
+			"YUV4MPEG2 W16 H8 F10:1 Cmono",
+			Header{Width: 16, Height: 8, Rate: Ratio{10, 1}, ColorSpace: "mono"},
+		},
+	}
+	for _, tt := range tests {
+		h, err := ParseHeader(tt.line)
+		if err != nil {
+			t.Errorf("ParseHeader(%q): %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(h, tt.want) {
+			t.Errorf("ParseHeader(%q) = %+v, want %+v", tt.line, h, tt.want)
+		}
+		if s := h.String(); s != tt.line {
+			t.Errorf("String() = %q, want %q", s, tt.line)
+		}
+	}
+	for _, line := range []string{
+		"",
+		"YUV4MPEG W2 H2 F1:1",
+		"YUV4MPEG2 W0 H2 F1:1",
+		"YUV4MPEG2 W2 F1:1",
+		"YUV4MPEG2 W2 H2 F1",
+		"YUV4MPEG2 W2 H2 Fx:1",
+		"YUV4MPEG2 W2 H2 F1:1 C411",
+	} {
+		if h, err := ParseHeader(line); err == nil {
+			t.Errorf("ParseHeader(%q) = %+v, want an error", line, h)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	const (
+		width, height = 13, 7
+		count         = 5
+	)
+	frames := Counter(Gradient(width, height, 9), 1)
+	for _, cs := range []string{"", "420jpeg", "422", "444", "mono"} {
+		t.Run(cs, func(t *testing.T) {
+			var (
+				buf bytes.Buffer
+				h   = Header{Width: width, Height: height, Rate: Ratio{24, 1}, ColorSpace: cs}
+			)
+			if err := Generate(&buf, h, count, frames); err != nil {
+				t.Fatalf("generating: %v", err)
+			}
+			encoded := buf.Bytes()
+			r, err := NewReader(bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("reading header: %v", err)
+			}
+			h.Interlace = 'p'
+			if !reflect.DeepEqual(r.Header, h) {
+				t.Errorf("header = %+v, want %+v", r.Header, h)
+			}
+			var (
+				again bytes.Buffer
+				w, _  = NewWriter(&again, r.Header)
+				n     int
+			)
+			for ; ; n++ {
+				img, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("reading frame %d: %v", n, err)
+				}
+				compare(t, n, frames(n), img, cs)
+				if err := w.WriteFrame(img); err != nil {
+					t.Fatalf("writing frame %d: %v", n, err)
+				}
+			}
+			if n != count {
+				t.Errorf("read %d frames, want %d", n, count)
+			}
+			// Decoded frames are written back unchanged.
+			if !bytes.Equal(again.Bytes(), encoded) {
+				t.Errorf("stream changed when rewritten")
+			}
+		})
+	}
+}
+
+// compare checks that the decoded frame n holds the luma of the source, and
+// its chroma too when the chroma isn't subsampled.
+func compare(t *testing.T, n int, src, got image.Image, cs string) {
+	t.Helper()
+	b := src.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := src.At(x, y).RGBA()
+			yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+			switch img := got.(type) {
+			case *image.Gray:
+				want := color.GrayModel.Convert(src.At(x, y)).(color.Gray)
+				if v := img.GrayAt(x, y); v != want {
+					t.Fatalf("frame %d (%d, %d) = %v, want %v", n, x, y, v, want)
+				}
+			case *image.YCbCr:
+				v := img.YCbCrAt(x, y)
+				if v.Y != yy {
+					t.Fatalf("frame %d (%d, %d) has luma %d, want %d", n, x, y, v.Y, yy)
+				}
+				if cs == "444" && (v.Cb != cb || v.Cr != cr) {
+					t.Fatalf("frame %d (%d, %d) has chroma %d,%d, want %d,%d", n, x, y, v.Cb, v.Cr, cb, cr)
+				}
+			default:
+				t.Fatalf("frame %d is a %T", n, got)
+			}
+		}
+	}
+}
+
+func TestWriteFramePads(t *testing.T) {
+	var (
+		buf bytes.Buffer
+		h   = Header{Width: 4, Height: 4, Rate: Ratio{1, 1}, ColorSpace: "mono"}
+	)
+	w, err := NewWriter(&buf, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A 2x2 white frame, offset from the origin, lands in the top left.
+	if err := w.WriteFrame(Solid(2, 2, color.White)(0).(*image.RGBA).SubImage(image.Rect(1, 1, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint8{
+		255, 0, 0, 0,
+		0, 0, 0, 0,
+		0, 0, 0, 0,
+		0, 0, 0, 0,
+	}
+	if got := img.(*image.Gray).Pix; !bytes.Equal(got, want) {
+		t.Errorf("pixels = %v, want %v", got, want)
+	}
+}
+
+func TestNewWriterRejects(t *testing.T) {
+	for _, h := range []Header{
+		{Width: 0, Height: 2, Rate: Ratio{1, 1}},
+		{Width: 2, Height: 2},
+		{Width: 2, Height: 2, Rate: Ratio{1, 1}, ColorSpace: "411"},
+	} {
+		if _, err := NewWriter(io.Discard, h); err == nil {
+			t.Errorf("NewWriter(%+v) succeeded", h)
+		}
+	}
+}
+
+func TestTruncatedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	h := Header{Width: 4, Height: 4, Rate: Ratio{1, 1}}
+	if err := Generate(&buf, h, 1, Solid(4, 4, color.White)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Errorf("reading a truncated frame gave %v, want an error", err)
+	}
+}